@@ -0,0 +1,51 @@
+package boot
+
+import "fmt"
+
+// Delivery is where the next server, bootfile and tftp server name are put
+// in replies. Old PXE ROMs only read the fixed BOOTP header fields, while
+// the options can be longer and are what everything else reads.
+type Delivery int
+
+const (
+	// DeliverBoth fills the header fields and sends the options.
+	DeliverBoth Delivery = iota
+	// DeliverHeader only fills the sname and file header fields.
+	DeliverHeader
+	// DeliverOptions only sends options 66 and 67.
+	DeliverOptions
+)
+
+var deliveries = map[string]Delivery{
+	"both":    DeliverBoth,
+	"header":  DeliverHeader,
+	"options": DeliverOptions,
+}
+
+// ParseDelivery parses one of both, header or options.
+func ParseDelivery(s string) (Delivery, error) {
+	d, ok := deliveries[s]
+	if !ok {
+		return DeliverBoth, fmt.Errorf("invalid boot delivery '%s', must be one of both, header or options", s)
+	}
+	return d, nil
+}
+
+func (d Delivery) String() string {
+	for s, v := range deliveries {
+		if v == d {
+			return s
+		}
+	}
+	return fmt.Sprintf("Delivery(%d)", int(d))
+}
+
+// Header returns true if the header fields are to be filled.
+func (d Delivery) Header() bool {
+	return d != DeliverOptions
+}
+
+// Options returns true if options 66 and 67 are to be sent.
+func (d Delivery) Options() bool {
+	return d != DeliverHeader
+}
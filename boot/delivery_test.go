@@ -0,0 +1,23 @@
+package boot
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDelivery(t *testing.T) {
+	for s, want := range map[string]Delivery{"both": DeliverBoth, "header": DeliverHeader, "options": DeliverOptions} {
+		d, err := ParseDelivery(s)
+		assert.Nil(t, err)
+		assert.Equal(t, want, d)
+		assert.Equal(t, s, d.String())
+	}
+
+	_, err := ParseDelivery("fields")
+	assert.NotNil(t, err)
+
+	assert.True(t, DeliverBoth.Header() && DeliverBoth.Options())
+	assert.True(t, DeliverHeader.Header() && !DeliverHeader.Options())
+	assert.True(t, !DeliverOptions.Header() && DeliverOptions.Options())
+}
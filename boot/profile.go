@@ -0,0 +1,114 @@
+// Package boot selects what network booting clients are handed out, by what
+// they tell about themselves: BIOS and UEFI firmware need different boot
+// files, and iPXE once running is best pointed at a script over HTTP.
+package boot
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// ProfileJSON is a boot profile as it exists in the configuration and
+// options files, i.e.
+//
+//	{"Name": "ipxe", "UserClass": "iPXE", "Bootfile": "http://boot.example.com/boot.ipxe"}
+//	{"Name": "uefi", "Arch": [7, 9], "Bootfile": "ipxe.efi", "NextServer": "192.0.2.69"}
+//	{"Name": "bios", "Arch": [0], "Bootfile": "undionly.kpxe", "Tftp": "192.0.2.69"}
+type ProfileJSON struct {
+	Name string
+
+	// What a request must match, unset criteria match anything
+	Arch        []uint16 // Option 93, any of the client's architectures
+	UserClass   string   // Option 77, any of the client's user classes
+	VendorClass string   // Option 60, prefix of the client's vendor class
+
+	// What is handed out, unset values aren't overridden
+	Bootfile   string // Option 67
+	NextServer string // Address, siaddr
+	Tftp       string // Option 66, address or name
+}
+
+// Profile is a parsed boot profile.
+type Profile struct {
+	Name string
+
+	Arch        []iana.Arch
+	UserClass   string
+	VendorClass string
+
+	Bootfile   string
+	NextServer net.IP // nil if not set
+	Tftp       string
+}
+
+// Parse validates p.
+func (p ProfileJSON) Parse() (Profile, error) {
+	profile := Profile{
+		Name:        p.Name,
+		UserClass:   p.UserClass,
+		VendorClass: p.VendorClass,
+		Bootfile:    p.Bootfile,
+		Tftp:        p.Tftp,
+	}
+	if p.Name == "" {
+		return Profile{}, errors.New("boot profile without a name")
+	}
+	for _, a := range p.Arch {
+		profile.Arch = append(profile.Arch, iana.Arch(a))
+	}
+	if p.NextServer != "" {
+		profile.NextServer = net.ParseIP(p.NextServer).To4()
+		if profile.NextServer == nil {
+			return Profile{}, fmt.Errorf("boot profile %s: invalid next server %s", p.Name, p.NextServer)
+		}
+	}
+	if p.Bootfile == "" && p.NextServer == "" && p.Tftp == "" {
+		return Profile{}, fmt.Errorf("boot profile %s hands out nothing", p.Name)
+	}
+	return profile, nil
+}
+
+// ParseProfiles validates profiles, failing on the first invalid one.
+func ParseProfiles(profiles []ProfileJSON) ([]Profile, error) {
+	var parsed []Profile
+	for _, p := range profiles {
+		profile, err := p.Parse()
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, profile)
+	}
+	return parsed, nil
+}
+
+// Matches returns true if req meets all criteria of p.
+func (p *Profile) Matches(req *dhcpv4.DHCPv4) bool {
+	if len(p.Arch) > 0 && !slices.ContainsFunc(req.ClientArch(), func(a iana.Arch) bool {
+		return slices.Contains(p.Arch, a)
+	}) {
+		return false
+	}
+	if p.UserClass != "" && !slices.Contains(req.UserClass(), p.UserClass) {
+		return false
+	}
+	if p.VendorClass != "" && !strings.HasPrefix(req.ClassIdentifier(), p.VendorClass) {
+		return false
+	}
+	return true
+}
+
+// Select returns the first of profiles req matches, nil if none does.
+func Select(profiles []Profile, req *dhcpv4.DHCPv4) *Profile {
+	for i := range profiles {
+		if profiles[i].Matches(req) {
+			return &profiles[i]
+		}
+	}
+	return nil
+}
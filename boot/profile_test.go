@@ -0,0 +1,83 @@
+package boot
+
+import (
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	p, err := ProfileJSON{Name: "uefi", Arch: []uint16{7, 9}, Bootfile: "ipxe.efi", NextServer: "192.0.2.69"}.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, []iana.Arch{iana.EFI_X86_64, iana.EFI_BC}, p.Arch)
+	assert.Equal(t, "192.0.2.69", p.NextServer.String())
+
+	invalid := []ProfileJSON{
+		{Bootfile: "ipxe.efi"},
+		{Name: "bad-next-server", NextServer: "boot.example.com"},
+		{Name: "empty", Arch: []uint16{0}},
+	}
+	for _, p := range invalid {
+		_, err := p.Parse()
+		assert.NotNil(t, err, "Invalid profile accepted: %+v", p)
+	}
+
+	_, err = ParseProfiles(append([]ProfileJSON{{Name: "ok", Bootfile: "x"}}, invalid...))
+	assert.NotNil(t, err)
+}
+
+func TestSelect(t *testing.T) {
+	profiles, err := ParseProfiles([]ProfileJSON{
+		{Name: "ipxe", UserClass: "iPXE", Bootfile: "http://boot.example.com/boot.ipxe"},
+		{Name: "uefi", Arch: []uint16{7, 9}, VendorClass: "PXEClient", Bootfile: "ipxe.efi"},
+		{Name: "bios", Arch: []uint16{0}, Bootfile: "undionly.kpxe"},
+	})
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name string
+		mods []dhcpv4.Modifier
+		want string
+	}{
+		{"nothing", nil, ""},
+		{"bios", []dhcpv4.Modifier{
+			dhcpv4.WithOption(dhcpv4.OptClientArch(iana.INTEL_X86PC)),
+			dhcpv4.WithOption(dhcpv4.OptClassIdentifier("PXEClient:Arch:00000:UNDI:002001")),
+		}, "bios"},
+		{"uefi", []dhcpv4.Modifier{
+			dhcpv4.WithOption(dhcpv4.OptClientArch(iana.EFI_BC)),
+			dhcpv4.WithOption(dhcpv4.OptClassIdentifier("PXEClient:Arch:00009:UNDI:003016")),
+		}, "uefi"},
+		{"uefi without vendor class", []dhcpv4.Modifier{
+			dhcpv4.WithOption(dhcpv4.OptClientArch(iana.EFI_X86_64)),
+		}, ""},
+		{"ipxe on uefi", []dhcpv4.Modifier{
+			dhcpv4.WithOption(dhcpv4.OptClientArch(iana.EFI_X86_64)),
+			dhcpv4.WithOption(dhcpv4.OptClassIdentifier("PXEClient:Arch:00007:UNDI:003016")),
+			dhcpv4.WithOption(dhcpv4.OptUserClass("iPXE")),
+		}, "ipxe"},
+		{"rfc 3004 user class", []dhcpv4.Modifier{
+			dhcpv4.WithOption(dhcpv4.OptRFC3004UserClass([]string{"other", "iPXE"})),
+		}, "ipxe"},
+		{"arm64", []dhcpv4.Modifier{
+			dhcpv4.WithOption(dhcpv4.OptClientArch(iana.EFI_ARM64)),
+			dhcpv4.WithOption(dhcpv4.OptClassIdentifier("PXEClient:Arch:00011:UNDI:003016")),
+		}, ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := dhcpv4.New(append([]dhcpv4.Modifier{dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover)}, tc.mods...)...)
+			assert.Nil(t, err)
+
+			p := Select(profiles, req)
+			if tc.want == "" {
+				assert.Nil(t, p)
+			} else if assert.NotNil(t, p) {
+				assert.Equal(t, tc.want, p.Name)
+			}
+		})
+	}
+}
@@ -0,0 +1,359 @@
+package config
+
+// The global configuration. Settings come from command line flags and an
+// optional JSON file, get validated and are then turned into an immutable
+// Config that can be swapped atomically when the file gets reloaded.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/linode/dhcpd-unnumbered/boot"
+	"github.com/linode/dhcpd-unnumbered/ratelimit"
+)
+
+// Settings are the raw settings as given on the command line or in the
+// configuration file, before validation.
+type Settings struct {
+	LeaseTime          time.Duration
+	Regex              string
+	PvtCIDR            string
+	DNS                []string
+	DNS6               []string
+	Tftp               string
+	DynamicHostname    bool
+	HostnameOverride   bool
+	OverrideFilePrefix string
+	Hostname           string
+	Domainname         string
+	Bootfile           string
+	BootDelivery       string
+	Classless          bool
+	ClasslessGateway   string
+	RelayAgents        []string
+
+	ClientRate     float64
+	ClientBurst    int
+	InterfaceRate  float64
+	InterfaceBurst int
+	// Keyed by VRF name, unset values fall back to the ones above
+	VRFRateLimits map[string]RateLimitOverride
+
+	// Only set in the configuration file
+	BootProfiles []boot.ProfileJSON
+}
+
+// RateLimitOverride overrides rate limits for the listener of a VRF. Nil
+// values are not overridden.
+type RateLimitOverride struct {
+	ClientRate     *float64 `json:"client-rate"`
+	ClientBurst    *int     `json:"client-burst"`
+	InterfaceRate  *float64 `json:"interface-rate"`
+	InterfaceBurst *int     `json:"interface-burst"`
+}
+
+// RateLimits are the limits applied to requests per client (interface and MAC)
+// and per interface.
+type RateLimits struct {
+	Client    ratelimit.Limit
+	Interface ratelimit.Limit
+}
+
+// This struct defines the configuration file as it exists on disk. Keys are
+// named after the command line flags they correspond to, missing keys count
+// as not set.
+type configJSON struct {
+	LeaseTime          *string  `json:"leasetime"` // Duration, i.e. 30m
+	Regex              *string  `json:"regex"`
+	PvtCIDR            *string  `json:"pvtcidr"`
+	DNS                []string `json:"dns"`
+	DNS6               []string `json:"dns6"`
+	Tftp               *string  `json:"tftp"`
+	DynamicHostname    *bool    `json:"dynamic-hostname"`
+	HostnameOverride   *bool    `json:"hostname-override"`
+	OverrideFilePrefix *string  `json:"override-file-prefix"`
+	Hostname           *string  `json:"hostname"`
+	Domainname         *string  `json:"domainname"`
+	Bootfile           *string  `json:"bootfile"`
+	BootDelivery       *string  `json:"boot-delivery"`
+	Classless          *bool    `json:"classless"`
+	ClasslessGateway   *string  `json:"classless-gateway"`
+	RelayAgents        []string `json:"relay-agents"`
+
+	ClientRate     *float64                     `json:"client-rate"`
+	ClientBurst    *int                         `json:"client-burst"`
+	InterfaceRate  *float64                     `json:"interface-rate"`
+	InterfaceBurst *int                         `json:"interface-burst"`
+	VRFRateLimits  map[string]RateLimitOverride `json:"vrf-ratelimits"`
+
+	BootProfiles []boot.ProfileJSON `json:"boot-profiles"`
+}
+
+// Config is the validated configuration. It must not be modified once
+// created, create a new one instead.
+type Config struct {
+	LeaseTime          time.Duration
+	TapRegex           *regexp.Regexp
+	PvtIPs             *net.IPNet
+	DNS                []net.IP
+	DNS6               []net.IP // handed out over DHCPv6, none if empty
+	Tftp               net.IP   // nil if not set
+	DynamicHostname    bool
+	HostnameOverride   bool
+	OverrideFilePrefix string
+	Hostname           string
+	Domainname         string
+	Bootfile           string
+	BootDelivery       boot.Delivery
+	Classless          bool
+	ClasslessGateway   net.IP // nil if not set
+	// Relayed requests are only served from these, and dropped if empty
+	RelayAgents []*net.IPNet
+
+	RateLimits    RateLimits
+	VRFRateLimits map[string]RateLimits
+
+	// Tried in order, the first one matching a request is used
+	BootProfiles []boot.Profile
+}
+
+// DefaultDNS is used if no DNS servers are configured.
+var DefaultDNS = net.IPv4(8, 8, 8, 8).To4()
+
+// LoadFile reads the configuration file at path and applies it on top of s.
+// Settings whose flag name is in pinned were given on the command line and
+// are left untouched. Unknown keys or values that cannot be parsed fail the
+// whole file.
+func LoadFile(path string, s *Settings, pinned map[string]bool) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	var onDisk configJSON
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&onDisk); err != nil {
+		return fmt.Errorf("failed to unmarshal config file %s: %v", path, err)
+	}
+
+	return onDisk.apply(s, pinned)
+}
+
+func (f *configJSON) apply(s *Settings, pinned map[string]bool) error {
+	if f.LeaseTime != nil && !pinned["leasetime"] {
+		d, err := time.ParseDuration(*f.LeaseTime)
+		if err != nil {
+			return fmt.Errorf("invalid leasetime: %v", err)
+		}
+		s.LeaseTime = d
+	}
+	setString(&s.Regex, f.Regex, pinned["regex"])
+	setString(&s.PvtCIDR, f.PvtCIDR, pinned["pvtcidr"])
+	if f.DNS != nil && !pinned["dns"] {
+		s.DNS = f.DNS
+	}
+	if f.DNS6 != nil && !pinned["dns6"] {
+		s.DNS6 = f.DNS6
+	}
+	setString(&s.Tftp, f.Tftp, pinned["tftp"])
+	setBool(&s.DynamicHostname, f.DynamicHostname, pinned["dynamic-hostname"])
+	setBool(&s.HostnameOverride, f.HostnameOverride, pinned["hostname-override"])
+	setString(&s.OverrideFilePrefix, f.OverrideFilePrefix, pinned["override-file-prefix"])
+	setString(&s.Hostname, f.Hostname, pinned["hostname"])
+	setString(&s.Domainname, f.Domainname, pinned["domainname"])
+	setString(&s.Bootfile, f.Bootfile, pinned["bootfile"])
+	setString(&s.BootDelivery, f.BootDelivery, pinned["boot-delivery"])
+	setBool(&s.Classless, f.Classless, pinned["classless"])
+	setString(&s.ClasslessGateway, f.ClasslessGateway, pinned["classless-gateway"])
+	if f.RelayAgents != nil && !pinned["relay-agents"] {
+		s.RelayAgents = f.RelayAgents
+	}
+	setFloat(&s.ClientRate, f.ClientRate, pinned["client-rate"])
+	setInt(&s.ClientBurst, f.ClientBurst, pinned["client-burst"])
+	setFloat(&s.InterfaceRate, f.InterfaceRate, pinned["interface-rate"])
+	setInt(&s.InterfaceBurst, f.InterfaceBurst, pinned["interface-burst"])
+	if f.VRFRateLimits != nil {
+		s.VRFRateLimits = f.VRFRateLimits
+	}
+	if f.BootProfiles != nil {
+		s.BootProfiles = f.BootProfiles
+	}
+	return nil
+}
+
+func setString(dst *string, v *string, pinned bool) {
+	if v != nil && !pinned {
+		*dst = *v
+	}
+}
+
+func setBool(dst *bool, v *bool, pinned bool) {
+	if v != nil && !pinned {
+		*dst = *v
+	}
+}
+
+func setFloat(dst *float64, v *float64, pinned bool) {
+	if v != nil && !pinned {
+		*dst = *v
+	}
+}
+
+func setInt(dst *int, v *int, pinned bool) {
+	if v != nil && !pinned {
+		*dst = *v
+	}
+}
+
+// Parse validates the settings and turns them into a Config.
+func (s *Settings) Parse() (*Config, error) {
+	c := &Config{
+		LeaseTime:          s.LeaseTime,
+		DynamicHostname:    s.DynamicHostname,
+		HostnameOverride:   s.HostnameOverride,
+		OverrideFilePrefix: s.OverrideFilePrefix,
+		Hostname:           s.Hostname,
+		Domainname:         s.Domainname,
+		Bootfile:           s.Bootfile,
+		Classless:          s.Classless,
+	}
+
+	if s.LeaseTime <= 0 {
+		return nil, fmt.Errorf("lease time must be positive, got %s", s.LeaseTime)
+	}
+
+	var err error
+	c.TapRegex, err = regexp.Compile(s.Regex)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse interface regex: %v", err)
+	}
+
+	_, c.PvtIPs, err = net.ParseCIDR(s.PvtCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse private IP range: %v", err)
+	}
+
+	for _, d := range s.DNS {
+		ip := net.ParseIP(d)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid dns server: %s", d)
+		}
+		c.DNS = append(c.DNS, ip)
+	}
+	if len(c.DNS) == 0 {
+		c.DNS = []net.IP{DefaultDNS}
+	}
+
+	for _, d := range s.DNS6 {
+		ip := net.ParseIP(d)
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6 dns server: %s", d)
+		}
+		c.DNS6 = append(c.DNS6, ip)
+	}
+
+	if s.Tftp != "" {
+		c.Tftp = net.ParseIP(s.Tftp)
+		if c.Tftp == nil {
+			return nil, fmt.Errorf("invalid tftp server: %s", s.Tftp)
+		}
+	}
+
+	if s.ClasslessGateway != "" {
+		c.ClasslessGateway = net.ParseIP(s.ClasslessGateway).To4()
+		if c.ClasslessGateway == nil {
+			return nil, fmt.Errorf("unable to parse classless gateway: %s", s.ClasslessGateway)
+		}
+	}
+
+	for _, r := range s.RelayAgents {
+		_, ipn, err := net.ParseCIDR(r)
+		if err != nil {
+			// A single agent
+			ip := net.ParseIP(r).To4()
+			if ip == nil {
+				return nil, fmt.Errorf("invalid relay agent: %s", r)
+			}
+			ipn = &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+		}
+		c.RelayAgents = append(c.RelayAgents, ipn)
+	}
+
+	c.RateLimits = RateLimits{
+		Client:    ratelimit.Limit{Rate: s.ClientRate, Burst: s.ClientBurst},
+		Interface: ratelimit.Limit{Rate: s.InterfaceRate, Burst: s.InterfaceBurst},
+	}
+	if err := c.RateLimits.validate(); err != nil {
+		return nil, err
+	}
+
+	c.VRFRateLimits = make(map[string]RateLimits)
+	for vrf, o := range s.VRFRateLimits {
+		limits := c.RateLimits
+		if o.ClientRate != nil {
+			limits.Client.Rate = *o.ClientRate
+		}
+		if o.ClientBurst != nil {
+			limits.Client.Burst = *o.ClientBurst
+		}
+		if o.InterfaceRate != nil {
+			limits.Interface.Rate = *o.InterfaceRate
+		}
+		if o.InterfaceBurst != nil {
+			limits.Interface.Burst = *o.InterfaceBurst
+		}
+		if err := limits.validate(); err != nil {
+			return nil, fmt.Errorf("VRF %s: %v", vrf, err)
+		}
+		c.VRFRateLimits[vrf] = limits
+	}
+
+	if s.BootDelivery != "" {
+		c.BootDelivery, err = boot.ParseDelivery(s.BootDelivery)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.BootProfiles, err = boot.ParseProfiles(s.BootProfiles)
+	if err != nil {
+		return nil, fmt.Errorf("invalid boot profiles: %v", err)
+	}
+
+	return c, nil
+}
+
+// RateLimitsFor returns the rate limits of the listener bound to vrf, or of
+// the wildcard listener if vrf is empty.
+func (c *Config) RateLimitsFor(vrf string) RateLimits {
+	if limits, ok := c.VRFRateLimits[vrf]; ok {
+		return limits
+	}
+	return c.RateLimits
+}
+
+// TrustsRelay returns true if relayed requests from ip are served.
+func (c *Config) TrustsRelay(ip net.IP) bool {
+	for _, ipn := range c.RelayAgents {
+		if ipn.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r RateLimits) validate() error {
+	if r.Client.Rate < 0 || r.Client.Burst < 0 {
+		return fmt.Errorf("invalid client rate limit %v/s, burst %d", r.Client.Rate, r.Client.Burst)
+	}
+	if r.Interface.Rate < 0 || r.Interface.Burst < 0 {
+		return fmt.Errorf("invalid interface rate limit %v/s, burst %d", r.Interface.Rate, r.Interface.Burst)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package config
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/linode/dhcpd-unnumbered/boot"
+	"github.com/stretchr/testify/assert"
+)
+
+func defaults() Settings {
+	return Settings{
+		LeaseTime: 30 * time.Minute,
+		Regex:     "tap.*_0",
+		PvtCIDR:   "192.168.0.0/16",
+		Hostname:  "localhost",
+	}
+}
+
+func writeFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(content), 0644)
+	assert.Nil(t, err, "Failed to write config file")
+	return path
+}
+
+func TestLoadFile(t *testing.T) {
+	path := writeFile(t, `
+{
+  "leasetime":        "1h",
+  "regex":            "vnet.*",
+  "dns":              ["1.1.1.1", "9.9.9.9"],
+  "dns6":             ["2001:db8::53"],
+  "hostname":         "from-file",
+  "dynamic-hostname": true
+}
+`)
+	s := defaults()
+	// hostname was given on the command line
+	err := LoadFile(path, &s, map[string]bool{"hostname": true})
+	assert.Nil(t, err)
+
+	c, err := s.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, time.Hour, c.LeaseTime, "Bad LeaseTime")
+	assert.Equal(t, "vnet.*", c.TapRegex.String(), "Bad Regex")
+	assert.Equal(t, 2, len(c.DNS), "Bad DNS")
+	assert.Equal(t, []net.IP{net.ParseIP("2001:db8::53")}, c.DNS6, "Bad DNS6")
+	assert.Equal(t, "localhost", c.Hostname, "Command line flag not honoured")
+	assert.True(t, c.DynamicHostname, "Bad DynamicHostname")
+	// Not in the file
+	assert.Equal(t, "192.168.0.0/16", c.PvtIPs.String(), "Bad PvtIPs")
+}
+
+func TestLoadFileInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"not json", `leasetime: 1h`},
+		{"unknown key", `{"leastime": "1h"}`},
+		{"bad duration", `{"leasetime": "forever"}`},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := defaults()
+			err := LoadFile(writeFile(t, tc.content), &s, nil)
+			assert.NotNil(t, err)
+		})
+	}
+
+	s := defaults()
+	err := LoadFile("/does-not-exist.json", &s, nil)
+	assert.NotNil(t, err, "Missing file accepted")
+}
+
+func TestParse(t *testing.T) {
+	s := defaults()
+	c, err := s.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(c.DNS), "No default DNS")
+	assert.True(t, c.DNS[0].Equal(DefaultDNS), "Bad default DNS")
+	assert.Nil(t, c.DNS6, "DNS6 not empty")
+	assert.Nil(t, c.Tftp, "Tftp not empty")
+	assert.Nil(t, c.ClasslessGateway, "ClasslessGateway not empty")
+
+	invalid := []func(s *Settings){
+		func(s *Settings) { s.LeaseTime = 0 },
+		func(s *Settings) { s.Regex = "tap(" },
+		func(s *Settings) { s.PvtCIDR = "192.168.0.0" },
+		func(s *Settings) { s.DNS = []string{"dns.google"} },
+		func(s *Settings) { s.DNS6 = []string{"9.9.9.9"} },
+		func(s *Settings) { s.Tftp = "tftp.example.com" },
+		func(s *Settings) { s.ClasslessGateway = "fe80::1" },
+	}
+	for _, mod := range invalid {
+		s := defaults()
+		mod(&s)
+		_, err := s.Parse()
+		assert.NotNil(t, err, "Invalid settings accepted: %+v", s)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	path := writeFile(t, `
+{
+  "client-rate":    2,
+  "client-burst":   5,
+  "interface-rate": 20,
+  "vrf-ratelimits": {
+    "vrf-blue": {"client-rate": 0.5, "interface-burst": 10}
+  }
+}
+`)
+	s := defaults()
+	s.InterfaceBurst = 50
+	err := LoadFile(path, &s, nil)
+	assert.Nil(t, err)
+
+	c, err := s.Parse()
+	assert.Nil(t, err)
+
+	global := c.RateLimitsFor("")
+	assert.Equal(t, 2.0, global.Client.Rate, "Bad client rate")
+	assert.Equal(t, 5, global.Client.Burst, "Bad client burst")
+	assert.Equal(t, 20.0, global.Interface.Rate, "Bad interface rate")
+	assert.Equal(t, 50, global.Interface.Burst, "Bad interface burst")
+
+	// Overridden values, others inherited
+	blue := c.RateLimitsFor("vrf-blue")
+	assert.Equal(t, 0.5, blue.Client.Rate, "Bad VRF client rate")
+	assert.Equal(t, 5, blue.Client.Burst, "Bad VRF client burst")
+	assert.Equal(t, 20.0, blue.Interface.Rate, "Bad VRF interface rate")
+	assert.Equal(t, 10, blue.Interface.Burst, "Bad VRF interface burst")
+
+	// Unknown VRFs get the global limits
+	assert.Equal(t, global, c.RateLimitsFor("vrf-red"))
+
+	s.VRFRateLimits["vrf-red"] = RateLimitOverride{InterfaceRate: new(float64)}
+	*s.VRFRateLimits["vrf-red"].InterfaceRate = -1
+	_, err = s.Parse()
+	assert.NotNil(t, err, "Negative rate accepted")
+}
+
+func TestBootProfiles(t *testing.T) {
+	path := writeFile(t, `
+{
+  "boot-profiles": [
+    {"name": "ipxe", "userclass": "iPXE", "bootfile": "http://boot.example.com/boot.ipxe"},
+    {"name": "bios", "arch": [0], "bootfile": "undionly.kpxe", "nextserver": "192.0.2.69"}
+  ]
+}
+`)
+	s := defaults()
+	err := LoadFile(path, &s, nil)
+	assert.Nil(t, err)
+
+	c, err := s.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(c.BootProfiles), "Bad BootProfiles")
+	assert.Equal(t, "ipxe", c.BootProfiles[0].Name, "Profiles out of order")
+	assert.Equal(t, "192.0.2.69", c.BootProfiles[1].NextServer.String(), "Bad NextServer")
+
+	s.BootProfiles[1].NextServer = "boot.example.com"
+	_, err = s.Parse()
+	assert.NotNil(t, err, "Invalid boot profile accepted")
+}
+
+func TestBootDelivery(t *testing.T) {
+	path := writeFile(t, `{"boot-delivery": "header"}`)
+	s := defaults()
+	err := LoadFile(path, &s, nil)
+	assert.Nil(t, err)
+
+	c, err := s.Parse()
+	assert.Nil(t, err)
+	assert.Equal(t, boot.DeliverHeader, c.BootDelivery, "Bad BootDelivery")
+
+	s.BootDelivery = "bootp"
+	_, err = s.Parse()
+	assert.NotNil(t, err, "Invalid boot delivery accepted")
+}
+
+func TestRelayAgents(t *testing.T) {
+	path := writeFile(t, `{"relay-agents": ["192.0.2.0/24", "198.51.100.7"]}`)
+	s := defaults()
+	err := LoadFile(path, &s, nil)
+	assert.Nil(t, err)
+
+	c, err := s.Parse()
+	assert.Nil(t, err)
+	assert.True(t, c.TrustsRelay(net.IPv4(192, 0, 2, 254)))
+	assert.True(t, c.TrustsRelay(net.IPv4(198, 51, 100, 7)))
+	assert.False(t, c.TrustsRelay(net.IPv4(198, 51, 100, 8)))
+
+	// Nothing is trusted by default
+	d := defaults()
+	c, err = d.Parse()
+	assert.Nil(t, err)
+	assert.False(t, c.TrustsRelay(net.IPv4(192, 0, 2, 1)))
+
+	s.RelayAgents = []string{"tor1"}
+	_, err = s.Parse()
+	assert.NotNil(t, err, "Invalid relay agent accepted")
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/linode/dhcpd-unnumbered/boot"
+	"github.com/linode/dhcpd-unnumbered/control"
+	"github.com/linode/dhcpd-unnumbered/leases"
+	"github.com/linode/dhcpd-unnumbered/monitor"
+	"github.com/linode/dhcpd-unnumbered/options"
+	ll "github.com/sirupsen/logrus"
+)
+
+// inspectable is a listener that can describe itself.
+type inspectable interface {
+	Info() ListenerInfo
+}
+
+// registry tracks the listeners and monitors of the daemon, so they can be
+// inspected through the control socket.
+type registry struct {
+	mu        sync.Mutex
+	listeners map[string]inspectable
+	monitors  map[string]*monitor.NetlinkMonitor
+}
+
+var active = &registry{
+	listeners: make(map[string]inspectable),
+	monitors:  make(map[string]*monitor.NetlinkMonitor),
+}
+
+func (r *registry) addListener(name string, l inspectable) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.listeners[name] = l
+}
+
+func (r *registry) removeListener(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.listeners, name)
+}
+
+func (r *registry) addMonitor(name string, m *monitor.NetlinkMonitor) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.monitors[name] = m
+}
+
+// interfaceOptions are the options in effect for an interface. Those depending
+// on the address handed out (dynamic hostname, order of DNS servers) are
+// applied per request on top.
+type interfaceOptions struct {
+	Interface       string   `json:"interface"`
+	OptionsFile     string   `json:"options-file,omitempty"`
+	IPv4            []string `json:"ipv4,omitempty"`
+	IPv6            []string `json:"ipv6,omitempty"`
+	Hostname        string   `json:"hostname"`
+	DynamicHostname bool     `json:"dynamic-hostname"`
+	Domainname      string   `json:"domainname"`
+	Gateway         string   `json:"gateway,omitempty"`
+	PvtIPs          string   `json:"pvtcidr"`
+	LeaseTime       string   `json:"leasetime"`
+	DNS             []string `json:"dns"`
+	DNS6            []string `json:"dns6,omitempty"`
+	NTP             []string `json:"ntp,omitempty"`
+	InterfaceMTU    uint16   `json:"mtu,omitempty"`
+	DomainSearch    []string `json:"domain-search,omitempty"`
+	Bootfile        string   `json:"bootfile,omitempty"`
+	Tftp            string   `json:"tftp,omitempty"`
+	Classless       bool     `json:"classless"`
+	RawOptions      []string `json:"raw-options,omitempty"`
+	BootProfiles    []string `json:"boot-profiles,omitempty"`
+}
+
+func profileNames(profiles []boot.Profile) []string {
+	var s []string
+	for _, p := range profiles {
+		s = append(s, p.Name)
+	}
+	return s
+}
+
+func ipStrings(ips []net.IP) []string {
+	var s []string
+	for _, ip := range ips {
+		s = append(s, ip.String())
+	}
+	return s
+}
+
+// effectiveOptions merges the configuration with the hostname override and
+// options files of ifName, the same way requests are handled. Interfaces in
+// other namespaces are given as <netns>/<interface>.
+func effectiveOptions(ifName string) (*interfaceOptions, error) {
+	c := cfg.Load()
+
+	nsName, name, ok := strings.Cut(ifName, "/")
+	if !ok {
+		nsName, name = "", ifName
+	}
+	// Both end up in the path of the override files
+	if !options.ValidName(name) || (ok && !options.ValidName(nsName)) {
+		return nil, fmt.Errorf("invalid interface name '%s'", ifName)
+	}
+	file := overrideName(nsName, name)
+
+	o := &interfaceOptions{
+		Interface:       ifName,
+		Hostname:        c.Hostname,
+		DynamicHostname: c.DynamicHostname,
+		Domainname:      c.Domainname,
+		PvtIPs:          c.PvtIPs.String(),
+		LeaseTime:       c.LeaseTime.String(),
+		DNS:             ipStrings(c.DNS),
+		DNS6:            ipStrings(c.DNS6),
+		Bootfile:        c.Bootfile,
+		Classless:       c.Classless,
+		BootProfiles:    profileNames(c.BootProfiles),
+	}
+	if c.Tftp != nil {
+		o.Tftp = c.Tftp.String()
+	}
+
+	if !c.HostnameOverride {
+		return o, nil
+	}
+
+	if h, d, err := getHostnameOverride(c.OverrideFilePrefix, file); err == nil {
+		o.Hostname = h
+		o.DynamicHostname = false
+		if d != "" {
+			o.Domainname = d
+		}
+	}
+
+	log := ll.NewEntry(ll.StandardLogger()).WithFields(ll.Fields{"interface": ifName})
+	opts, err := getOptionsOverride(log, c.OverrideFilePrefix, file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read options file: %v", err)
+	}
+	return o.merge(path.Join(c.OverrideFilePrefix, file+".options"), opts), nil
+}
+
+// merge applies the options read from file.
+func (o *interfaceOptions) merge(file string, opts *options.DHCP) *interfaceOptions {
+	if _, err := os.Stat(file); err == nil {
+		o.OptionsFile = file
+	}
+	for _, ipn := range opts.IPv4 {
+		o.IPv4 = append(o.IPv4, ipn.String())
+	}
+	o.IPv6 = ipStrings(opts.IPv6)
+	if opts.Hostname != nil {
+		o.Hostname = *opts.Hostname
+		o.DynamicHostname = false
+	}
+	if opts.Domainname != nil {
+		o.Domainname = *opts.Domainname
+	}
+	if opts.Gateway != nil {
+		o.Gateway = opts.Gateway.String()
+	}
+	if opts.PvtIPs != nil {
+		o.PvtIPs = opts.PvtIPs.String()
+	}
+	if opts.LeaseTime != nil {
+		o.LeaseTime = opts.LeaseTime.String()
+	}
+	if len(opts.DNS) > 0 {
+		o.DNS = ipStrings(opts.DNS)
+	}
+	if len(opts.DNS6) > 0 {
+		o.DNS6 = ipStrings(opts.DNS6)
+	}
+	o.NTP = ipStrings(opts.NTP)
+	if opts.InterfaceMTU != nil {
+		o.InterfaceMTU = *opts.InterfaceMTU
+	}
+	o.DomainSearch = opts.DomainSearch
+	if opts.Bootfile != nil {
+		o.Bootfile = *opts.Bootfile
+	}
+	if opts.Tftp != nil {
+		o.Tftp = opts.Tftp.String()
+	}
+	if opts.Classless != nil {
+		o.Classless = *opts.Classless
+	}
+	for _, opt := range opts.RawOptions {
+		o.RawOptions = append(o.RawOptions, fmt.Sprintf("%d: %x", opt.Code.Code(), opt.Value.ToBytes()))
+	}
+	if len(opts.BootProfiles) > 0 {
+		o.BootProfiles = profileNames(opts.BootProfiles)
+	}
+	return o
+}
+
+// newControlServer sets up the commands of the control socket at path.
+func newControlServer(path string, leaseTable *leases.Table) *control.Server {
+	s := control.NewServer(path)
+
+	s.Handle("listeners", "listeners: list active listeners", func(args []string) (any, error) {
+		active.mu.Lock()
+		defer active.mu.Unlock()
+
+		infos := make(map[string]ListenerInfo)
+		for name, l := range active.listeners {
+			infos[name] = l.Info()
+		}
+		return infos, nil
+	})
+
+	s.Handle("interfaces", "interfaces: list interfaces known to the link monitors", func(args []string) (any, error) {
+		active.mu.Lock()
+		defer active.mu.Unlock()
+
+		ifaces := make(map[string][]string)
+		for name, m := range active.monitors {
+			ifaces[name] = m.Interfaces()
+		}
+		return ifaces, nil
+	})
+
+	s.Handle("leases", "leases: dump current leases", func(args []string) (any, error) {
+		return leaseTable.List(), nil
+	})
+
+	s.Handle("options", "options [netns/]<interface>: show the options in effect for interface", func(args []string) (any, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("usage: options [netns/]<interface>")
+		}
+		return effectiveOptions(args[0])
+	})
+
+	s.Handle("loglevel", "loglevel [level]: show or change the log level", func(args []string) (any, error) {
+		if len(args) > 1 {
+			return nil, fmt.Errorf("usage: loglevel [level]")
+		}
+		if len(args) == 1 {
+			set, ok := logLevels[args[0]]
+			if !ok {
+				return nil, fmt.Errorf("invalid log level '%s', valid log levels are %v", args[0], getLogLevels())
+			}
+			// Undo "none"
+			ll.SetOutput(os.Stderr)
+			set()
+			ll.Infof("Log level changed to '%s'", args[0])
+		}
+		return ll.GetLevel().String(), nil
+	})
+
+	return s
+}
+
+// runCtl sends a command to the control socket of the running daemon and
+// prints the result.
+func runCtl(path string, args []string) error {
+	if path == "" {
+		return errors.New("no control socket, give -control before ctl")
+	}
+	if len(args) == 0 {
+		args = []string{"help"}
+	}
+
+	res, err := control.Call(path, args[0], args[1:]...)
+	if err != nil {
+		return err
+	}
+
+	var out any
+	if err := json.Unmarshal(res, &out); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(out)
+}
@@ -0,0 +1,210 @@
+package control
+
+// A local control socket to query and adjust the running daemon. Clients send
+// a single line holding a command and its arguments separated by whitespace,
+// and get a single JSON response before the connection is closed.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ll "github.com/sirupsen/logrus"
+)
+
+// How long a client may take to send its command
+const readTimeout = 5 * time.Second
+
+// Longest command line accepted
+const maxLine = 4096
+
+// Handler runs a command with the given arguments. The result is sent to the
+// client encoded as JSON.
+type Handler func(args []string) (any, error)
+
+type command struct {
+	usage   string
+	handler Handler
+}
+
+// Response is sent back for each command. Exactly one of the fields is set.
+type Response struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// Server serves commands on a Unix socket.
+type Server struct {
+	log  *ll.Entry
+	path string
+
+	mu       sync.RWMutex
+	commands map[string]command
+	ln       net.Listener
+}
+
+// NewServer creates a server listening on path once Listen is called.
+func NewServer(path string) *Server {
+	s := &Server{
+		log:      ll.NewEntry(ll.StandardLogger()).WithFields(ll.Fields{"component": "control"}),
+		path:     path,
+		commands: make(map[string]command),
+	}
+	s.Handle("help", "help: list commands", s.help)
+	return s
+}
+
+// Handle registers handler h for command name. usage is shown by help.
+func (s *Server) Handle(name, usage string, h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands[name] = command{usage: usage, handler: h}
+}
+
+func (s *Server) help(args []string) (any, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var usage []string
+	for _, c := range s.commands {
+		usage = append(usage, c.usage)
+	}
+	sort.Strings(usage)
+	return usage, nil
+}
+
+// Listen creates the socket and serves commands. Blocks until Close is called.
+func (s *Server) Listen() error {
+	// A stale socket of a previous run is replaced, anything else is left
+	// alone
+	if fi, err := os.Lstat(s.path); err == nil && fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("unable to listen on %s: not a socket", s.path)
+	}
+
+	// Only root is supposed to control the daemon. The socket is created
+	// with the umask, so it's created in a directory nobody else can enter,
+	// restricted and only then moved in place.
+	dir, err := os.MkdirTemp(filepath.Dir(s.path), ".control")
+	if err != nil {
+		return fmt.Errorf("unable to create socket directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, filepath.Base(s.path))
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s: %v", s.path, err)
+	}
+	// It's moved away, Close removes it at its final path
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0600); err != nil {
+		ln.Close()
+		return fmt.Errorf("unable to restrict access to %s: %v", s.path, err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		ln.Close()
+		return fmt.Errorf("unable to listen on %s: %v", s.path, err)
+	}
+
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+
+	s.log.Infof("Listening on %s", s.path)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+// Close stops serving commands and removes the socket.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln == nil {
+		return nil
+	}
+	err := s.ln.Close()
+	os.Remove(s.path)
+	return err
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, maxLine), maxLine)
+	if !scanner.Scan() {
+		s.log.Debugf("No command received: %v", scanner.Err())
+		return
+	}
+
+	resp := s.run(strings.Fields(scanner.Text()))
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		s.log.Debugf("Failed to send response: %v", err)
+	}
+}
+
+// run runs the command in fields and returns the response to it.
+func (s *Server) run(fields []string) Response {
+	if len(fields) == 0 {
+		return Response{Error: "no command given"}
+	}
+
+	s.mu.RLock()
+	c, ok := s.commands[fields[0]]
+	s.mu.RUnlock()
+	if !ok {
+		return Response{Error: fmt.Sprintf("unknown command %q, try help", fields[0])}
+	}
+
+	s.log.Debugf("Running %v", fields)
+	result, err := c.handler(fields[1:])
+	if err != nil {
+		return Response{Error: err.Error()}
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		return Response{Error: fmt.Sprintf("unable to encode result: %v", err)}
+	}
+	return Response{Result: b}
+}
+
+// Call sends a command to the server listening on path and returns its result.
+func Call(path string, cmd string, args ...string) (json.RawMessage, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to %s: %v", path, err)
+	}
+	defer conn.Close()
+
+	line := strings.Join(append([]string{cmd}, args...), " ")
+	if _, err := fmt.Fprintln(conn, line); err != nil {
+		return nil, fmt.Errorf("unable to send command: %v", err)
+	}
+
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("unable to read response: %v", err)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp.Result, nil
+}
@@ -0,0 +1,124 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startServer(t *testing.T) (*Server, string) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	s := NewServer(path)
+	s.Handle("echo", "echo <args>: return the arguments", func(args []string) (any, error) {
+		return args, nil
+	})
+	s.Handle("fail", "fail: always fails", func(args []string) (any, error) {
+		return nil, errors.New("failed")
+	})
+
+	go s.Listen()
+	t.Cleanup(func() { s.Close() })
+
+	// Wait for the socket to show up
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return s, path
+}
+
+func TestCall(t *testing.T) {
+	_, path := startServer(t)
+
+	res, err := Call(path, "echo", "a", "b")
+	assert.Nil(t, err)
+	var args []string
+	assert.Nil(t, json.Unmarshal(res, &args))
+	assert.Equal(t, []string{"a", "b"}, args)
+
+	_, err = Call(path, "fail")
+	assert.EqualError(t, err, "failed")
+
+	_, err = Call(path, "nope")
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "unknown command"))
+
+	res, err = Call(path, "help")
+	assert.Nil(t, err)
+	var usage []string
+	assert.Nil(t, json.Unmarshal(res, &usage))
+	assert.Equal(t, 3, len(usage))
+	assert.Equal(t, "echo <args>: return the arguments", usage[0])
+
+	// Root only
+	fi, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+}
+
+func TestEmptyCommand(t *testing.T) {
+	_, path := startServer(t)
+
+	conn, err := net.Dial("unix", path)
+	assert.Nil(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("   \n"))
+	assert.Nil(t, err)
+
+	var resp Response
+	assert.Nil(t, json.NewDecoder(conn).Decode(&resp))
+	assert.Equal(t, "no command given", resp.Error)
+}
+
+func TestStaleSocket(t *testing.T) {
+	s, path := startServer(t)
+	s.Close()
+
+	// A socket left behind by a crash doesn't get in the way
+	ln, err := net.Listen("unix", path)
+	assert.Nil(t, err)
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	s = NewServer(path)
+	go s.Listen()
+	defer s.Close()
+	for i := 0; i < 100; i++ {
+		if _, err := Call(path, "help"); err == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Server didn't replace stale socket")
+}
+
+func TestNotSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	assert.Nil(t, os.WriteFile(path, []byte("keep"), 0644))
+
+	assert.NotNil(t, NewServer(path).Listen())
+	b, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "keep", string(b))
+}
+
+func TestClose(t *testing.T) {
+	s, path := startServer(t)
+	assert.Nil(t, s.Close())
+
+	_, err := os.Lstat(path)
+	assert.True(t, os.IsNotExist(err), "Socket left behind")
+	// Nothing left of the directory it was created in
+	entries, err := os.ReadDir(filepath.Dir(path))
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/linode/dhcpd-unnumbered/boot"
+	"github.com/linode/dhcpd-unnumbered/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEffectiveOptions(t *testing.T) {
+	dir := t.TempDir() + "/"
+	s := config.Settings{
+		LeaseTime:          time.Hour,
+		Regex:              "tap.*",
+		PvtCIDR:            "192.168.0.0/16",
+		DNS:                []string{"192.0.2.53"},
+		DNS6:               []string{"2001:db8::53"},
+		HostnameOverride:   true,
+		OverrideFilePrefix: dir,
+		Hostname:           "localhost",
+		Domainname:         "localdomain",
+		BootProfiles:       []boot.ProfileJSON{{Name: "bios", Arch: []uint16{0}, Bootfile: "undionly.kpxe"}},
+	}
+	c, err := s.Parse()
+	assert.Nil(t, err)
+	cfg.Store(c)
+
+	// Nothing but the configuration
+	o, err := effectiveOptions("tap1_0")
+	assert.Nil(t, err)
+	assert.Equal(t, "localhost", o.Hostname)
+	assert.Equal(t, "1h0m0s", o.LeaseTime)
+	assert.Equal(t, []string{"192.0.2.53"}, o.DNS)
+	assert.Equal(t, []string{"2001:db8::53"}, o.DNS6)
+	assert.Equal(t, "", o.OptionsFile)
+	assert.Equal(t, []string{"bios"}, o.BootProfiles)
+
+	// Hostname override and options file
+	assert.Nil(t, os.WriteFile(dir+"tap2_0", []byte("guest.example.com"), 0644))
+	optionsFile := filepath.Join(dir, "tap2_0.options")
+	assert.Nil(t, os.WriteFile(optionsFile, []byte(`{"LeaseTime": "10m", "DNS": ["198.51.100.53"], "IPv6": ["2001:db8::7"], "Classless": true, "BootProfiles": [{"Name": "ipxe", "UserClass": "iPXE", "Bootfile": "http://boot.example.com/boot.ipxe"}]}`), 0644))
+
+	o, err = effectiveOptions("tap2_0")
+	assert.Nil(t, err)
+	assert.Equal(t, "guest", o.Hostname)
+	assert.Equal(t, "example.com", o.Domainname)
+	assert.Equal(t, "10m0s", o.LeaseTime)
+	assert.Equal(t, []string{"198.51.100.53"}, o.DNS)
+	assert.Equal(t, []string{"2001:db8::7"}, o.IPv6)
+	assert.True(t, o.Classless)
+	assert.Equal(t, optionsFile, o.OptionsFile)
+	assert.Equal(t, []string{"ipxe"}, o.BootProfiles)
+
+	// Interfaces in other namespaces read their own files
+	assert.Nil(t, os.Mkdir(dir+"tenant", 0755))
+	assert.Nil(t, os.WriteFile(dir+"tenant/tap2_0", []byte("tenant.example.com"), 0644))
+
+	o, err = effectiveOptions("tenant/tap2_0")
+	assert.Nil(t, err)
+	assert.Equal(t, "tenant", o.Hostname)
+	assert.Equal(t, "1h0m0s", o.LeaseTime)
+	assert.Equal(t, "", o.OptionsFile)
+
+	// Nothing outside the override files
+	for _, name := range []string{"", "../tap2_0", "tenant/../tap2_0", "/tap2_0", "tenant/", "a/b/c", "..", ".hidden"} {
+		_, err = effectiveOptions(name)
+		assert.NotNil(t, err, "%q accepted", name)
+	}
+}
@@ -0,0 +1,479 @@
+// Package decision works out how a DHCP request is answered, from the request,
+// facts about the interface it came in on and the configuration. Everything
+// but Gather is free of I/O, so it can be tested without interfaces, routes
+// or files.
+package decision
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/linode/dhcpd-unnumbered/boot"
+	"github.com/linode/dhcpd-unnumbered/config"
+	"github.com/linode/dhcpd-unnumbered/metrics"
+	"github.com/linode/dhcpd-unnumbered/options"
+	"github.com/linode/dhcpd-unnumbered/relay"
+	ll "github.com/sirupsen/logrus"
+)
+
+// DefaultClasslessGateway is handed out to classless clients if neither the
+// configuration nor the server IP provide one.
+var DefaultClasslessGateway = net.IPv4(169, 254, 0, 1).To4()
+
+// Lookup gets the facts about an interface that don't come with the request.
+type Lookup interface {
+	// Interface returns the interface with the given index.
+	Interface(index int) (*net.Interface, error)
+	// InterfaceByName returns the interface with the given name.
+	InterfaceByName(name string) (*net.Interface, error)
+	// RelayInterface returns the interface name the client relayed by agent
+	// is mapped to, if it is.
+	RelayInterface(agent *relay.Agent) (string, bool)
+	// Routes returns the host routes to the interface with the given index,
+	// and where they were read from, e.g. "table 254".
+	Routes(ifindex int) ([]*net.IPNet, string, error)
+	// Options returns the options file of the interface, which is empty if
+	// there is none.
+	Options(ifName string) (*options.DHCP, error)
+	// Hostname returns the hostname and domain name from the hostname
+	// override file of the interface.
+	Hostname(ifName string) (string, string, error)
+}
+
+// Facts is what is known about an interface and client when deciding.
+type Facts struct {
+	Interface *net.Interface
+	// Options from the options file, nil if there is none or it failed to
+	// load
+	Options *options.DHCP
+	// Host routes to the interface, /32s gathered by Gather and /128s by
+	// Gather6, only looked up without addresses of that family in the options
+	// file
+	Routes []*net.IPNet
+	// Hostname and domain name from the hostname override file, if
+	// HasHostname
+	HasHostname bool
+	Hostname    string
+	Domainname  string
+	// ServerIP is the source IP of the replies, nil to use the gateway.
+	ServerIP net.IP
+	// Lease is the IP the client holds a lease for, nil without one.
+	Lease net.IP
+}
+
+// Trace collects the steps taken while deciding, for explain. Steps are
+// logged at debug level either way. A nil Trace is fine.
+type Trace struct {
+	Log    *ll.Entry
+	Record bool
+	Steps  []string
+}
+
+// Step notes a step.
+func (t *Trace) Step(format string, args ...any) {
+	if t == nil {
+		return
+	}
+	if t.Log != nil {
+		t.Log.Debugf(format, args...)
+	}
+	if t.Record {
+		t.Steps = append(t.Steps, fmt.Sprintf(format, args...))
+	}
+}
+
+// DropError is returned for requests that don't get a reply.
+type DropError struct {
+	// Reason for the metrics, one of the metrics.Drop* values
+	Reason string
+	Err    error
+}
+
+func (e *DropError) Error() string {
+	return e.Err.Error()
+}
+
+// Verdict is whether a DHCPREQUEST is acknowledged.
+type Verdict int
+
+const (
+	Ack Verdict = iota
+	Nak
+	Ignore
+)
+
+// Reply is how a request is to be answered.
+type Reply struct {
+	// Options with everything not given in the options file filled in
+	Options   *options.DHCP
+	IP        *net.IPNet
+	Classless bool
+	// Server identifier, source IP of the replies
+	ServerIP net.IP
+	DNS      []net.IP
+	// Boot settings, from the boot profile matched if any. NextServer goes
+	// into siaddr, TFTPServer into option 66 and sname unless empty, as
+	// Delivery says.
+	BootProfile string
+	NextServer  net.IP
+	TFTPServer  string
+	Delivery    boot.Delivery
+	// For requests, whether to acknowledge them. Unless Ack, Reason says why.
+	Verdict Verdict
+	Reason  string
+}
+
+// Accept checks whether requests on ifi are served at all.
+func Accept(c *config.Config, ifi *net.Interface, t *Trace) error {
+	if !(c.TapRegex.Match([]byte(ifi.Name))) {
+		return &DropError{metrics.DropRegexMismatch, fmt.Errorf("DHCP request on Interface %v is not accepted by regex %s, ignoring", ifi.Name, c.TapRegex)}
+	}
+	if ifi.Flags&net.FlagUp != net.FlagUp {
+		return &DropError{metrics.DropInterfaceDown, fmt.Errorf("DHCP request on a Interface %v, which is down. that's not right, skipping", ifi.Name)}
+	}
+	t.Step("Interface %v matches %s and is up", ifi.Name, c.TapRegex)
+	return nil
+}
+
+// AcceptRelay checks whether requests relayed by agent from src are served at
+// all. Returns the interface standing in for the tap of the client, named as
+// mapped or after its identity: the local interface of that name if there is
+// one that Accept takes, so host routes to it are handed out, otherwise one
+// without an index, so only the options file is.
+func AcceptRelay(c *config.Config, lk Lookup, agent *relay.Agent, src net.IP, t *Trace) (*net.Interface, error) {
+	if !c.TrustsRelay(src) {
+		return nil, &DropError{metrics.DropUntrustedRelay, fmt.Errorf("DHCP request relayed by %v from %v, which is not a trusted relay agent, ignoring", agent.Addr, src)}
+	}
+	name, mapped := lk.RelayInterface(agent)
+	if mapped {
+		t.Step("Relayed by %v from %v, client mapped to %s", agent.Addr, src, name)
+	} else {
+		name = agent.Identity()
+		if name == "" {
+			return nil, &DropError{metrics.DropNoRelayIdentity, fmt.Errorf("DHCP request relayed by %v without circuit-id or remote-id, ignoring", agent.Addr)}
+		}
+		t.Step("Relayed by %v from %v, client identified as %s", agent.Addr, src, name)
+	}
+
+	ifi, err := lk.InterfaceByName(name)
+	if err != nil {
+		t.Step("No local interface %s, addresses only come from the options file", name)
+		return &net.Interface{Name: name}, nil
+	}
+	// Relay agents pick the name, so a local interface only counts if a
+	// request on it would be served too
+	if err := Accept(c, ifi, nil); err != nil {
+		t.Step("Local interface %s isn't served, addresses only come from the options file", name)
+		return &net.Interface{Name: name}, nil
+	}
+	return ifi, nil
+}
+
+// overrideLookup reads the override files of an interface, shared by Lookup
+// and Lookup6.
+type overrideLookup interface {
+	Options(ifName string) (*options.DHCP, error)
+	Hostname(ifName string) (string, string, error)
+}
+
+// gatherOverrides reads the options file and hostname override of ifi through
+// lk, if enabled.
+func gatherOverrides(lk overrideLookup, c *config.Config, ifi *net.Interface, t *Trace) *Facts {
+	f := &Facts{Interface: ifi}
+
+	// Load override options from file if it exists. Otherwise, fall back to
+	// existing behavior of generating options internally.
+	if c.HostnameOverride {
+		opt, err := lk.Options(ifi.Name)
+		if err != nil {
+			if t != nil && t.Log != nil {
+				t.Log.Warnf("Failed to read options file: %v", err)
+			}
+			metrics.OptionsLoadFailures.Inc()
+		} else {
+			t.Step("Override options read from file: %+v", *opt)
+			f.Options = opt
+		}
+
+		h, dn, err := lk.Hostname(ifi.Name)
+		if err == nil {
+			f.HasHostname, f.Hostname, f.Domainname = true, h, dn
+		} else {
+			t.Step("unable to get static hostname: %v", err)
+		}
+	} else {
+		t.Step("Hostname override disabled, not reading options file")
+	}
+	return f
+}
+
+// Gather reads the options file, routes and hostname override of ifi through
+// lk. ServerIP and Lease are left for the caller to fill in.
+func Gather(lk Lookup, c *config.Config, ifi *net.Interface, t *Trace) (*Facts, error) {
+	f := gatherOverrides(lk, c, ifi, t)
+
+	if ifi.Index == 0 {
+		// Relayed client without a local interface
+		return f, nil
+	}
+
+	if f.Options == nil || len(f.Options.IPv4) == 0 {
+		rts, from, err := lk.Routes(ifi.Index)
+		if err != nil {
+			return nil, &DropError{metrics.DropRouteLookup, fmt.Errorf("failed to get routes for Interface %v: %v", ifi.Name, err)}
+		}
+		t.Step("Read routes from %s", from)
+		f.Routes = rts
+	}
+
+	return f, nil
+}
+
+// Decide works out the reply to req with facts f and configuration c. Returns
+// a *DropError if there is no reply.
+func Decide(c *config.Config, req *dhcpv4.DHCPv4, f *Facts, t *Trace) (*Reply, error) {
+	// Work on a copy, defaults are filled in below
+	options := &options.DHCP{}
+	if f.Options != nil {
+		*options = *f.Options
+	}
+
+	if options.PvtIPs == nil {
+		options.PvtIPs = c.PvtIPs
+	}
+
+	if len(options.IPv4) == 0 {
+		for _, ip := range f.Routes {
+			// Range is implicitly /24.
+			ipn := net.IPNet{
+				IP:   ip.IP,
+				Mask: net.CIDRMask(24, 32),
+			}
+			options.IPv4 = append(options.IPv4, &ipn)
+		}
+		t.Step("Routes found for Interface %v: %v", f.Interface.Name, options.IPv4)
+	} else {
+		t.Step("IPs from options file for Interface %v: %v", f.Interface.Name, options.IPv4)
+	}
+
+	var pickedIP *net.IPNet
+	switch {
+	case req.MessageType() == dhcpv4.MessageTypeInform:
+		// The client configured its address itself (RFC 2131 3.4), so the
+		// answer is for that one, routed here or not
+		if req.ClientIPAddr == nil || req.ClientIPAddr.IsUnspecified() {
+			return nil, &DropError{metrics.DropInvalidMessage, fmt.Errorf("DHCPINFORM on %v without client address, ignoring", f.Interface.Name)}
+		}
+		pickedIP = &net.IPNet{IP: req.ClientIPAddr.To4(), Mask: net.CIDRMask(24, 32)}
+		for _, ipr := range options.IPv4 {
+			if ipr.IP.Equal(req.ClientIPAddr) {
+				pickedIP = ipr
+				break
+			}
+		}
+		t.Step("INFORM from %v, not picking an IP", pickedIP.IP)
+	case len(options.IPv4) > 0:
+		pickedIP = pickIP(req, options, f.Lease, t)
+	case req.MessageType() == dhcpv4.MessageTypeRequest && clientIP(req) != nil:
+		// No address is ours anymore, but the client holding one still gets a
+		// NAK below instead of retrying until its lease runs out
+		pickedIP = &net.IPNet{IP: clientIP(req).To4(), Mask: net.CIDRMask(24, 32)}
+		t.Step("No host routes or override IPs, answering REQUEST for %v", pickedIP.IP)
+	default:
+		// seems like we have no host routes, not providing DHCP
+		return nil, &DropError{metrics.DropNoHostRoutes, errors.New("seems like we have no host routes or override IPs, not providing DHCP")}
+	}
+
+	classless := c.Classless
+	if options.Classless != nil {
+		classless = *options.Classless
+	}
+
+	if classless {
+		// the client gets a /32 and no neighbours at all, the gateway is
+		// reached through a host route instead.
+		pickedIP = &net.IPNet{IP: pickedIP.IP, Mask: net.CIDRMask(32, 32)}
+		if options.Gateway == nil {
+			gw := DefaultClasslessGateway
+			if c.ClasslessGateway != nil {
+				gw = c.ClasslessGateway
+			} else if f.ServerIP != nil {
+				gw = f.ServerIP
+			}
+			options.Gateway = &gw
+		}
+		t.Step("Classless, handing out %v with gateway %v", pickedIP, *options.Gateway)
+	}
+
+	// a relayed client is on a real network, routed by the relay agent
+	if options.Gateway == nil {
+		if agent := relay.FromRequest(req); agent != nil {
+			gw := agent.Addr
+			options.Gateway = &gw
+			t.Step("Gateway is the relay agent: %v", gw)
+		}
+	}
+
+	// the default gateway handed out by DHCP is the first IP of whatever subnet the client gets handed out.
+	// we actually don't care at all what the gw IP is, its really just to make the client's tcp/ip stack happy
+	if options.Gateway == nil {
+		options.Gateway = gatewayFromIP(pickedIP)
+		t.Step("Gateway derived from %v: %v", pickedIP, *options.Gateway)
+	}
+
+	// source IP to be sending from
+	sIP := f.ServerIP
+	if sIP == nil {
+		sIP = *options.Gateway
+	}
+	t.Step("Server identifier: %v", sIP)
+
+	r := &Reply{
+		Options:   options,
+		IP:        pickedIP,
+		Classless: classless,
+		ServerIP:  sIP,
+		Verdict:   Ack,
+	}
+
+	// RFC 2131 4.3.2: a REQUEST must only be acknowledged if the requested
+	// address is still routed to this interface, otherwise the client gets a
+	// NAK so it restarts in INIT state.
+	if req.MessageType() == dhcpv4.MessageTypeRequest {
+		r.Verdict, r.Reason = checkRequest(req, options.IPv4, sIP)
+		switch r.Verdict {
+		case Ignore:
+			return nil, &DropError{metrics.DropOtherServer, fmt.Errorf("Ignoring DHCPREQUEST on %v: %s", f.Interface.Name, r.Reason)}
+		case Nak:
+			t.Step("REQUEST gets a NAK: %s", r.Reason)
+			return r, nil
+		}
+		t.Step("REQUEST gets an ACK")
+	}
+
+	if len(options.DNS) > 0 {
+		// DNS servers from the options file are handed out as given
+		r.DNS = options.DNS
+		t.Step("DNS servers from options file: %v", r.DNS)
+	} else {
+		// mix DNS but mix em consistently so same IP gets the same order
+		r.DNS = mixDNS(c.DNS, pickedIP.IP)
+		t.Step("DNS servers mixed for %v: %v", pickedIP.IP, r.DNS)
+	}
+
+	hostname, domainname, source := pickHostname(c, f, options, pickedIP.IP)
+
+	// Options file takes priority over the configuration for lease time and
+	// bootfile
+	if options.LeaseTime == nil {
+		leaseTime := c.LeaseTime
+		options.LeaseTime = &leaseTime
+	}
+
+	if options.Bootfile == nil {
+		bootfile := c.Bootfile
+		options.Bootfile = &bootfile
+	}
+
+	options.Hostname = &hostname
+	options.Domainname = &domainname
+	t.Step("Hostname %s.%s from %s", *options.Hostname, *options.Domainname, source)
+
+	if options.Tftp == nil && c.Tftp != nil {
+		tftp := c.Tftp
+		options.Tftp = &tftp
+	}
+
+	if options.Tftp != nil {
+		r.TFTPServer = options.Tftp.String()
+	}
+	r.Delivery = c.BootDelivery
+	if options.BootDelivery != nil {
+		r.Delivery = *options.BootDelivery
+	}
+	var nextServer net.IP
+
+	// Boot profiles in the options file replace the configured ones
+	profiles := c.BootProfiles
+	if len(options.BootProfiles) > 0 {
+		profiles = options.BootProfiles
+	}
+	if p := boot.Select(profiles, req); p != nil {
+		r.BootProfile = p.Name
+		if p.Bootfile != "" {
+			bootfile := p.Bootfile
+			options.Bootfile = &bootfile
+		}
+		nextServer = p.NextServer
+		if p.Tftp != "" {
+			r.TFTPServer = p.Tftp
+		}
+		t.Step("Boot profile %s matches, bootfile %q, next server %v, tftp %q", p.Name, *options.Bootfile, nextServer, r.TFTPServer)
+	} else if len(profiles) > 0 {
+		t.Step("No boot profile matches")
+	}
+
+	// The next server is where legacy PXE ROMs fetch the bootfile from by
+	// TFTP, so unless given it's the tftp server, if that is an address.
+	// Otherwise it stays the gateway as it always was.
+	r.NextServer = nextServer
+	if r.NextServer == nil {
+		r.NextServer = net.ParseIP(r.TFTPServer).To4()
+	}
+	if r.NextServer == nil {
+		r.NextServer = *options.Gateway
+	}
+	if *options.Bootfile != "" || r.TFTPServer != "" {
+		t.Step("Boot settings sent in %s, next server %v", r.Delivery, r.NextServer)
+	}
+
+	return r, nil
+}
+
+// pickIP picks the address handed out to the client sending req from the ones
+// in options: the one it asks for or already holds if still there, else the
+// one it has a lease for, else the first that isn't private.
+func pickIP(req *dhcpv4.DHCPv4, options *options.DHCP, lease net.IP, t *Trace) *net.IPNet {
+	// by default set the first IP in our return slice of routes
+	pickedIP := options.IPv4[0]
+	requested := false
+	for _, ipr := range options.IPv4 {
+		// however, check if the client requests a specific IP *and* still owns it, if so let 'em have it, even if private
+		if req.RequestedIPAddress().Equal(ipr.IP) {
+			t.Step("client requested IP: %v and still owns it. so sticking to that one", req.RequestedIPAddress())
+			pickedIP = ipr
+			requested = true
+			break
+		}
+		if req.ClientIPAddr.Equal(ipr.IP) {
+			t.Step("client used IP: %v and still owns it. so sticking to that one", req.ClientIPAddr)
+			pickedIP = ipr
+			requested = true
+			break
+		}
+
+		// if first IP in rts slice is a privete IP, override it with this one.
+		// doing this way will allow the last private IP to stick anyway in case there is no public IP assigned to a VM
+		if options.PvtIPs.Contains(pickedIP.IP) {
+			t.Step("first IP was private (%s), overriding with %v for now", options.PvtIPs, ipr)
+			pickedIP = ipr
+		}
+	}
+
+	// otherwise keep handing out the IP the client got before, so offers are
+	// stable even if the routes changed order
+	if lease != nil && !requested {
+		for _, ipr := range options.IPv4 {
+			if ipr.IP.Equal(lease) {
+				t.Step("client has a lease for IP: %v and we still own it. so sticking to that one", lease)
+				pickedIP = ipr
+				break
+			}
+		}
+	}
+
+	t.Step("Picked IP: %v", pickedIP)
+	return pickedIP
+}
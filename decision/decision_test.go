@@ -0,0 +1,617 @@
+package decision
+
+import (
+	"errors"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/linode/dhcpd-unnumbered/boot"
+	"github.com/linode/dhcpd-unnumbered/config"
+	"github.com/linode/dhcpd-unnumbered/metrics"
+	"github.com/linode/dhcpd-unnumbered/options"
+	"github.com/linode/dhcpd-unnumbered/relay"
+	"github.com/stretchr/testify/assert"
+)
+
+func testConfig() *config.Config {
+	_, pvt, _ := net.ParseCIDR("10.0.0.0/8")
+	return &config.Config{
+		LeaseTime:  30 * time.Minute,
+		TapRegex:   regexp.MustCompile("tap.*_0"),
+		PvtIPs:     pvt,
+		DNS:        []net.IP{net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 2)},
+		Hostname:   "localhost",
+		Domainname: "localdomain",
+	}
+}
+
+func testInterface() *net.Interface {
+	return &net.Interface{Index: 7, Name: "tap.1_0", Flags: net.FlagUp}
+}
+
+// hostRoutes returns /32s for ips.
+func hostRoutes(ips ...string) []*net.IPNet {
+	var r []*net.IPNet
+	for _, ip := range ips {
+		r = append(r, &net.IPNet{IP: net.ParseIP(ip).To4(), Mask: net.CIDRMask(32, 32)})
+	}
+	return r
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestDecide(t *testing.T) {
+	_, optNet, _ := net.ParseCIDR("198.51.100.9/25")
+	optNet.IP = net.IPv4(198, 51, 100, 9).To4()
+
+	tests := []struct {
+		name string
+		typ  dhcpv4.MessageType
+		mods []dhcpv4.Modifier
+		c    func(*config.Config)
+		f    func(*Facts)
+
+		ip       string
+		gateway  string
+		hostname string
+		verdict  Verdict
+		drop     string
+	}{
+		{
+			name: "first route",
+			f:    func(f *Facts) { f.Routes = hostRoutes("203.0.113.7", "198.51.100.9") },
+			ip:   "203.0.113.7/24", gateway: "203.0.113.1", hostname: "localhost.localdomain",
+		},
+		{
+			name: "private IP overridden",
+			f:    func(f *Facts) { f.Routes = hostRoutes("10.0.0.5", "203.0.113.7") },
+			ip:   "203.0.113.7/24", gateway: "203.0.113.1", hostname: "localhost.localdomain",
+		},
+		{
+			name: "only private IPs",
+			f:    func(f *Facts) { f.Routes = hostRoutes("10.0.0.5", "10.0.0.6") },
+			ip:   "10.0.0.6/24", gateway: "10.0.0.1", hostname: "localhost.localdomain",
+		},
+		{
+			name: "private IPs from options file",
+			f: func(f *Facts) {
+				_, pvt, _ := net.ParseCIDR("203.0.113.0/24")
+				f.Options = &options.DHCP{PvtIPs: pvt}
+				f.Routes = hostRoutes("203.0.113.7", "10.0.0.5")
+			},
+			ip: "10.0.0.5/24", gateway: "10.0.0.1", hostname: "localhost.localdomain",
+		},
+		{
+			name: "requested private IP sticks",
+			mods: []dhcpv4.Modifier{dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(10, 0, 0, 5)))},
+			f:    func(f *Facts) { f.Routes = hostRoutes("10.0.0.5", "203.0.113.7") },
+			ip:   "10.0.0.5/24", gateway: "10.0.0.1", hostname: "localhost.localdomain",
+		},
+		{
+			name: "client IP sticks",
+			mods: []dhcpv4.Modifier{dhcpv4.WithClientIP(net.IPv4(198, 51, 100, 9))},
+			f:    func(f *Facts) { f.Routes = hostRoutes("203.0.113.7", "198.51.100.9") },
+			ip:   "198.51.100.9/24", gateway: "198.51.100.1", hostname: "localhost.localdomain",
+		},
+		{
+			name: "requested IP not owned",
+			mods: []dhcpv4.Modifier{dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(192, 0, 2, 99)))},
+			f:    func(f *Facts) { f.Routes = hostRoutes("203.0.113.7", "198.51.100.9") },
+			ip:   "203.0.113.7/24", gateway: "203.0.113.1", hostname: "localhost.localdomain",
+		},
+		{
+			name: "lease sticks",
+			f: func(f *Facts) {
+				f.Routes = hostRoutes("203.0.113.7", "198.51.100.9")
+				f.Lease = net.IPv4(198, 51, 100, 9)
+			},
+			ip: "198.51.100.9/24", gateway: "198.51.100.1", hostname: "localhost.localdomain",
+		},
+		{
+			name: "lease no longer owned",
+			f: func(f *Facts) {
+				f.Routes = hostRoutes("203.0.113.7")
+				f.Lease = net.IPv4(198, 51, 100, 9)
+			},
+			ip: "203.0.113.7/24", gateway: "203.0.113.1", hostname: "localhost.localdomain",
+		},
+		{
+			name: "requested IP wins over lease",
+			mods: []dhcpv4.Modifier{dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(203, 0, 113, 7)))},
+			f: func(f *Facts) {
+				f.Routes = hostRoutes("203.0.113.7", "198.51.100.9")
+				f.Lease = net.IPv4(198, 51, 100, 9)
+			},
+			ip: "203.0.113.7/24", gateway: "203.0.113.1", hostname: "localhost.localdomain",
+		},
+		{
+			name: "options file IPs win over routes",
+			f: func(f *Facts) {
+				f.Options = &options.DHCP{IPv4: []*net.IPNet{optNet}}
+				f.Routes = hostRoutes("203.0.113.7")
+			},
+			ip: "198.51.100.9/25", gateway: "198.51.100.1", hostname: "localhost.localdomain",
+		},
+		{
+			name: "options file gateway",
+			f: func(f *Facts) {
+				f.Options = &options.DHCP{Gateway: ptr(net.IPv4(203, 0, 113, 254))}
+				f.Routes = hostRoutes("203.0.113.7")
+			},
+			ip: "203.0.113.7/24", gateway: "203.0.113.254", hostname: "localhost.localdomain",
+		},
+		{
+			name: "relayed",
+			mods: []dhcpv4.Modifier{dhcpv4.WithGatewayIP(net.IPv4(198, 51, 100, 1))},
+			f:    func(f *Facts) { f.Options = &options.DHCP{IPv4: []*net.IPNet{optNet}} },
+			ip:   "198.51.100.9/25", gateway: "198.51.100.1", hostname: "localhost.localdomain",
+		},
+		{
+			name: "relayed with options file gateway",
+			mods: []dhcpv4.Modifier{dhcpv4.WithGatewayIP(net.IPv4(198, 51, 100, 1))},
+			f: func(f *Facts) {
+				f.Options = &options.DHCP{IPv4: []*net.IPNet{optNet}, Gateway: ptr(net.IPv4(198, 51, 100, 126))}
+			},
+			ip: "198.51.100.9/25", gateway: "198.51.100.126", hostname: "localhost.localdomain",
+		},
+		{
+			name: "no routes",
+			drop: metrics.DropNoHostRoutes,
+		},
+		{
+			name: "dynamic hostname",
+			c:    func(c *config.Config) { c.DynamicHostname = true },
+			f:    func(f *Facts) { f.Routes = hostRoutes("203.0.113.7") },
+			ip:   "203.0.113.7/24", gateway: "203.0.113.1", hostname: "203-0-113-7.localdomain",
+		},
+		{
+			name: "override file wins over dynamic hostname",
+			c:    func(c *config.Config) { c.DynamicHostname = true },
+			f: func(f *Facts) {
+				f.Routes = hostRoutes("203.0.113.7")
+				f.HasHostname, f.Hostname, f.Domainname = true, "vm", "example.com"
+			},
+			ip: "203.0.113.7/24", gateway: "203.0.113.1", hostname: "vm.example.com",
+		},
+		{
+			name: "override file without domain",
+			f: func(f *Facts) {
+				f.Routes = hostRoutes("203.0.113.7")
+				f.HasHostname, f.Hostname = true, "vm"
+			},
+			ip: "203.0.113.7/24", gateway: "203.0.113.1", hostname: "vm.localdomain",
+		},
+		{
+			name: "options file wins over override file",
+			c:    func(c *config.Config) { c.DynamicHostname = true },
+			f: func(f *Facts) {
+				f.Routes = hostRoutes("203.0.113.7")
+				f.HasHostname, f.Hostname, f.Domainname = true, "vm", "example.com"
+				f.Options = &options.DHCP{Hostname: ptr("opt"), Domainname: ptr("example.net")}
+			},
+			ip: "203.0.113.7/24", gateway: "203.0.113.1", hostname: "opt.example.net",
+		},
+		{
+			name: "classless with server IP",
+			c:    func(c *config.Config) { c.Classless = true },
+			f:    func(f *Facts) { f.Routes = hostRoutes("203.0.113.7") },
+			ip:   "203.0.113.7/32", gateway: "192.0.2.1", hostname: "localhost.localdomain",
+		},
+		{
+			name: "classless without server IP",
+			c:    func(c *config.Config) { c.Classless = true },
+			f: func(f *Facts) {
+				f.Routes = hostRoutes("203.0.113.7")
+				f.ServerIP = nil
+			},
+			ip: "203.0.113.7/32", gateway: "169.254.0.1", hostname: "localhost.localdomain",
+		},
+		{
+			name: "classless with configured gateway",
+			c: func(c *config.Config) {
+				c.Classless = true
+				c.ClasslessGateway = net.IPv4(192, 0, 2, 254)
+			},
+			f:  func(f *Facts) { f.Routes = hostRoutes("203.0.113.7") },
+			ip: "203.0.113.7/32", gateway: "192.0.2.254", hostname: "localhost.localdomain",
+		},
+		{
+			name: "classless disabled in options file",
+			c:    func(c *config.Config) { c.Classless = true },
+			f: func(f *Facts) {
+				f.Routes = hostRoutes("203.0.113.7")
+				f.Options = &options.DHCP{Classless: ptr(false)}
+			},
+			ip: "203.0.113.7/24", gateway: "203.0.113.1", hostname: "localhost.localdomain",
+		},
+		{
+			name: "request acknowledged",
+			typ:  dhcpv4.MessageTypeRequest,
+			mods: []dhcpv4.Modifier{dhcpv4.WithClientIP(net.IPv4(203, 0, 113, 7))},
+			f:    func(f *Facts) { f.Routes = hostRoutes("203.0.113.7") },
+			ip:   "203.0.113.7/24", gateway: "203.0.113.1", hostname: "localhost.localdomain",
+		},
+		{
+			name:    "request not owned",
+			typ:     dhcpv4.MessageTypeRequest,
+			mods:    []dhcpv4.Modifier{dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(198, 51, 100, 9)))},
+			f:       func(f *Facts) { f.Routes = hostRoutes("203.0.113.7") },
+			ip:      "203.0.113.7/24",
+			gateway: "203.0.113.1",
+			verdict: Nak,
+		},
+		{
+			name: "inform",
+			typ:  dhcpv4.MessageTypeInform,
+			mods: []dhcpv4.Modifier{dhcpv4.WithClientIP(net.IPv4(192, 0, 2, 77))},
+			c:    func(c *config.Config) { c.DynamicHostname = true },
+			f:    func(f *Facts) { f.Routes = hostRoutes("203.0.113.7") },
+			ip:   "192.0.2.77/24", gateway: "192.0.2.1", hostname: "192-0-2-77.localdomain",
+		},
+		{
+			name: "inform without routes",
+			typ:  dhcpv4.MessageTypeInform,
+			mods: []dhcpv4.Modifier{dhcpv4.WithClientIP(net.IPv4(192, 0, 2, 77))},
+			ip:   "192.0.2.77/24", gateway: "192.0.2.1", hostname: "localhost.localdomain",
+		},
+		{
+			name: "inform with owned address",
+			typ:  dhcpv4.MessageTypeInform,
+			mods: []dhcpv4.Modifier{dhcpv4.WithClientIP(net.IPv4(198, 51, 100, 9))},
+			f:    func(f *Facts) { f.Options = &options.DHCP{IPv4: []*net.IPNet{optNet}} },
+			ip:   "198.51.100.9/25", gateway: "198.51.100.1", hostname: "localhost.localdomain",
+		},
+		{
+			name: "inform without client address",
+			typ:  dhcpv4.MessageTypeInform,
+			f:    func(f *Facts) { f.Routes = hostRoutes("203.0.113.7") },
+			drop: metrics.DropInvalidMessage,
+		},
+		{
+			name:    "request without routes",
+			typ:     dhcpv4.MessageTypeRequest,
+			mods:    []dhcpv4.Modifier{dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(198, 51, 100, 9)))},
+			ip:      "198.51.100.9/24",
+			gateway: "198.51.100.1",
+			verdict: Nak,
+		},
+		{
+			name:    "renewal without routes",
+			typ:     dhcpv4.MessageTypeRequest,
+			mods:    []dhcpv4.Modifier{dhcpv4.WithClientIP(net.IPv4(198, 51, 100, 9))},
+			ip:      "198.51.100.9/24",
+			gateway: "198.51.100.1",
+			verdict: Nak,
+		},
+		{
+			name: "request without routes or address",
+			typ:  dhcpv4.MessageTypeRequest,
+			drop: metrics.DropNoHostRoutes,
+		},
+		{
+			name: "request for other server",
+			typ:  dhcpv4.MessageTypeRequest,
+			mods: []dhcpv4.Modifier{
+				dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.IPv4(192, 0, 2, 2))),
+				dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(203, 0, 113, 7))),
+			},
+			f:    func(f *Facts) { f.Routes = hostRoutes("203.0.113.7") },
+			drop: metrics.DropOtherServer,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := testConfig()
+			if tc.c != nil {
+				tc.c(c)
+			}
+			f := &Facts{Interface: testInterface(), ServerIP: net.IPv4(192, 0, 2, 1)}
+			if tc.f != nil {
+				tc.f(f)
+			}
+			typ := tc.typ
+			if typ == dhcpv4.MessageTypeNone {
+				typ = dhcpv4.MessageTypeDiscover
+			}
+			req, err := dhcpv4.New(append([]dhcpv4.Modifier{dhcpv4.WithMessageType(typ)}, tc.mods...)...)
+			assert.Nil(t, err)
+
+			r, err := Decide(c, req, f, &Trace{Record: true})
+			if tc.drop != "" {
+				var drop *DropError
+				assert.True(t, errors.As(err, &drop), "expected a drop")
+				assert.Equal(t, tc.drop, drop.Reason)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.ip, r.IP.String())
+			assert.Equal(t, tc.gateway, r.Options.Gateway.String())
+			assert.Equal(t, tc.verdict, r.Verdict, r.Reason)
+			if tc.verdict == Ack {
+				assert.Equal(t, tc.hostname, *r.Options.Hostname+"."+*r.Options.Domainname)
+				assert.Equal(t, c.LeaseTime, *r.Options.LeaseTime)
+			}
+		})
+	}
+}
+
+func TestDecideDNS(t *testing.T) {
+	c := testConfig()
+	f := &Facts{Interface: testInterface(), Routes: hostRoutes("203.0.113.7")}
+	req, err := dhcpv4.New(dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover))
+	assert.Nil(t, err)
+
+	// Mixed by the last octet of the picked IP
+	r, err := Decide(c, req, f, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []net.IP{c.DNS[1], c.DNS[0]}, r.DNS)
+	// Without a server IP, replies come from the gateway
+	assert.Equal(t, "203.0.113.1", r.ServerIP.String())
+
+	// Handed out as given from the options file
+	dns := []net.IP{net.IPv4(9, 9, 9, 9), net.IPv4(8, 8, 8, 8)}
+	f.Options = &options.DHCP{DNS: dns}
+	r, err = Decide(c, req, f, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, dns, r.DNS)
+
+	// The facts are left alone
+	assert.Nil(t, f.Options.Hostname)
+	assert.Nil(t, f.Options.Gateway)
+}
+
+func TestAccept(t *testing.T) {
+	c := testConfig()
+	assert.Nil(t, Accept(c, testInterface(), nil))
+
+	var drop *DropError
+	err := Accept(c, &net.Interface{Name: "eth0", Flags: net.FlagUp}, nil)
+	assert.True(t, errors.As(err, &drop))
+	assert.Equal(t, metrics.DropRegexMismatch, drop.Reason)
+
+	err = Accept(c, &net.Interface{Name: "tap.1_0"}, nil)
+	assert.True(t, errors.As(err, &drop))
+	assert.Equal(t, metrics.DropInterfaceDown, drop.Reason)
+}
+
+func TestAcceptRelay(t *testing.T) {
+	c := testConfig()
+	_, trusted, _ := net.ParseCIDR("198.51.100.0/24")
+	c.RelayAgents = []*net.IPNet{trusted}
+	agent := &relay.Agent{Addr: net.IPv4(192, 0, 2, 1), CircuitID: []byte("swp1")}
+	src := net.IPv4(198, 51, 100, 10)
+	lk := &fakeLookup{}
+
+	ifi, err := AcceptRelay(c, lk, agent, src, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, &net.Interface{Name: "swp1"}, ifi)
+
+	// Only a local interface that is served stands in with its routes
+	lk.local = &net.Interface{Index: 12, Name: "swp1", Flags: net.FlagUp}
+	ifi, err = AcceptRelay(c, lk, agent, src, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, &net.Interface{Name: "swp1"}, ifi)
+
+	c.TapRegex = regexp.MustCompile("tap.*_0|swp.*")
+	ifi, err = AcceptRelay(c, lk, agent, src, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, lk.local, ifi)
+
+	lk.local.Flags = 0
+	ifi, err = AcceptRelay(c, lk, agent, src, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, &net.Interface{Name: "swp1"}, ifi)
+
+	// A circuit-id naming an uplink doesn't hand out its routes
+	lk.local = &net.Interface{Index: 2, Name: "eth0", Flags: net.FlagUp}
+	ifi, err = AcceptRelay(c, lk, &relay.Agent{Addr: net.IPv4(192, 0, 2, 1), CircuitID: []byte("eth0")}, src, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, &net.Interface{Name: "eth0"}, ifi)
+	lk.local = nil
+
+	// Mapped rather than identified
+	lk.mapped = "bm-r1-u1"
+	ifi, err = AcceptRelay(c, lk, agent, src, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, &net.Interface{Name: "bm-r1-u1"}, ifi)
+	ifi, err = AcceptRelay(c, lk, &relay.Agent{Addr: net.IPv4(192, 0, 2, 1)}, src, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "bm-r1-u1", ifi.Name)
+	lk.mapped = ""
+
+	var drop *DropError
+	_, err = AcceptRelay(c, lk, agent, net.IPv4(203, 0, 113, 10), nil)
+	assert.True(t, errors.As(err, &drop))
+	assert.Equal(t, metrics.DropUntrustedRelay, drop.Reason)
+
+	_, err = AcceptRelay(c, lk, &relay.Agent{Addr: net.IPv4(192, 0, 2, 1)}, src, nil)
+	assert.True(t, errors.As(err, &drop))
+	assert.Equal(t, metrics.DropNoRelayIdentity, drop.Reason)
+}
+
+// fakeLookup serves fixed facts and counts the route lookups.
+type fakeLookup struct {
+	local    *net.Interface
+	mapped   string
+	options  *options.DHCP
+	routes   []*net.IPNet
+	routes6  []*net.IPNet
+	routeErr error
+	hostname string
+	lookups  int
+}
+
+func (lk *fakeLookup) Interface(index int) (*net.Interface, error) {
+	return testInterface(), nil
+}
+
+func (lk *fakeLookup) InterfaceByName(name string) (*net.Interface, error) {
+	if lk.local == nil || lk.local.Name != name {
+		return nil, errors.New("no such network interface")
+	}
+	return lk.local, nil
+}
+
+func (lk *fakeLookup) RelayInterface(agent *relay.Agent) (string, bool) {
+	return lk.mapped, lk.mapped != ""
+}
+
+func (lk *fakeLookup) Routes(ifindex int) ([]*net.IPNet, string, error) {
+	lk.lookups++
+	return lk.routes, "table 254", lk.routeErr
+}
+
+func (lk *fakeLookup) Routes6(ifindex int) ([]*net.IPNet, string, error) {
+	lk.lookups++
+	return lk.routes6, "table 254", lk.routeErr
+}
+
+func (lk *fakeLookup) Options(ifName string) (*options.DHCP, error) {
+	if lk.options == nil {
+		return nil, errors.New("broken options file")
+	}
+	return lk.options, nil
+}
+
+func (lk *fakeLookup) Hostname(ifName string) (string, string, error) {
+	if lk.hostname == "" {
+		return "", "", errors.New("no hostname file")
+	}
+	return lk.hostname, "", nil
+}
+
+func TestGather(t *testing.T) {
+	c := testConfig()
+
+	// Without overrides, only routes are looked up
+	lk := &fakeLookup{options: &options.DHCP{}, routes: hostRoutes("203.0.113.7"), hostname: "vm"}
+	tr := &Trace{Record: true}
+	f, err := Gather(lk, c, testInterface(), tr)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Options)
+	assert.False(t, f.HasHostname)
+	assert.Equal(t, lk.routes, f.Routes)
+	assert.Equal(t, []string{"Hostname override disabled, not reading options file", "Read routes from table 254"}, tr.Steps)
+
+	c.HostnameOverride = true
+	f, err = Gather(lk, c, testInterface(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, lk.options, f.Options)
+	assert.True(t, f.HasHostname)
+	assert.Equal(t, "vm", f.Hostname)
+	assert.Equal(t, 2, lk.lookups)
+
+	// IPs from the options file make routes unnecessary
+	lk.options = &options.DHCP{IPv4: hostRoutes("198.51.100.9")}
+	f, err = Gather(lk, c, testInterface(), nil)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Routes)
+	assert.Equal(t, 2, lk.lookups)
+
+	// A broken options file is skipped
+	lk.options = nil
+	f, err = Gather(lk, c, testInterface(), nil)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Options)
+	assert.Equal(t, lk.routes, f.Routes)
+
+	// Relayed clients without a local interface only get the options file
+	f, err = Gather(lk, c, &net.Interface{Name: "swp1"}, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Routes)
+	assert.Equal(t, 3, lk.lookups)
+
+	var drop *DropError
+	lk.routeErr = errors.New("netlink")
+	_, err = Gather(lk, c, testInterface(), nil)
+	assert.True(t, errors.As(err, &drop))
+	assert.Equal(t, metrics.DropRouteLookup, drop.Reason)
+}
+
+func TestDecideBoot(t *testing.T) {
+	c := testConfig()
+	c.Bootfile = "pxelinux.0"
+	c.Tftp = net.IPv4(192, 0, 2, 69)
+	var err error
+	c.BootProfiles, err = boot.ParseProfiles([]boot.ProfileJSON{
+		{Name: "ipxe", UserClass: "iPXE", Bootfile: "http://boot.example.com/boot.ipxe"},
+		{Name: "uefi", Arch: []uint16{7}, Bootfile: "ipxe.efi", NextServer: "192.0.2.70", Tftp: "tftp.example.com"},
+	})
+	assert.Nil(t, err)
+
+	fileProfiles, err := boot.ParseProfiles([]boot.ProfileJSON{
+		{Name: "arm64", Arch: []uint16{11}, Bootfile: "arm64.efi"},
+	})
+	assert.Nil(t, err)
+
+	namedTftp, err := boot.ParseProfiles([]boot.ProfileJSON{
+		{Name: "named", UserClass: "iPXE", Bootfile: "boot.ipxe", Tftp: "tftp.example.com"},
+	})
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name    string
+		mods    []dhcpv4.Modifier
+		options *options.DHCP
+
+		profile    string
+		bootfile   string
+		nextServer string
+		tftp       string
+	}{
+		{"no profile", nil, nil, "", "pxelinux.0", "192.0.2.69", "192.0.2.69"},
+		{"bootfile from options file", nil, &options.DHCP{Bootfile: ptr("grub.efi")}, "", "grub.efi", "192.0.2.69", "192.0.2.69"},
+		{"ipxe", []dhcpv4.Modifier{
+			dhcpv4.WithOption(dhcpv4.OptUserClass("iPXE")),
+		}, nil, "ipxe", "http://boot.example.com/boot.ipxe", "192.0.2.69", "192.0.2.69"},
+		{"uefi", []dhcpv4.Modifier{
+			dhcpv4.WithOption(dhcpv4.OptClientArch(iana.EFI_X86_64)),
+		}, &options.DHCP{Bootfile: ptr("grub.efi")}, "uefi", "ipxe.efi", "192.0.2.70", "tftp.example.com"},
+		{"options file replaces profiles", []dhcpv4.Modifier{
+			dhcpv4.WithOption(dhcpv4.OptClientArch(iana.EFI_X86_64)),
+		}, &options.DHCP{BootProfiles: fileProfiles}, "", "pxelinux.0", "192.0.2.69", "192.0.2.69"},
+		{"tftp server by name", []dhcpv4.Modifier{
+			dhcpv4.WithOption(dhcpv4.OptUserClass("iPXE")),
+		}, &options.DHCP{BootProfiles: namedTftp}, "named", "boot.ipxe", "203.0.113.1", "tftp.example.com"},
+		{"profile from options file", []dhcpv4.Modifier{
+			dhcpv4.WithOption(dhcpv4.OptClientArch(iana.EFI_ARM64)),
+		}, &options.DHCP{BootProfiles: fileProfiles}, "arm64", "arm64.efi", "192.0.2.69", "192.0.2.69"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			f := &Facts{Interface: testInterface(), Routes: hostRoutes("203.0.113.7"), Options: tc.options}
+			req, err := dhcpv4.New(append([]dhcpv4.Modifier{dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover)}, tc.mods...)...)
+			assert.Nil(t, err)
+
+			r, err := Decide(c, req, f, nil)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.profile, r.BootProfile)
+			assert.Equal(t, tc.bootfile, *r.Options.Bootfile)
+			assert.Equal(t, tc.nextServer, r.NextServer.String())
+			assert.Equal(t, tc.tftp, r.TFTPServer)
+			assert.Equal(t, boot.DeliverBoth, r.Delivery)
+		})
+	}
+
+	// Delivery from the options file wins over the configuration
+	c.BootDelivery = boot.DeliverHeader
+	f := &Facts{Interface: testInterface(), Routes: hostRoutes("203.0.113.7")}
+	req, err := dhcpv4.New(dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover))
+	assert.Nil(t, err)
+	r, err := Decide(c, req, f, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, boot.DeliverHeader, r.Delivery)
+
+	f.Options = &options.DHCP{BootDelivery: ptr(boot.DeliverOptions)}
+	r, err = Decide(c, req, f, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, boot.DeliverOptions, r.Delivery)
+}
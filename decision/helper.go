@@ -0,0 +1,151 @@
+package decision
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/linode/dhcpd-unnumbered/config"
+	"github.com/linode/dhcpd-unnumbered/options"
+)
+
+// dynamicHostname will generate hostname from IP and predefined domainname
+func dynamicHostname(ip net.IP) string {
+	return strings.NewReplacer(".", "-", ":", "-").Replace(ip.String())
+}
+
+// pickHostname returns the hostname and domain name handed out to a client
+// getting ip, nil if it gets none, and where the hostname came from. The
+// options file takes priority over the hostname override file, which takes
+// priority over the dynamic hostname and the configuration.
+func pickHostname(c *config.Config, f *Facts, o *options.DHCP, ip net.IP) (string, string, string) {
+	// should I generate a dynamic hostname?
+	hostname := c.Hostname
+	domainname := c.Domainname
+	source := "configuration"
+
+	// find dynamic hostname if feature is enabled
+	if c.DynamicHostname && ip != nil {
+		hostname = dynamicHostname(ip)
+		source = "dynamic hostname"
+	}
+
+	// static hostname in a file (if exists) will supersede the dynamic hostname
+	if f.HasHostname {
+		hostname = f.Hostname
+		if f.Domainname != "" {
+			domainname = f.Domainname
+		}
+		source = "hostname override file"
+	}
+
+	// Options file takes priority over other hostname settings
+	if o.Hostname != nil {
+		hostname = *o.Hostname
+		source = "options file"
+	}
+	if o.Domainname != nil {
+		domainname = *o.Domainname
+	}
+	return hostname, domainname, source
+}
+
+// mixDNS sorts dns servers in a sudo-random way (the provided IP should always get back the same sequence of DNS)
+func mixDNS(servers []net.IP, ip net.IP) []net.IP {
+	l := len(servers)
+	if l == 0 {
+		return nil
+	}
+	// just mod over last octet of IP as it provides the highest diversity without causing much complexity
+	m := int(ip[len(ip)-1]) % l
+	var mix []net.IP
+
+	for i := 0; i < l; i++ {
+		if i+m >= l {
+			m = m - l
+		}
+		mix = append(mix, servers[i+m])
+	}
+
+	return mix
+}
+
+// Determine the gateway based on IP and Netmask.
+func gatewayFromIP(ipnet *net.IPNet) *net.IP {
+	// Apply netmask to IP, then increment last octet by one
+	gw := ipnet.IP.Mask(ipnet.Mask)
+	gw[len(gw)-1] += 1
+
+	return &gw
+}
+
+// ownsIP returns true if ip is one of the addresses in ips.
+func ownsIP(ips []*net.IPNet, ip net.IP) bool {
+	for _, ipn := range ips {
+		if ipn.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRequest validates a DHCPREQUEST against the addresses owned by the
+// requesting interface, following the client states of RFC 2131 section
+// 4.3.2. serverID is the server identifier we hand out. Unless the verdict is
+// Ack, a reason is returned as well.
+func checkRequest(req *dhcpv4.DHCPv4, owned []*net.IPNet, serverID net.IP) (Verdict, string) {
+	requested := req.RequestedIPAddress()
+	ciaddr := req.ClientIPAddr
+	hasCiaddr := ciaddr != nil && !ciaddr.IsUnspecified()
+
+	switch {
+	case req.ServerIdentifier() != nil:
+		// SELECTING: the client answers an offer, which may not be ours.
+		if !req.ServerIdentifier().Equal(serverID) {
+			return Ignore, fmt.Sprintf("client selected server %s", req.ServerIdentifier())
+		}
+		if requested == nil || hasCiaddr {
+			return Nak, "malformed request in SELECTING state"
+		}
+		if !ownsIP(owned, requested) {
+			return Nak, fmt.Sprintf("requested address %s is not available", requested)
+		}
+	case requested != nil:
+		// INIT-REBOOT: the client verifies a previously allocated address.
+		if !ownsIP(owned, requested) {
+			return Nak, fmt.Sprintf("requested address %s is not available", requested)
+		}
+	case hasCiaddr:
+		// RENEWING or REBINDING: the client extends its lease.
+		if !ownsIP(owned, ciaddr) {
+			return Nak, fmt.Sprintf("client address %s is not available", ciaddr)
+		}
+	default:
+		return Ignore, "neither requested nor client address set"
+	}
+
+	return Ack, ""
+}
+
+// containsIP returns true if ip is one of ips.
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address the client sending req asks for or holds, nil
+// if it gives neither.
+func clientIP(req *dhcpv4.DHCPv4) net.IP {
+	if ip := req.RequestedIPAddress(); ip != nil {
+		return ip
+	}
+	if ip := req.ClientIPAddr; ip != nil && !ip.IsUnspecified() {
+		return ip
+	}
+	return nil
+}
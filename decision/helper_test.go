@@ -0,0 +1,158 @@
+package decision
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+)
+
+func IPsEqual(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, v := range a {
+		if !v.Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMixDNS(t *testing.T) {
+	myDNS := []net.IP{net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 2), net.IPv4(3, 3, 3, 3), net.IPv4(4, 4, 4, 4)}
+
+	tests := []struct {
+		input net.IP
+		want  []net.IP
+	}{
+		{
+			net.IPv4(1, 1, 1, 0),
+			[]net.IP{net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 2), net.IPv4(3, 3, 3, 3), net.IPv4(4, 4, 4, 4)},
+		},
+		{
+			net.IPv4(1, 1, 1, 1),
+			[]net.IP{net.IPv4(2, 2, 2, 2), net.IPv4(3, 3, 3, 3), net.IPv4(4, 4, 4, 4), net.IPv4(1, 1, 1, 1)},
+		},
+		{
+			net.IPv4(3, 3, 3, 2),
+			[]net.IP{net.IPv4(3, 3, 3, 3), net.IPv4(4, 4, 4, 4), net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 2)},
+		},
+		{
+			net.IPv4(3, 3, 3, 3),
+			[]net.IP{net.IPv4(4, 4, 4, 4), net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 2), net.IPv4(3, 3, 3, 3)},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("Test: %s", tc.input), func(t *testing.T) {
+			out := mixDNS(myDNS, tc.input)
+			if !IPsEqual(out, tc.want) {
+				t.Errorf("Failed ! got %s want %s", out, tc.want)
+			} else {
+				t.Logf("Success !")
+			}
+		})
+	}
+}
+
+func TestDynamicHostname(t *testing.T) {
+	tests := []struct {
+		input net.IP
+		want  string
+	}{
+		{net.IPv4(1, 1, 1, 1), "1-1-1-1"},
+		{net.IPv4(2, 2, 2, 2), "2-2-2-2"},
+		{net.ParseIP("2001:db8::7"), "2001-db8--7"},
+	}
+
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("Test: %s", tc.input), func(t *testing.T) {
+			if h := dynamicHostname(tc.input); h != tc.want {
+				t.Errorf("Failed ! got %s want %s", h, tc.want)
+			} else {
+				t.Logf("Success !")
+			}
+		})
+	}
+}
+
+func TestGatewayFromIP(t *testing.T) {
+	tests := []struct {
+		input  string
+		output string
+	}{
+		{"192.168.11.11/23", "192.168.10.1"},
+		{"192.168.14.15/24", "192.168.14.1"},
+		{"192.168.11.40/27", "192.168.11.33"},
+	}
+
+	for _, test := range tests {
+		ip, ipnet, err := net.ParseCIDR(test.input)
+		assert.Nil(t, err, "Failed to parse test data!")
+		chosenIP := net.IPNet{
+			IP:   ip,
+			Mask: ipnet.Mask,
+		}
+		gw := gatewayFromIP(&chosenIP)
+
+		assert.Equal(t, test.output, gw.String(), "Unexpected gateway")
+	}
+}
+
+func TestCheckRequest(t *testing.T) {
+	owned := []*net.IPNet{
+		{IP: net.IPv4(10, 0, 0, 5), Mask: net.CIDRMask(24, 32)},
+		{IP: net.IPv4(192, 168, 0, 5), Mask: net.CIDRMask(24, 32)},
+	}
+	serverID := net.IPv4(10, 255, 255, 1)
+	otherID := net.IPv4(10, 255, 255, 2)
+
+	tests := []struct {
+		name string
+		mods []dhcpv4.Modifier
+		want Verdict
+	}{
+		{"selecting owned", []dhcpv4.Modifier{
+			dhcpv4.WithOption(dhcpv4.OptServerIdentifier(serverID)),
+			dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(10, 0, 0, 5))),
+		}, Ack},
+		{"selecting not owned", []dhcpv4.Modifier{
+			dhcpv4.WithOption(dhcpv4.OptServerIdentifier(serverID)),
+			dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(10, 0, 0, 6))),
+		}, Nak},
+		{"selecting other server", []dhcpv4.Modifier{
+			dhcpv4.WithOption(dhcpv4.OptServerIdentifier(otherID)),
+			dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(10, 0, 0, 5))),
+		}, Ignore},
+		{"selecting without requested IP", []dhcpv4.Modifier{
+			dhcpv4.WithOption(dhcpv4.OptServerIdentifier(serverID)),
+		}, Nak},
+		{"init-reboot owned", []dhcpv4.Modifier{
+			dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(192, 168, 0, 5))),
+		}, Ack},
+		{"init-reboot not owned", []dhcpv4.Modifier{
+			dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(1, 2, 3, 4))),
+		}, Nak},
+		{"renewing owned", []dhcpv4.Modifier{
+			dhcpv4.WithClientIP(net.IPv4(10, 0, 0, 5)),
+		}, Ack},
+		{"renewing not owned", []dhcpv4.Modifier{
+			dhcpv4.WithClientIP(net.IPv4(10, 0, 0, 7)),
+		}, Nak},
+		{"no address at all", nil, Ignore},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mods := append([]dhcpv4.Modifier{dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest)}, tc.mods...)
+			req, err := dhcpv4.New(mods...)
+			assert.Nil(t, err)
+
+			verdict, reason := checkRequest(req, owned, serverID)
+			assert.Equal(t, tc.want, verdict, reason)
+		})
+	}
+}
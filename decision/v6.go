@@ -0,0 +1,184 @@
+package decision
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/linode/dhcpd-unnumbered/config"
+	"github.com/linode/dhcpd-unnumbered/metrics"
+	"github.com/linode/dhcpd-unnumbered/options"
+)
+
+// Lookup6 gets the facts about a tap served over DHCPv6 that don't come with
+// the message.
+type Lookup6 interface {
+	// InterfaceByName returns the interface with the given name.
+	InterfaceByName(name string) (*net.Interface, error)
+	// Routes6 returns the IPv6 host routes to the interface with the given
+	// index, and where they were read from, e.g. "table 254".
+	Routes6(ifindex int) ([]*net.IPNet, string, error)
+	// Options returns the options file of the interface, which is empty if
+	// there is none.
+	Options(ifName string) (*options.DHCP, error)
+	// Hostname returns the hostname and domain name from the hostname
+	// override file of the interface.
+	Hostname(ifName string) (string, string, error)
+}
+
+// Reply6 is how a DHCPv6 message is to be answered.
+type Reply6 struct {
+	// Options with the lease time filled in
+	Options *options.DHCP
+	// Addresses handed out in IA_NA, all of those routed to the interface
+	Addrs        []net.IP
+	DNS          []net.IP
+	DomainSearch []string
+	// Fully qualified domain name, only sent to clients asking for one
+	FQDN string
+	// For CONFIRM, whether the addresses of the client are still on link.
+	// Unless Ack, Reason says why.
+	Verdict Verdict
+	Reason  string
+}
+
+// Accept6 checks the server and client identifiers of msg as per RFC 8415
+// section 16, serverID being ours.
+func Accept6(msg *dhcpv6.Message, serverID dhcpv6.Duid) error {
+	mt := msg.MessageType
+	sid := msg.Options.ServerID()
+
+	switch mt {
+	case dhcpv6.MessageTypeSolicit, dhcpv6.MessageTypeConfirm, dhcpv6.MessageTypeRebind:
+		if sid != nil {
+			return &DropError{metrics.DropInvalidMessage, fmt.Errorf("%s with server identifier, ignoring", mt)}
+		}
+	case dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRelease, dhcpv6.MessageTypeDecline:
+		if sid == nil {
+			return &DropError{metrics.DropInvalidMessage, fmt.Errorf("%s without server identifier, ignoring", mt)}
+		}
+		if !sid.Equal(serverID) {
+			return &DropError{metrics.DropOtherServer, fmt.Errorf("%s for server %s, ignoring", mt, sid)}
+		}
+	case dhcpv6.MessageTypeInformationRequest:
+		if sid != nil && !sid.Equal(serverID) {
+			return &DropError{metrics.DropOtherServer, fmt.Errorf("%s for server %s, ignoring", mt, sid)}
+		}
+		// The client identifier is optional here
+		return nil
+	default:
+		return &DropError{metrics.DropUnhandledType, fmt.Errorf("Unhandled message type: %s", mt)}
+	}
+
+	if msg.Options.ClientID() == nil {
+		return &DropError{metrics.DropInvalidMessage, fmt.Errorf("%s without client identifier, ignoring", mt)}
+	}
+	return nil
+}
+
+// Gather6 reads the options file, IPv6 host routes and hostname override of
+// ifi through lk.
+func Gather6(lk Lookup6, c *config.Config, ifi *net.Interface, t *Trace) (*Facts, error) {
+	f := gatherOverrides(lk, c, ifi, t)
+
+	if f.Options == nil || len(f.Options.IPv6) == 0 {
+		rts, from, err := lk.Routes6(ifi.Index)
+		if err != nil {
+			return nil, &DropError{metrics.DropRouteLookup, fmt.Errorf("failed to get IPv6 routes for Interface %v: %v", ifi.Name, err)}
+		}
+		t.Step("Read IPv6 routes from %s", from)
+		f.Routes = rts
+	}
+
+	return f, nil
+}
+
+// Decide6 works out the reply to DHCPv6 message msg with facts f and
+// configuration c. Returns a *DropError if there is no reply.
+func Decide6(c *config.Config, msg *dhcpv6.Message, f *Facts, t *Trace) (*Reply6, error) {
+	// Work on a copy, defaults are filled in below
+	options := &options.DHCP{}
+	if f.Options != nil {
+		*options = *f.Options
+	}
+
+	if options.LeaseTime == nil {
+		leaseTime := c.LeaseTime
+		options.LeaseTime = &leaseTime
+	}
+
+	r := &Reply6{
+		Options: options,
+		Verdict: Ack,
+	}
+
+	// Unlike DHCPv4 there's no need to pick one, the client gets all of them
+	if len(options.IPv6) > 0 {
+		r.Addrs = options.IPv6
+		t.Step("IPv6 addresses from options file for Interface %v: %v", f.Interface.Name, r.Addrs)
+	} else {
+		for _, ipn := range f.Routes {
+			r.Addrs = append(r.Addrs, ipn.IP)
+		}
+		t.Step("IPv6 routes found for Interface %v: %v", f.Interface.Name, r.Addrs)
+	}
+
+	switch msg.MessageType {
+	case dhcpv6.MessageTypeSolicit:
+		// Taps without IPv6 don't get advertised to at all, so the client
+		// keeps looking for a server that may have addresses
+		if len(r.Addrs) == 0 {
+			return nil, &DropError{metrics.DropNoHostRoutes, errors.New("seems like we have no IPv6 host routes or override IPs, not providing DHCPv6")}
+		}
+	case dhcpv6.MessageTypeConfirm:
+		// RFC 8415 18.3.3: the client checks whether it's still on the same
+		// link, which it is if all of its addresses are still ours.
+		confirmed := 0
+		for _, ia := range msg.Options.IANA() {
+			for _, addr := range ia.Options.Addresses() {
+				if !containsIP(r.Addrs, addr.IPv6Addr) {
+					r.Verdict, r.Reason = Nak, fmt.Sprintf("address %s is not on link", addr.IPv6Addr)
+					t.Step("CONFIRM gets NotOnLink: %s", r.Reason)
+					return r, nil
+				}
+				confirmed++
+			}
+		}
+		if confirmed == 0 {
+			return nil, &DropError{metrics.DropInvalidMessage, fmt.Errorf("CONFIRM without addresses on %v, ignoring", f.Interface.Name)}
+		}
+		t.Step("CONFIRM of %d addresses gets Success", confirmed)
+	}
+
+	var firstIP net.IP
+	if len(r.Addrs) > 0 {
+		firstIP = r.Addrs[0]
+	}
+
+	if len(options.DNS6) > 0 {
+		r.DNS = options.DNS6
+		t.Step("IPv6 DNS servers from options file: %v", r.DNS)
+	} else if firstIP != nil {
+		r.DNS = mixDNS(c.DNS6, firstIP)
+		t.Step("IPv6 DNS servers mixed for %v: %v", firstIP, r.DNS)
+	} else {
+		r.DNS = c.DNS6
+		t.Step("IPv6 DNS servers: %v", r.DNS)
+	}
+
+	hostname, domainname, source := pickHostname(c, f, options, firstIP)
+	r.FQDN = hostname
+	if domainname != "" {
+		r.FQDN += "." + domainname
+	}
+	t.Step("FQDN %s from %s", r.FQDN, source)
+
+	// There's no domain name option in DHCPv6, the search list stands in
+	r.DomainSearch = options.DomainSearch
+	if len(r.DomainSearch) == 0 && domainname != "" {
+		r.DomainSearch = []string{domainname}
+	}
+
+	return r, nil
+}
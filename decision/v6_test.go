@@ -0,0 +1,239 @@
+package decision
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/linode/dhcpd-unnumbered/config"
+	"github.com/linode/dhcpd-unnumbered/metrics"
+	"github.com/linode/dhcpd-unnumbered/options"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testServerID = dhcpv6.Duid{Type: dhcpv6.DUID_LL, HwType: iana.HWTypeEthernet, LinkLayerAddr: net.HardwareAddr{0xfe, 0, 0, 0, 0, 7}}
+	testClientID = dhcpv6.Duid{Type: dhcpv6.DUID_LL, HwType: iana.HWTypeEthernet, LinkLayerAddr: net.HardwareAddr{0, 0, 0x5e, 0, 0x53, 1}}
+)
+
+// hostRoutes6 returns /128s for ips.
+func hostRoutes6(ips ...string) []*net.IPNet {
+	var r []*net.IPNet
+	for _, ip := range ips {
+		r = append(r, &net.IPNet{IP: net.ParseIP(ip), Mask: net.CIDRMask(128, 128)})
+	}
+	return r
+}
+
+// message6 returns a DHCPv6 message of type mt from the test client with
+// options opts.
+func message6(mt dhcpv6.MessageType, opts ...dhcpv6.Option) *dhcpv6.Message {
+	msg := &dhcpv6.Message{MessageType: mt}
+	msg.AddOption(dhcpv6.OptClientID(testClientID))
+	for _, opt := range opts {
+		msg.AddOption(opt)
+	}
+	return msg
+}
+
+// iana6 returns an IA_NA holding addrs.
+func iana6(addrs ...string) *dhcpv6.OptIANA {
+	ia := &dhcpv6.OptIANA{IaId: [4]byte{0, 0, 0, 1}}
+	for _, a := range addrs {
+		ia.Options.Add(&dhcpv6.OptIAAddress{IPv6Addr: net.ParseIP(a)})
+	}
+	return ia
+}
+
+func TestAccept6(t *testing.T) {
+	other := dhcpv6.Duid{Type: dhcpv6.DUID_LL, HwType: iana.HWTypeEthernet, LinkLayerAddr: net.HardwareAddr{0xfe, 0, 0, 0, 0, 8}}
+
+	tests := []struct {
+		name string
+		msg  *dhcpv6.Message
+		drop string
+	}{
+		{"solicit", message6(dhcpv6.MessageTypeSolicit), ""},
+		{"solicit with server id", message6(dhcpv6.MessageTypeSolicit, dhcpv6.OptServerID(testServerID)), metrics.DropInvalidMessage},
+		{"solicit without client id", &dhcpv6.Message{MessageType: dhcpv6.MessageTypeSolicit}, metrics.DropInvalidMessage},
+		{"request", message6(dhcpv6.MessageTypeRequest, dhcpv6.OptServerID(testServerID)), ""},
+		{"request without server id", message6(dhcpv6.MessageTypeRequest), metrics.DropInvalidMessage},
+		{"request for other server", message6(dhcpv6.MessageTypeRequest, dhcpv6.OptServerID(other)), metrics.DropOtherServer},
+		{"renew for other server", message6(dhcpv6.MessageTypeRenew, dhcpv6.OptServerID(other)), metrics.DropOtherServer},
+		{"rebind", message6(dhcpv6.MessageTypeRebind), ""},
+		{"release", message6(dhcpv6.MessageTypeRelease, dhcpv6.OptServerID(testServerID)), ""},
+		{"information request", &dhcpv6.Message{MessageType: dhcpv6.MessageTypeInformationRequest}, ""},
+		{"information request for other server", message6(dhcpv6.MessageTypeInformationRequest, dhcpv6.OptServerID(other)), metrics.DropOtherServer},
+		{"advertise", message6(dhcpv6.MessageTypeAdvertise), metrics.DropUnhandledType},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := Accept6(tc.msg, testServerID)
+			if tc.drop == "" {
+				assert.Nil(t, err)
+				return
+			}
+			var drop *DropError
+			if assert.True(t, errors.As(err, &drop), "not dropped: %v", err) {
+				assert.Equal(t, tc.drop, drop.Reason)
+			}
+		})
+	}
+}
+
+func TestGather6(t *testing.T) {
+	c := testConfig()
+	c.HostnameOverride = true
+
+	lk := &fakeLookup{options: &options.DHCP{}, routes6: hostRoutes6("2001:db8::7"), hostname: "vm"}
+	f, err := Gather6(lk, c, testInterface(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, lk.routes6, f.Routes)
+	assert.Equal(t, "vm", f.Hostname)
+	assert.Equal(t, 1, lk.lookups)
+
+	// Addresses from the options file make routes unnecessary
+	lk.options = &options.DHCP{IPv6: []net.IP{net.ParseIP("2001:db8::9")}}
+	f, err = Gather6(lk, c, testInterface(), nil)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Routes)
+	assert.Equal(t, 1, lk.lookups)
+
+	// IPv4 addresses in the options file don't
+	lk.options = &options.DHCP{IPv4: hostRoutes("198.51.100.9")}
+	f, err = Gather6(lk, c, testInterface(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, lk.routes6, f.Routes)
+
+	var drop *DropError
+	lk.routeErr = errors.New("netlink")
+	_, err = Gather6(lk, c, testInterface(), nil)
+	assert.True(t, errors.As(err, &drop))
+	assert.Equal(t, metrics.DropRouteLookup, drop.Reason)
+}
+
+func TestDecide6(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  *dhcpv6.Message
+		c    func(*config.Config)
+		f    func(*Facts)
+
+		addrs   []string
+		dns     []string
+		search  []string
+		fqdn    string
+		verdict Verdict
+		drop    string
+	}{
+		{
+			name:  "all routes",
+			msg:   message6(dhcpv6.MessageTypeSolicit, iana6()),
+			f:     func(f *Facts) { f.Routes = hostRoutes6("2001:db8::7", "2001:db8::8") },
+			addrs: []string{"2001:db8::7", "2001:db8::8"}, search: []string{"localdomain"}, fqdn: "localhost.localdomain",
+		},
+		{
+			name: "solicit without routes",
+			msg:  message6(dhcpv6.MessageTypeSolicit, iana6()),
+			drop: metrics.DropNoHostRoutes,
+		},
+		{
+			name: "request without routes",
+			msg:  message6(dhcpv6.MessageTypeRequest, iana6("2001:db8::7")),
+			fqdn: "localhost.localdomain", search: []string{"localdomain"},
+		},
+		{
+			name: "options file",
+			msg:  message6(dhcpv6.MessageTypeRequest, iana6()),
+			f: func(f *Facts) {
+				f.Routes = hostRoutes6("2001:db8::7")
+				f.Options = &options.DHCP{
+					IPv6:         []net.IP{net.ParseIP("2001:db8::9")},
+					DNS6:         []net.IP{net.ParseIP("2001:db8::53")},
+					Hostname:     ptr("vm"),
+					Domainname:   ptr("example.com"),
+					DomainSearch: []string{"example.net"},
+				}
+			},
+			addrs: []string{"2001:db8::9"}, dns: []string{"2001:db8::53"}, search: []string{"example.net"}, fqdn: "vm.example.com",
+		},
+		{
+			name: "configured DNS and dynamic hostname",
+			msg:  message6(dhcpv6.MessageTypeRenew, iana6("2001:db8::7")),
+			c: func(c *config.Config) {
+				c.DNS6 = []net.IP{net.ParseIP("2001:db8::53"), net.ParseIP("2001:db8::54")}
+				c.DynamicHostname = true
+				c.Domainname = ""
+			},
+			f:     func(f *Facts) { f.Routes = hostRoutes6("2001:db8::7") },
+			addrs: []string{"2001:db8::7"}, dns: []string{"2001:db8::54", "2001:db8::53"}, fqdn: "2001-db8--7",
+		},
+		{
+			name:  "confirm on link",
+			msg:   message6(dhcpv6.MessageTypeConfirm, iana6("2001:db8::7")),
+			f:     func(f *Facts) { f.Routes = hostRoutes6("2001:db8::7", "2001:db8::8") },
+			addrs: []string{"2001:db8::7", "2001:db8::8"}, search: []string{"localdomain"}, fqdn: "localhost.localdomain",
+		},
+		{
+			name:    "confirm not on link",
+			msg:     message6(dhcpv6.MessageTypeConfirm, iana6("2001:db8::7", "2001:db8::99")),
+			f:       func(f *Facts) { f.Routes = hostRoutes6("2001:db8::7") },
+			addrs:   []string{"2001:db8::7"},
+			verdict: Nak,
+		},
+		{
+			name: "confirm without addresses",
+			msg:  message6(dhcpv6.MessageTypeConfirm, iana6()),
+			f:    func(f *Facts) { f.Routes = hostRoutes6("2001:db8::7") },
+			drop: metrics.DropInvalidMessage,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := testConfig()
+			if tc.c != nil {
+				tc.c(c)
+			}
+			f := &Facts{Interface: testInterface()}
+			if tc.f != nil {
+				tc.f(f)
+			}
+
+			r, err := Decide6(c, tc.msg, f, nil)
+			if tc.drop != "" {
+				var drop *DropError
+				if assert.True(t, errors.As(err, &drop), "not dropped: %v", err) {
+					assert.Equal(t, tc.drop, drop.Reason)
+				}
+				return
+			}
+			if !assert.Nil(t, err) {
+				return
+			}
+
+			var addrs []string
+			for _, ip := range r.Addrs {
+				addrs = append(addrs, ip.String())
+			}
+			assert.Equal(t, tc.addrs, addrs, "Bad addresses")
+			assert.Equal(t, tc.verdict, r.Verdict, "Bad verdict: %s", r.Reason)
+			if r.Verdict != Ack {
+				return
+			}
+
+			var dns []string
+			for _, ip := range r.DNS {
+				dns = append(dns, ip.String())
+			}
+			assert.Equal(t, tc.dns, dns, "Bad DNS")
+			assert.Equal(t, tc.search, r.DomainSearch, "Bad domain search")
+			assert.Equal(t, tc.fqdn, r.FQDN, "Bad FQDN")
+			assert.Equal(t, 30*time.Minute, *r.Options.LeaseTime, "Bad lease time")
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/linode/dhcpd-unnumbered/control"
+	"github.com/linode/dhcpd-unnumbered/decision"
+	"github.com/linode/dhcpd-unnumbered/leases"
+	"github.com/linode/dhcpd-unnumbered/options"
+	"github.com/linode/dhcpd-unnumbered/relay"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+var explainTypes = map[string]dhcpv4.MessageType{
+	"discover": dhcpv4.MessageTypeDiscover,
+	"request":  dhcpv4.MessageTypeRequest,
+	"inform":   dhcpv4.MessageTypeInform,
+}
+
+// explain runs the decision pipeline for a made up request on an interface,
+// without sending anything, and writes each step to w. args are the
+// arguments following the explain subcommand.
+func explain(w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("explain", flag.ContinueOnError)
+	fs.SetOutput(w)
+	mac := fs.String("mac", "00:00:5e:00:53:01", "client hardware address")
+	msgType := fs.String("type", "discover", "message type, one of discover, request or inform")
+	requested := fs.String("requested", "", "requested IP (option 50)")
+	ciaddr := fs.String("ciaddr", "", "client IP (ciaddr)")
+	serverID := fs.String("server-id", "", "server identifier (option 54), as sent in SELECTING state")
+	arch := fs.Int("arch", -1, "client system architecture (option 93), i.e. 0 for BIOS or 7 for UEFI x86-64")
+	userClass := fs.String("user-class", "", "user class (option 77), i.e. iPXE")
+	vendorClass := fs.String("vendor-class", "", "vendor class (option 60), i.e. PXEClient")
+	giaddr := fs.String("giaddr", "", "relay agent address (giaddr), the request is relayed if set")
+	circuitID := fs.String("circuit-id", "", "circuit-id sent by the relay agent (option 82)")
+	remoteID := fs.String("remote-id", "", "remote-id sent by the relay agent (option 82)")
+	relaySrc := fs.String("relay-src", "", "address the relay agent sends from, defaults to giaddr")
+	nsName := fs.String("netns", "", "named network namespace in -netns-dir the interface is in")
+	fs.Usage = func() {
+		fmt.Fprintln(w, "usage: dhcpd-unnumbered [flags] explain [explain flags] <interface>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("exactly one interface expected")
+	}
+	ifName := fs.Arg(0)
+
+	mt, ok := explainTypes[*msgType]
+	if !ok {
+		return fmt.Errorf("invalid message type '%s'", *msgType)
+	}
+	hwaddr, err := net.ParseMAC(*mac)
+	if err != nil {
+		return fmt.Errorf("invalid MAC: %v", err)
+	}
+	mods := []dhcpv4.Modifier{dhcpv4.WithMessageType(mt), dhcpv4.WithHwAddr(hwaddr)}
+	for _, o := range []struct {
+		value string
+		mod   func(net.IP) dhcpv4.Modifier
+	}{
+		{*requested, func(ip net.IP) dhcpv4.Modifier { return dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)) }},
+		{*ciaddr, dhcpv4.WithClientIP},
+		{*serverID, func(ip net.IP) dhcpv4.Modifier { return dhcpv4.WithOption(dhcpv4.OptServerIdentifier(ip)) }},
+		{*giaddr, dhcpv4.WithGatewayIP},
+	} {
+		if o.value == "" {
+			continue
+		}
+		ip := net.ParseIP(o.value).To4()
+		if ip == nil {
+			return fmt.Errorf("invalid IP '%s'", o.value)
+		}
+		mods = append(mods, o.mod(ip))
+	}
+	if *arch >= 0 {
+		mods = append(mods, dhcpv4.WithOption(dhcpv4.OptClientArch(iana.Arch(*arch))))
+	}
+	if *userClass != "" {
+		mods = append(mods, dhcpv4.WithOption(dhcpv4.OptUserClass(*userClass)))
+	}
+	if *vendorClass != "" {
+		mods = append(mods, dhcpv4.WithOption(dhcpv4.OptClassIdentifier(*vendorClass)))
+	}
+	var subs []dhcpv4.Option
+	if *circuitID != "" {
+		subs = append(subs, dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte(*circuitID)))
+	}
+	if *remoteID != "" {
+		subs = append(subs, dhcpv4.OptGeneric(dhcpv4.AgentRemoteIDSubOption, []byte(*remoteID)))
+	}
+	if len(subs) > 0 {
+		mods = append(mods, dhcpv4.WithOption(dhcpv4.OptRelayAgentInfo(subs...)))
+	}
+	req, err := dhcpv4.New(mods...)
+	if err != nil {
+		return fmt.Errorf("unable to build request: %v", err)
+	}
+
+	c, err := loadConfig()
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	cfg.Store(c)
+
+	ns := netns.None()
+	if *nsName != "" {
+		if !options.ValidName(*nsName) {
+			return fmt.Errorf("invalid namespace name '%s'", *nsName)
+		}
+		ns, err = netns.GetFromPath(filepath.Join(*flagNetnsDir, *nsName))
+		if err != nil {
+			return fmt.Errorf("unable to open namespace: %v", err)
+		}
+		defer ns.Close()
+	}
+
+	// Each namespace has its own loopback to pick the source IP from
+	var sIP net.IP
+	var ifi *net.Interface
+	err = inNetns(ns, func() (err error) {
+		if sIP, err = getSourceIP(); err != nil {
+			return fmt.Errorf("unable to get source IP to be used: %v", err)
+		}
+		ifi, err = net.InterfaceByName(ifName)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Requests from taps in a VRF are handled by its listener, which looks up
+	// routes in the VRF's table. Namespaces are served by a single listener
+	// on the main table.
+	vrf, table := "", unix.RT_TABLE_MAIN
+	if !ns.IsOpen() {
+		if vrf, table, err = getMasterVRF(ns, ifName); err != nil {
+			return err
+		}
+	}
+
+	// Nothing is received or sent
+	l := newListenerOn(nil, nil, ns, *nsName, ifName, vrf, table)
+	l.sIP = sIP
+	l.SetRelayMap(newRelayMap())
+	t := &decision.Trace{Log: l.log, Record: true}
+	t.Step("%s from %s on %s", mt, hwaddr, overrideName(*nsName, ifName))
+
+	// Clients keep the address they hold a lease for, so ask the running
+	// daemon. Routes are read from the table its route cache mirrors.
+	if leaseTable, err := daemonLeases(*flagControl); err != nil {
+		t.Step("Leases of the running daemon left out: %v", err)
+	} else {
+		l.SetLeases(leaseTable)
+		t.Step("Leases of the running daemon consulted: %d", len(leaseTable.List()))
+	}
+
+	r, err := func() (*decision.Reply, error) {
+		lk := l.lookup(c)
+		if agent := relay.FromRequest(req); agent != nil {
+			src := agent.Addr
+			if *relaySrc != "" {
+				if src = net.ParseIP(*relaySrc); src == nil {
+					return nil, fmt.Errorf("invalid IP '%s'", *relaySrc)
+				}
+			}
+			ifi, err = decision.AcceptRelay(c, lk, agent, src, t)
+		} else {
+			err = decision.Accept(c, ifi, t)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return l.decide(c, lk, ifi, req, l.leaseKey(ifi.Name, req), t)
+	}()
+
+	for i, step := range t.Steps {
+		fmt.Fprintf(w, "%2d. %s\n", i+1, step)
+	}
+
+	var drop *decision.DropError
+	switch {
+	case errors.As(err, &drop):
+		fmt.Fprintf(w, "Dropped (%s): %v\n", drop.Reason, drop.Err)
+		return nil
+	case err != nil:
+		return err
+	case r.Verdict == decision.Nak:
+		fmt.Fprintf(w, "NAK: %s\n", r.Reason)
+		return nil
+	}
+
+	reply := dhcpv4.MessageTypeAck
+	if mt == dhcpv4.MessageTypeDiscover {
+		reply = dhcpv4.MessageTypeOffer
+	}
+	fmt.Fprintf(w, "%s with %v, gateway %v, lease %s, hostname %s.%s, dns %v, classless %t, bootfile %q, next server %v, tftp %q\n",
+		reply,
+		r.IP,
+		*r.Options.Gateway,
+		*r.Options.LeaseTime,
+		*r.Options.Hostname,
+		*r.Options.Domainname,
+		r.DNS,
+		r.Classless,
+		*r.Options.Bootfile,
+		r.NextServer,
+		r.TFTPServer,
+	)
+	return nil
+}
+
+// daemonLeases returns the leases of the daemon serving the control socket at
+// path.
+func daemonLeases(path string) (*leases.Table, error) {
+	if path == "" {
+		return nil, errors.New("no control socket given with -control")
+	}
+	res, err := control.Call(path, "leases")
+	if err != nil {
+		return nil, err
+	}
+	var list []leases.Lease
+	if err := json.Unmarshal(res, &list); err != nil {
+		return nil, fmt.Errorf("invalid leases: %v", err)
+	}
+	t := leases.New()
+	t.Restore(list)
+	return t, nil
+}
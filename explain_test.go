@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/linode/dhcpd-unnumbered/leases"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExplain(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"-type", "offer", "lo"},
+		{"-mac", "nope", "lo"},
+		{"-requested", "2001:db8::1", "lo"},
+		{"lo", "eth0"},
+		{"-giaddr", "192.0.2.1", "-relay-src", "nope", "lo"},
+	} {
+		var out bytes.Buffer
+		assert.Error(t, explain(&out, args), args)
+	}
+
+	defer func(v string) { *flagControl = v }(*flagControl)
+	*flagControl = ""
+
+	var out bytes.Buffer
+	assert.NoError(t, explain(&out, []string{"-type", "request", "-requested", "192.0.2.10", "lo"}))
+	assert.Equal(t, " 1. REQUEST from 00:00:5e:00:53:01 on lo\n"+
+		" 2. Leases of the running daemon left out: no control socket given with -control\n"+
+		"Dropped (regex_mismatch): DHCP request on Interface lo is not accepted by regex tap.*_0, ignoring\n", out.String())
+
+	out.Reset()
+	assert.NoError(t, explain(&out, []string{"-giaddr", "192.0.2.1", "-circuit-id", "swp1", "lo"}))
+	assert.Equal(t, " 1. DISCOVER from 00:00:5e:00:53:01 on lo\n"+
+		" 2. Leases of the running daemon left out: no control socket given with -control\n"+
+		"Dropped (untrusted_relay): DHCP request relayed by 192.0.2.1 from 192.0.2.1, which is not a trusted relay agent, ignoring\n", out.String())
+
+	// Leases of the running daemon
+	*flagControl = filepath.Join(t.TempDir(), "control.sock")
+	table := leases.New()
+	table.Ack(leases.Lease{Key: leases.Key{Interface: "tap.1_0", ClientID: "00:00:5e:00:53:01"}, IP: net.IPv4(192, 0, 2, 10)}, time.Hour)
+	ctl := newControlServer(*flagControl, table)
+	go ctl.Listen()
+	defer ctl.Close()
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(*flagControl); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	out.Reset()
+	assert.NoError(t, explain(&out, []string{"lo"}))
+	assert.Contains(t, out.String(), " 2. Leases of the running daemon consulted: 1\n")
+}
+
+func TestExplainNetns(t *testing.T) {
+	defer func(v string) { *flagControl = v }(*flagControl)
+	defer func(v string) { *flagNetnsDir = v }(*flagNetnsDir)
+	defer func(v string) { *flagTapRegex = v }(*flagTapRegex)
+	defer func(v bool) { *flagHostnameOverride = v }(*flagHostnameOverride)
+	defer func(v string) { *flagHostnamePath = v }(*flagHostnamePath)
+	*flagControl = ""
+	*flagNetnsDir = t.TempDir()
+
+	var out bytes.Buffer
+	assert.ErrorContains(t, explain(&out, []string{"-netns", "../ns1", "lo"}), "invalid namespace name")
+	assert.ErrorContains(t, explain(&out, []string{"-netns", "ns1", "lo"}), "unable to open namespace")
+
+	// Our own namespace stands in for a named one
+	assert.Nil(t, os.Symlink("/proc/self/ns/net", filepath.Join(*flagNetnsDir, "ns1")))
+	prefix := t.TempDir() + "/"
+	*flagTapRegex, *flagHostnameOverride, *flagHostnamePath = "lo", true, prefix
+
+	// Override files of interfaces in namespaces are read from a directory
+	// of the namespace
+	assert.Nil(t, os.Mkdir(prefix+"ns1", 0755))
+	assert.Nil(t, os.WriteFile(prefix+"ns1/lo.options", []byte(`{"ipv4": ["192.0.2.50"]}`), 0644))
+	assert.Nil(t, os.WriteFile(prefix+"lo.options", []byte(`{"ipv4": ["192.0.2.60"]}`), 0644))
+
+	out.Reset()
+	err := explain(&out, []string{"-netns", "ns1", "lo"})
+	if err != nil {
+		t.Skipf("Unable to explain in a namespace: %v", err)
+	}
+	assert.Contains(t, out.String(), " 1. DISCOVER from 00:00:5e:00:53:01 on ns1/lo\n")
+	assert.Contains(t, out.String(), "unable to get static hostname: open "+prefix+"ns1/lo: no such file or directory\n")
+	assert.Contains(t, out.String(), "OFFER with 192.0.2.50/24,")
+}
@@ -0,0 +1,82 @@
+package filter
+
+// Classic BPF programs for the listening sockets, dropping packets that can't
+// be DHCP requests in the kernel, before they get copied to userspace.
+//
+// Filters attached to UDP sockets see the packet starting at the UDP header.
+
+import (
+	"errors"
+
+	"golang.org/x/net/bpf"
+)
+
+const (
+	udpHeaderLen = 8
+	// Offset of the op field from the start of the UDP header
+	opOffset = udpHeaderLen
+	// Offset of the magic cookie, following the fixed size BOOTP header
+	cookieOffset = udpHeaderLen + 236
+
+	opBootRequest = 1
+	magicCookie   = 0x63825363
+
+	// The kernel refuses programs longer than this (BPF_MAXINSNS)
+	maxInstructions = 4096
+
+	verdictAccept = 0xffffffff
+	verdictDrop   = 0
+)
+
+// ErrTooManyInterfaces is returned if the interfaces don't fit into a program.
+var ErrTooManyInterfaces = errors.New("too many interfaces for a BPF program")
+
+// Program returns a filter accepting BOOTREQUESTs carrying the DHCP magic
+// cookie.
+func Program() ([]bpf.RawInstruction, error) {
+	return bpf.Assemble(instructions(nil))
+}
+
+// ProgramForInterfaces returns a filter like Program, which additionally only
+// accepts packets received on one of the given interfaces. If ifindexes is
+// empty, everything is dropped.
+func ProgramForInterfaces(ifindexes []int) ([]bpf.RawInstruction, error) {
+	if ifindexes == nil {
+		ifindexes = []int{}
+	}
+	insts := instructions(ifindexes)
+	if len(insts) > maxInstructions {
+		return nil, ErrTooManyInterfaces
+	}
+	return bpf.Assemble(insts)
+}
+
+// instructions builds the program. The interfaces are only checked if
+// ifindexes is not nil.
+func instructions(ifindexes []int) []bpf.Instruction {
+	// Loads beyond the end of the packet drop it, so short packets don't need
+	// to be checked for explicitly.
+	insts := []bpf.Instruction{
+		bpf.LoadAbsolute{Off: opOffset, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: opBootRequest, SkipTrue: 1},
+		bpf.RetConstant{Val: verdictDrop},
+		bpf.LoadAbsolute{Off: cookieOffset, Size: 4},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: magicCookie, SkipTrue: 1},
+		bpf.RetConstant{Val: verdictDrop},
+	}
+
+	if ifindexes == nil {
+		return append(insts, bpf.RetConstant{Val: verdictAccept})
+	}
+
+	// Jumps can skip at most 255 instructions, so accept right after each
+	// match instead of jumping to a common verdict.
+	insts = append(insts, bpf.LoadExtension{Num: bpf.ExtInterfaceIndex})
+	for _, idx := range ifindexes {
+		insts = append(insts,
+			bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: uint32(idx), SkipTrue: 1},
+			bpf.RetConstant{Val: verdictAccept},
+		)
+	}
+	return append(insts, bpf.RetConstant{Val: verdictDrop})
+}
@@ -0,0 +1,81 @@
+package filter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/bpf"
+)
+
+// udpPacket prepends a (zeroed) UDP header, which is where filters on UDP
+// sockets start.
+func udpPacket(payload []byte) []byte {
+	return append(make([]byte, udpHeaderLen), payload...)
+}
+
+func discover(t *testing.T) []byte {
+	mac, _ := net.ParseMAC("52:54:00:12:34:56")
+	req, err := dhcpv4.NewDiscovery(mac)
+	assert.Nil(t, err)
+	return req.ToBytes()
+}
+
+// run runs insts against pkt, pretending it arrived on interface ifindex. The
+// VM doesn't implement the interface index extension, so it's replaced by a
+// constant.
+func run(t *testing.T, insts []bpf.Instruction, pkt []byte, ifindex int) bool {
+	replaced := make([]bpf.Instruction, len(insts))
+	for i, inst := range insts {
+		if ext, ok := inst.(bpf.LoadExtension); ok && ext.Num == bpf.ExtInterfaceIndex {
+			inst = bpf.LoadConstant{Dst: bpf.RegA, Val: uint32(ifindex)}
+		}
+		replaced[i] = inst
+	}
+
+	vm, err := bpf.NewVM(replaced)
+	assert.Nil(t, err)
+	n, err := vm.Run(pkt)
+	assert.Nil(t, err)
+	return n > 0
+}
+
+func TestProgram(t *testing.T) {
+	insts := instructions(nil)
+
+	req := discover(t)
+	assert.True(t, run(t, insts, udpPacket(req), 0), "Discover dropped")
+
+	reply := append([]byte{}, req...)
+	reply[0] = byte(dhcpv4.OpcodeBootReply)
+	assert.False(t, run(t, insts, udpPacket(reply), 0), "Reply accepted")
+
+	bootp := append([]byte{}, req...)
+	bootp[236] = 0
+	assert.False(t, run(t, insts, udpPacket(bootp), 0), "Missing magic cookie accepted")
+
+	assert.False(t, run(t, insts, udpPacket(req[:100]), 0), "Truncated packet accepted")
+
+	_, err := Program()
+	assert.Nil(t, err)
+}
+
+func TestProgramForInterfaces(t *testing.T) {
+	req := udpPacket(discover(t))
+
+	insts := instructions([]int{3, 7})
+	assert.True(t, run(t, insts, req, 3))
+	assert.True(t, run(t, insts, req, 7))
+	assert.False(t, run(t, insts, req, 5), "Unknown interface accepted")
+
+	// No interfaces, nothing to accept
+	insts = instructions([]int{})
+	assert.False(t, run(t, insts, req, 3))
+
+	_, err := ProgramForInterfaces(nil)
+	assert.Nil(t, err)
+
+	_, err = ProgramForInterfaces(make([]int, maxInstructions))
+	assert.Equal(t, ErrTooManyInterfaces, err)
+}
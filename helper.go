@@ -5,11 +5,14 @@ import (
 	"net"
 	"os"
 	"path"
+	"runtime"
 	"strings"
 
+	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/linode/dhcpd-unnumbered/options"
 	ll "github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
 	"golang.org/x/sys/unix"
 )
 
@@ -46,14 +49,19 @@ func getSourceIP() (net.IP, error) {
 	return nil, nil
 }
 
-// getDynamicHostname will generate hostname from IP and predefined domainname
-func getDynamicHostname(ip net.IP) string {
-	return strings.ReplaceAll(ip.String(), ".", "-")
+// overrideName returns the name the override files of ifName in the namespace
+// nsName are read by. Interfaces in other namespaces get <nsName>/<ifName>,
+// so taps of the same name in different namespaces don't share them.
+func overrideName(nsName, ifName string) string {
+	if nsName == "" {
+		return ifName
+	}
+	return nsName + "/" + ifName
 }
 
 // getHostnameOverride returns a hoostname (and if applicable) a domainname read from a static file based on path+ifName
-func getHostnameOverride(ifName string) (string, string, error) {
-	h, err := os.ReadFile(*flagHostnamePath + ifName)
+func getHostnameOverride(path, ifName string) (string, string, error) {
+	h, err := os.ReadFile(path + ifName)
 	if err != nil {
 		return "", "", err
 	}
@@ -66,28 +74,11 @@ func getHostnameOverride(ifName string) (string, string, error) {
 
 // getHostnameOverride returns override options read from a static file based on
 // path+ifName.options
-func getOptionsOverride(log *ll.Entry, ifName string) (*options.DHCP, error) {
-	fullpath := path.Join(*flagHostnamePath, ifName+".options")
+func getOptionsOverride(log *ll.Entry, prefix, ifName string) (*options.DHCP, error) {
+	fullpath := path.Join(prefix, ifName+".options")
 	return options.Load(log, fullpath)
 }
 
-// mixDNS sorts dns servers in a sudo-random way (the provided IP should always get back the same sequence of DNS)
-func mixDNS(ip net.IP) []net.IP {
-	l := len(myDNS)
-	// just mod over last octet of IP as it provides the highest diversity without causing much complexity
-	m := int(ip[len(ip)-1]) % l
-	var mix []net.IP
-
-	for i := 0; i < l; i++ {
-		if i+m >= l {
-			m = m - l
-		}
-		mix = append(mix, myDNS[i+m])
-	}
-
-	return mix
-}
-
 type listIP []net.IP
 
 func (ip *listIP) String() string {
@@ -115,15 +106,59 @@ func getLogLevels() []string {
 	return levels
 }
 
-// Returns the table id of VRF `ifName`, or an error if ifName is not a VRF.
-func getVRFTableIdx(ifName string) (int, error) {
-	nlh, err := netlink.NewHandle()
-	defer nlh.Delete()
+// inNetns runs fn with its thread switched to namespace ns and waits for it.
+// Sockets created by fn stay in ns. If ns isn't open, fn runs in the current
+// namespace.
+func inNetns(ns netns.NsHandle, fn func() error) error {
+	if !ns.IsOpen() {
+		return fn()
+	}
+
+	// The namespace is a property of the thread, so fn runs on a goroutine
+	// locked to a thread of its own. Unless the thread made it back to the
+	// original namespace it stays locked, and the runtime terminates it as
+	// the goroutine exits instead of reusing it.
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		orig, err := netns.Get()
+		if err != nil {
+			runtime.UnlockOSThread()
+			errc <- fmt.Errorf("unable to get current namespace: %v", err)
+			return
+		}
+		defer orig.Close()
+
+		if err := netns.Set(ns); err != nil {
+			runtime.UnlockOSThread()
+			errc <- fmt.Errorf("unable to enter namespace: %v", err)
+			return
+		}
+
+		fnErr := fn()
+
+		if err := netns.Set(orig); err != nil {
+			ll.Errorf("Unable to return to original namespace: %v", err)
+			errc <- fnErr
+			return
+		}
+		runtime.UnlockOSThread()
+		errc <- fnErr
+	}()
+	return <-errc
+}
+
+// Returns the table id of VRF `ifName` in namespace ns, or an error if ifName
+// is not a VRF.
+func getVRFTableIdx(ns netns.NsHandle, ifName string) (int, error) {
+	nlh, err := netlink.NewHandleAt(ns)
 	if err != nil {
 		return 0, fmt.Errorf("unable to hook into netlink: %v", err)
 	}
+	defer nlh.Delete()
 
-	link, err := netlink.LinkByName(ifName)
+	link, err := nlh.LinkByName(ifName)
 	if err != nil {
 		return 0, fmt.Errorf("unable to get link info: %v", err)
 	}
@@ -137,19 +172,59 @@ func getVRFTableIdx(ifName string) (int, error) {
 	return int(vrf.Table), nil
 }
 
-// Returns routes for the given interface in the given table.
-func getTableRoutes(ifidx int, table int) ([]*net.IPNet, error) {
-	nlh, err := netlink.NewHandle()
+// Returns the name and table id of the VRF `ifName` is enslaved to in namespace
+// ns. If it isn't enslaved to a VRF, the name is empty and the table is main.
+func getMasterVRF(ns netns.NsHandle, ifName string) (string, int, error) {
+	nlh, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return "", 0, fmt.Errorf("unable to hook into netlink: %v", err)
+	}
 	defer nlh.Delete()
+
+	link, err := nlh.LinkByName(ifName)
+	if err != nil {
+		return "", 0, fmt.Errorf("unable to get link info: %v", err)
+	}
+
+	if link.Attrs().MasterIndex == 0 {
+		return "", unix.RT_TABLE_MAIN, nil
+	}
+
+	master, err := nlh.LinkByIndex(link.Attrs().MasterIndex)
+	if err != nil {
+		return "", 0, fmt.Errorf("unable to get master link info: %v", err)
+	}
+
+	// Enslaved to something else, i.e. a bridge
+	vrf, ok := master.(*netlink.Vrf)
+	if !ok {
+		return "", unix.RT_TABLE_MAIN, nil
+	}
+
+	return vrf.Name, int(vrf.Table), nil
+}
+
+// Returns IPv4 host routes for the given interface in the given table of
+// namespace ns.
+func getTableRoutes(ns netns.NsHandle, ifidx int, table int) ([]*net.IPNet, error) {
+	return getHostRoutes(ns, unix.AF_INET, ifidx, table)
+}
+
+// Returns host routes of address family family (unix.AF_INET for /32s or
+// unix.AF_INET6 for /128s) for the given interface in the given table of
+// namespace ns.
+func getHostRoutes(ns netns.NsHandle, family int, ifidx int, table int) ([]*net.IPNet, error) {
+	nlh, err := netlink.NewHandleAt(ns)
 	if err != nil {
 		return nil, fmt.Errorf("unable to hook into netlink: %v", err)
 	}
+	defer nlh.Delete()
 
 	routeFilter := &netlink.Route{
 		Table: table,
 	}
 
-	ro, err := nlh.RouteListFiltered(unix.AF_INET, routeFilter, netlink.RT_FILTER_TABLE)
+	ro, err := nlh.RouteListFiltered(family, routeFilter, netlink.RT_FILTER_TABLE)
 	if err != nil {
 		return nil, fmt.Errorf("unable to get routes: %v", err)
 	}
@@ -160,19 +235,30 @@ func getTableRoutes(ifidx int, table int) ([]*net.IPNet, error) {
 			continue
 		}
 
-		m, l := d.Dst.Mask.Size()
-		if m == 32 && l == 32 {
+		if isHostRoute(d.Dst) {
 			r = append(r, d.Dst)
 		}
 	}
 	return r, nil
 }
 
-// Determine the gateway based on IP and Netmask.
-func gatewayFromIP(ipnet *net.IPNet) *net.IP {
-	// Apply netmask to IP, then increment last octet by one
-	gw := ipnet.IP.Mask(ipnet.Mask)
-	gw[len(gw)-1] += 1
+// isHostRoute returns true if dst is a single address, a /32 or a /128.
+func isHostRoute(dst *net.IPNet) bool {
+	m, l := dst.Mask.Size()
+	return m == l && (l == 32 || l == 128)
+}
 
-	return &gw
+// classlessRoutes returns the RFC 3442 routes making gw reachable on-link and
+// the default route via gw, for clients handed out a /32.
+func classlessRoutes(gw net.IP) dhcpv4.Routes {
+	return dhcpv4.Routes{
+		{
+			Dest:   &net.IPNet{IP: gw.To4(), Mask: net.CIDRMask(32, 32)},
+			Router: net.IPv4zero,
+		},
+		{
+			Dest:   &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+			Router: gw,
+		},
+	}
 }
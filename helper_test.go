@@ -4,83 +4,14 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
 )
 
-func IPsEqual(a, b []net.IP) bool {
-	if len(a) != len(b) {
-		return false
-	}
-	for i, v := range a {
-		if !v.Equal(b[i]) {
-			return false
-		}
-	}
-	return true
-}
-
-func TestMixDNS(t *testing.T) {
-	myDNS.Set("1.1.1.1")
-	myDNS.Set("2.2.2.2")
-	myDNS.Set("3.3.3.3")
-	myDNS.Set("4.4.4.4")
-
-	tests := []struct {
-		input net.IP
-		want  []net.IP
-	}{
-		{
-			net.IPv4(1, 1, 1, 0),
-			[]net.IP{net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 2), net.IPv4(3, 3, 3, 3), net.IPv4(4, 4, 4, 4)},
-		},
-		{
-			net.IPv4(1, 1, 1, 1),
-			[]net.IP{net.IPv4(2, 2, 2, 2), net.IPv4(3, 3, 3, 3), net.IPv4(4, 4, 4, 4), net.IPv4(1, 1, 1, 1)},
-		},
-		{
-			net.IPv4(3, 3, 3, 2),
-			[]net.IP{net.IPv4(3, 3, 3, 3), net.IPv4(4, 4, 4, 4), net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 2)},
-		},
-		{
-			net.IPv4(3, 3, 3, 3),
-			[]net.IP{net.IPv4(4, 4, 4, 4), net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 2), net.IPv4(3, 3, 3, 3)},
-		},
-	}
-
-	for _, tc := range tests {
-		t.Run(fmt.Sprintf("Test: %s", tc.input), func(t *testing.T) {
-			out := mixDNS(tc.input)
-			if !IPsEqual(out, tc.want) {
-				t.Errorf("Failed ! got %s want %s", out, tc.want)
-			} else {
-				t.Logf("Success !")
-			}
-		})
-	}
-}
-
-func TestGetDynamicHostname(t *testing.T) {
-	tests := []struct {
-		input net.IP
-		want  string
-	}{
-		{net.IPv4(1, 1, 1, 1), "1-1-1-1"},
-		{net.IPv4(2, 2, 2, 2), "2-2-2-2"},
-	}
-
-	for _, tc := range tests {
-		t.Run(fmt.Sprintf("Test: %s", tc.input), func(t *testing.T) {
-			if h := getDynamicHostname(tc.input); h != tc.want {
-				t.Errorf("Failed ! got %s want %s", h, tc.want)
-			} else {
-				t.Logf("Success !")
-			}
-		})
-	}
-}
-
 func overrideFile(t *testing.T, ifName, hostname string) {
 	*flagHostnamePath = "/tmp/"
 
@@ -107,7 +38,7 @@ func TestGetHostnameOverride(t *testing.T) {
 
 			overrideFile(t, tc.ifName, tc.wantHost+"."+tc.wantDomain)
 
-			h, d, e := getHostnameOverride(tc.ifName)
+			h, d, e := getHostnameOverride(*flagHostnamePath, tc.ifName)
 
 			if h != tc.wantHost {
 				t.Errorf("Failed ! got %s want %s", h, tc.wantHost)
@@ -122,25 +53,111 @@ func TestGetHostnameOverride(t *testing.T) {
 	}
 }
 
-func TestGatewayFromIP(t *testing.T) {
-	tests := []struct {
-		input  string
-		output string
-	}{
-		{"192.168.11.11/23", "192.168.10.1"},
-		{"192.168.14.15/24", "192.168.14.1"},
-		{"192.168.11.40/27", "192.168.11.33"},
+func TestClasslessRoutes(t *testing.T) {
+	routes := classlessRoutes(net.IPv4(169, 254, 0, 1))
+
+	assert.Equal(t, 2, len(routes))
+	assert.Equal(t, "169.254.0.1/32", routes[0].Dest.String(), "Bad gateway host route")
+	assert.True(t, routes[0].Router.Equal(net.IPv4zero), "Gateway host route not on-link")
+	assert.Equal(t, "0.0.0.0/0", routes[1].Dest.String(), "Bad default route")
+	assert.True(t, routes[1].Router.Equal(net.IPv4(169, 254, 0, 1)), "Default route not via gateway")
+
+	// mask length, significant octets of the destination, router
+	want := []byte{32, 169, 254, 0, 1, 0, 0, 0, 0, 0, 169, 254, 0, 1}
+	assert.Equal(t, want, routes.ToBytes())
+}
+
+func TestIsHostRoute(t *testing.T) {
+	for dst, want := range map[string]bool{
+		"203.0.113.7/32":  true,
+		"203.0.113.0/24":  false,
+		"2001:db8::7/128": true,
+		"2001:db8::/64":   false,
+		"0.0.0.0/0":       false,
+	} {
+		_, ipn, err := net.ParseCIDR(dst)
+		assert.Nil(t, err)
+		assert.Equal(t, want, isHostRoute(ipn), dst)
+	}
+}
+
+func TestInNetns(t *testing.T) {
+	// Without a namespace, fn runs right away
+	called := false
+	err := inNetns(netns.None(), func() error {
+		called = true
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.True(t, called)
+
+	fnErr := fmt.Errorf("failed")
+	assert.Equal(t, fnErr, inNetns(netns.None(), func() error { return fnErr }))
+
+	// Switching into our own namespace needs CAP_SYS_ADMIN
+	ns, err := netns.Get()
+	if err != nil {
+		t.Skipf("Unable to get current namespace: %v", err)
 	}
+	defer ns.Close()
 
-	for _, test := range tests {
-		ip, ipnet, err := net.ParseCIDR(test.input)
-		assert.Nil(t, err, "Failed to parse test data!")
-		chosenIP := net.IPNet{
-			IP:   ip,
-			Mask: ipnet.Mask,
+	err = inNetns(ns, func() error {
+		cur, err := netns.Get()
+		if err != nil {
+			return err
 		}
-		gw := gatewayFromIP(&chosenIP)
+		defer cur.Close()
+		assert.True(t, cur.Equal(ns))
+		return nil
+	})
+	if err != nil {
+		t.Skipf("Unable to switch namespace: %v", err)
+	}
+}
 
-		assert.Equal(t, test.output, gw.String(), "Unexpected gateway")
+func TestGetMasterVRF(t *testing.T) {
+	// Loopback is never enslaved
+	vrf, table, err := getMasterVRF(netns.None(), "lo")
+	if err != nil {
+		t.Skipf("Unable to look up lo: %v", err)
+	}
+	assert.Equal(t, "", vrf)
+	assert.Equal(t, unix.RT_TABLE_MAIN, table)
+
+	_, _, err = getMasterVRF(netns.None(), "does-not-exist0")
+	assert.NotNil(t, err)
+}
+
+// Taps of the same name in different namespaces read their own override files
+func TestOverrideNetns(t *testing.T) {
+	prefix := t.TempDir() + "/"
+	for _, f := range []struct{ name, content string }{
+		{"tap0_0", "host"},
+		{"tenantA/tap0_0", "a.example.com"},
+		{"tenantA/tap0_0.options", `{"IPv4": ["192.0.2.10"]}`},
+		{"tenantB/tap0_0", "b.example.com"},
+	} {
+		assert.Nil(t, os.MkdirAll(filepath.Dir(prefix+f.name), 0755))
+		assert.Nil(t, os.WriteFile(prefix+f.name, []byte(f.content), 0644))
+	}
+
+	for _, tc := range []struct {
+		nsName   string
+		hostname string
+		ipv4     int
+	}{
+		{"", "host", 0},
+		{"tenantA", "a", 1},
+		{"tenantB", "b", 0},
+	} {
+		l := newListenerOn(nil, nil, netns.None(), tc.nsName, "tap0_0", "", unix.RT_TABLE_MAIN)
+		lk := listenerLookup{l, prefix}
+
+		h, _, err := lk.Hostname("tap0_0")
+		assert.Nil(t, err)
+		assert.Equal(t, tc.hostname, h, "netns %q", tc.nsName)
+		opts, err := lk.Options("tap0_0")
+		assert.Nil(t, err)
+		assert.Len(t, opts.IPv4, tc.ipv4, "netns %q", tc.nsName)
 	}
 }
@@ -0,0 +1,376 @@
+package leases
+
+// Persist leases in an append-only journal of JSON records, one per line. The
+// journal is compacted to the current leases periodically, keeping the
+// previous one around as <path>.1.
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	ll "github.com/sirupsen/logrus"
+)
+
+// Journal operations
+const (
+	opAck     = "ack"
+	opRelease = "release"
+	opExpire  = "expire"
+)
+
+// The journal is compacted once it has this many records more than leases
+const compactSlack = 10000
+
+// Longest record accepted when reading the journal
+const maxRecord = 1 << 16
+
+type leaseJSON struct {
+	Interface string    `json:"interface"`
+	ClientID  string    `json:"client-id"`
+	HWAddr    string    `json:"hwaddr"`
+	IP        string    `json:"ip"`
+	Hostname  string    `json:"hostname,omitempty"`
+	XID       string    `json:"xid"`
+	ServerID  string    `json:"server-id,omitempty"`
+	Updated   time.Time `json:"updated"`
+	Expiry    time.Time `json:"expiry"`
+}
+
+type record struct {
+	Op    string    `json:"op"`
+	Time  time.Time `json:"time"`
+	Lease leaseJSON `json:"lease"`
+}
+
+func toJSON(l Lease) leaseJSON {
+	j := leaseJSON{
+		Interface: l.Interface,
+		ClientID:  l.ClientID,
+		HWAddr:    l.HWAddr.String(),
+		IP:        l.IP.String(),
+		Hostname:  l.Hostname,
+		XID:       l.XID.String(),
+		Updated:   l.Updated,
+		Expiry:    l.Expiry,
+	}
+	if l.ServerID != nil {
+		j.ServerID = l.ServerID.String()
+	}
+	return j
+}
+
+func fromJSON(j leaseJSON) (Lease, error) {
+	l := Lease{
+		Key:      Key{Interface: j.Interface, ClientID: j.ClientID},
+		State:    Acked,
+		Hostname: j.Hostname,
+		Updated:  j.Updated,
+		Expiry:   j.Expiry,
+	}
+	if j.Interface == "" || j.ClientID == "" {
+		return l, fmt.Errorf("lease without interface or client")
+	}
+
+	l.IP = net.ParseIP(j.IP)
+	if l.IP == nil {
+		return l, fmt.Errorf("invalid IP %q", j.IP)
+	}
+
+	// Not recorded by earlier versions
+	if j.ServerID != "" {
+		l.ServerID = net.ParseIP(j.ServerID)
+		if l.ServerID == nil {
+			return l, fmt.Errorf("invalid server identifier %q", j.ServerID)
+		}
+	}
+
+	if j.HWAddr != "" {
+		hw, err := net.ParseMAC(j.HWAddr)
+		if err != nil {
+			return l, fmt.Errorf("invalid hardware address: %v", err)
+		}
+		l.HWAddr = hw
+	}
+
+	// Only informational, so don't insist on it
+	if xid, err := hex.DecodeString(strings.TrimPrefix(j.XID, "0x")); err == nil {
+		copy(l.XID[:], xid)
+	}
+
+	return l, nil
+}
+
+// Journal records lease changes in a file. Records are queued and written in
+// batches in the background, so recording doesn't wait for the disk.
+type Journal struct {
+	log  *ll.Entry
+	path string
+
+	// Held while writing to f, and while replacing it
+	wmu sync.Mutex
+	f   *os.File
+	// Records dropped for a compaction in progress
+	cut        []byte
+	cutRecords int
+
+	mu      sync.Mutex
+	pending []byte
+	records int
+
+	wake    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// OpenJournal replays the journal at path, creating it if it doesn't exist,
+// and returns the leases recorded in it. Records that can't be read, i.e.
+// because the daemon died while writing them, are skipped. The journal is
+// compacted right away, so it can be appended to.
+func OpenJournal(path string) (*Journal, []Lease, error) {
+	j := &Journal{
+		log:     ll.NewEntry(ll.StandardLogger()).WithFields(ll.Fields{"component": "leases", "journal": path}),
+		path:    path,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	leases, err := j.replay()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := j.compact(leases); err != nil {
+		return nil, nil, err
+	}
+
+	go j.run()
+	return j, leases, nil
+}
+
+// run writes the queued records whenever there are some. Blocks until Close is
+// called, writing what's left.
+func (j *Journal) run() {
+	defer close(j.stopped)
+	for {
+		select {
+		case <-j.wake:
+			j.flush()
+		case <-j.done:
+			j.flush()
+			return
+		}
+	}
+}
+
+// flush writes the queued records.
+func (j *Journal) flush() {
+	j.wmu.Lock()
+	defer j.wmu.Unlock()
+
+	j.mu.Lock()
+	batch := j.pending
+	j.pending = nil
+	j.mu.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+	// Records are written whole, so a crash leaves at most one partial record
+	// behind
+	if _, err := j.f.Write(batch); err != nil {
+		j.log.Errorf("Unable to record %d bytes of lease changes: %v", len(batch), err)
+	}
+}
+
+// replay reads the journal and returns the resulting leases.
+func (j *Journal) replay() ([]Lease, error) {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open lease journal: %v", err)
+	}
+	defer f.Close()
+
+	current := make(map[Key]Lease)
+	// Client holding an address, so an ack moving it is found right away
+	holders := make(map[addrKey]Key)
+	drop := func(k Key) {
+		if l, ok := current[k]; ok {
+			delete(holders, addrOf(&l))
+			delete(current, k)
+		}
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 4096), maxRecord)
+	line, skipped := 0, 0
+	for scanner.Scan() {
+		line++
+		var r record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			j.log.Warnf("Skipping unreadable record on line %d: %v", line, err)
+			skipped++
+			continue
+		}
+		l, err := fromJSON(r.Lease)
+		if err != nil {
+			j.log.Warnf("Skipping invalid lease on line %d: %v", line, err)
+			skipped++
+			continue
+		}
+
+		switch r.Op {
+		case opAck:
+			drop(l.Key)
+			if k, ok := holders[addrOf(&l)]; ok {
+				drop(k)
+			}
+			current[l.Key] = l
+			holders[addrOf(&l)] = l.Key
+		case opRelease, opExpire:
+			drop(l.Key)
+		default:
+			j.log.Warnf("Skipping unknown operation %q on line %d", r.Op, line)
+			skipped++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		// Most likely an overlong line, keep what we have
+		j.log.Warnf("Stopped reading after line %d: %v", line, err)
+	}
+
+	leases := make([]Lease, 0, len(current))
+	for _, l := range current {
+		leases = append(leases, l)
+	}
+	j.log.Infof("Read %d leases from %d records, skipped %d", len(leases), line, skipped)
+	return leases, nil
+}
+
+// compact replaces the journal with one holding an ack per lease, and
+// reopens it for appending. The previous journal is kept as <path>.1. Must be
+// called with wmu held.
+func (j *Journal) compact(leases []Lease) error {
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to create lease journal: %v", err)
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	now := time.Now()
+	for _, l := range leases {
+		if err := enc.Encode(record{Op: opAck, Time: now, Lease: toJSON(l)}); err != nil {
+			f.Close()
+			return fmt.Errorf("unable to write lease journal: %v", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write lease journal: %v", err)
+	}
+	// Make sure the new journal is complete before it replaces the old one
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to sync lease journal: %v", err)
+	}
+
+	if _, err := os.Stat(j.path); err == nil {
+		if err := os.Rename(j.path, j.path+".1"); err != nil {
+			f.Close()
+			return fmt.Errorf("unable to keep previous lease journal: %v", err)
+		}
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to replace lease journal: %v", err)
+	}
+
+	if j.f != nil {
+		j.f.Close()
+	}
+	j.f = f
+	j.mu.Lock()
+	j.records += len(leases)
+	j.mu.Unlock()
+	return nil
+}
+
+// needsCompaction returns true if the journal grew well beyond the number of
+// leases it holds.
+func (j *Journal) needsCompaction(leases int) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.records > leases+compactSlack
+}
+
+// beginCompact holds writing records back until endCompact and drops the
+// queued ones, which the leases passed to endCompact must include. Records
+// queued in between are written to the compacted journal.
+func (j *Journal) beginCompact() {
+	j.wmu.Lock()
+
+	j.mu.Lock()
+	j.cut, j.cutRecords = j.pending, j.records
+	j.pending, j.records = nil, 0
+	j.mu.Unlock()
+}
+
+// endCompact replaces the journal with one holding just the given leases and
+// resumes writing records. If that fails, the dropped records are queued
+// again.
+func (j *Journal) endCompact(leases []Lease) error {
+	defer j.wmu.Unlock()
+
+	cut, cutRecords := j.cut, j.cutRecords
+	j.cut, j.cutRecords = nil, 0
+	if err := j.compact(leases); err != nil {
+		j.mu.Lock()
+		j.pending = append(cut, j.pending...)
+		j.records += cutRecords
+		j.mu.Unlock()
+		return err
+	}
+	j.log.Infof("Compacted journal to %d leases", len(leases))
+	return nil
+}
+
+// record queues a record of op on l for writing. Failures are logged, as the
+// lease is handed out anyway.
+func (j *Journal) record(op string, l Lease, now time.Time) {
+	b, err := json.Marshal(record{Op: op, Time: now, Lease: toJSON(l)})
+	if err != nil {
+		j.log.Errorf("Unable to encode %s of %s: %v", op, l.IP, err)
+		return
+	}
+
+	j.mu.Lock()
+	j.pending = append(append(j.pending, b...), '\n')
+	j.records++
+	j.mu.Unlock()
+
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Close writes the queued records and closes the journal file.
+func (j *Journal) Close() error {
+	close(j.done)
+	<-j.stopped
+
+	j.wmu.Lock()
+	defer j.wmu.Unlock()
+	return j.f.Close()
+}
@@ -0,0 +1,181 @@
+package leases
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestJournal(t *testing.T, path string) (*Table, *clock, *Journal) {
+	tbl, c := newTestTable()
+	j, leases, err := OpenJournal(path)
+	assert.Nil(t, err)
+	tbl.Restore(leases)
+	tbl.SetJournal(j)
+	return tbl, c, j
+}
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases")
+	tbl, c, j := openTestJournal(t, path)
+
+	a := lease("tap1_0", "192.0.2.10")
+	a.Hostname = "guest1"
+	a.XID = dhcpv4.TransactionID{1, 2, 3, 4}
+	a.ServerID = net.IPv4(192, 0, 2, 1)
+	b := lease("tap2_0", "192.0.2.20")
+	released := lease("tap3_0", "192.0.2.30")
+	expired := lease("tap4_0", "192.0.2.40")
+
+	tbl.Ack(a, time.Hour)
+	tbl.Ack(b, time.Hour)
+	tbl.Ack(released, time.Hour)
+	tbl.Release(released.Key)
+	tbl.Ack(expired, time.Second)
+	// Offers aren't recorded, but the release of a lease they replace is
+	tbl.Offer(lease("tap5_0", "192.0.2.50"))
+	moved := lease("tap6_0", "192.0.2.60")
+	tbl.Ack(moved, time.Hour)
+	moved.IP = net.IPv4(192, 0, 2, 61)
+	tbl.Offer(moved)
+	c.advance(time.Second)
+	assert.Equal(t, 1, len(tbl.Expire()))
+	assert.Nil(t, j.Close())
+
+	// Restart
+	tbl, c, j = openTestJournal(t, path)
+	defer j.Close()
+	leases := tbl.List()
+	assert.Equal(t, 2, len(leases))
+	for _, l := range leases {
+		if l.Key == a.Key {
+			assert.True(t, l.IP.Equal(a.IP))
+			assert.Equal(t, a.HWAddr, l.HWAddr)
+			assert.Equal(t, "guest1", l.Hostname)
+			assert.Equal(t, a.XID, l.XID)
+			assert.True(t, l.ServerID.Equal(a.ServerID))
+			assert.Equal(t, Acked, l.State)
+		} else {
+			assert.Equal(t, b.Key, l.Key)
+		}
+	}
+
+	// The previous journal is kept around
+	_, err := os.Stat(path + ".1")
+	assert.Nil(t, err)
+
+	// Leases that expired while we were down aren't restored
+	_, leases, err = OpenJournal(path)
+	assert.Nil(t, err)
+	tbl, _ = newTestTable()
+	c.advance(2 * time.Hour)
+	tbl.now = c.now
+	tbl.Restore(leases)
+	assert.Empty(t, tbl.List())
+}
+
+func TestJournalMovedAddress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases")
+	tbl, _, j := openTestJournal(t, path)
+
+	a := lease("tap1_0", "192.0.2.10")
+	b := lease("tap1_0", "192.0.2.10")
+	b.ClientID = "01525400123456"
+	tbl.Ack(a, time.Hour)
+	// Takes the address over from a, which then gets another one
+	tbl.Ack(b, time.Hour)
+	a.IP = net.IPv4(192, 0, 2, 11)
+	tbl.Ack(a, time.Hour)
+	assert.Nil(t, j.Close())
+
+	_, leases, err := OpenJournal(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(leases))
+	for _, l := range leases {
+		if l.Key == a.Key {
+			assert.True(t, l.IP.Equal(a.IP))
+		} else {
+			assert.True(t, l.IP.Equal(b.IP))
+		}
+	}
+}
+
+func TestJournalCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases")
+	tbl, _, j := openTestJournal(t, path)
+	tbl.now = time.Now
+	tbl.Ack(lease("tap1_0", "192.0.2.10"), time.Hour)
+	tbl.Ack(lease("tap2_0", "192.0.2.20"), time.Hour)
+	assert.Nil(t, j.Close())
+
+	// Garbage in between and a partial record at the end, as left behind by
+	// a crash
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	assert.Nil(t, err)
+	_, err = f.WriteString("not json\n{\"op\":\"ack\",\"lease\":{\"ip\":\"bad\"}}\n{\"op\":\"release\",\"lea")
+	assert.Nil(t, err)
+	f.Close()
+
+	_, leases, err := OpenJournal(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(leases))
+
+	// Compacted on open, so records can be appended cleanly
+	tbl, _, j = openTestJournal(t, path)
+	tbl.now = time.Now
+	tbl.Ack(lease("tap3_0", "192.0.2.30"), time.Hour)
+	assert.Nil(t, j.Close())
+
+	_, leases, err = OpenJournal(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(leases))
+}
+
+func TestJournalCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases")
+	tbl, _, j := openTestJournal(t, path)
+
+	l := lease("tap1_0", "192.0.2.10")
+	for i := 0; i <= compactSlack+1; i++ {
+		tbl.Ack(l, time.Hour)
+	}
+	assert.True(t, j.needsCompaction(1))
+
+	tbl.compact()
+	assert.False(t, j.needsCompaction(1))
+
+	b, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(splitLines(b)))
+
+	// Changes while the compacted journal is written end up in it
+	for i := 0; i <= compactSlack+1; i++ {
+		tbl.Ack(l, time.Hour)
+	}
+	acked := tbl.List()
+	j.beginCompact()
+	tbl.Ack(lease("tap2_0", "192.0.2.20"), time.Hour)
+	assert.Nil(t, j.endCompact(acked))
+	assert.Nil(t, j.Close())
+
+	_, leases, err := OpenJournal(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(leases))
+}
+
+func splitLines(b []byte) [][]byte {
+	var lines [][]byte
+	start := 0
+	for i, c := range b {
+		if c == '\n' {
+			lines = append(lines, b[start:i])
+			start = i + 1
+		}
+	}
+	return lines
+}
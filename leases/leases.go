@@ -0,0 +1,369 @@
+package leases
+
+// Track the leases handed out, per interface and client. Addresses are bound
+// to the tap by routing, so this is not needed to allocate addresses, but it
+// allows keeping offers stable, answering requests consistently and knowing
+// which client held which address when.
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	ll "github.com/sirupsen/logrus"
+)
+
+// How often expired leases are removed
+const expireInterval = 10 * time.Second
+
+// OfferHold is how long an offered address is held for the client, waiting for
+// its request.
+const OfferHold = time.Minute
+
+// State of a lease
+type State int
+
+const (
+	// Offered leases were offered to the client, which didn't request them
+	// (yet).
+	Offered State = iota
+	// Acked leases were acknowledged and are in use by the client.
+	Acked
+)
+
+func (s State) String() string {
+	switch s {
+	case Offered:
+		return "offered"
+	case Acked:
+		return "acked"
+	}
+	return "unknown"
+}
+
+// Key identifies the client a lease belongs to.
+type Key struct {
+	Interface string
+	// Client identifier (option 61) in hex if sent, otherwise the hardware
+	// address.
+	ClientID string
+}
+
+// KeyFor returns the key of the client sending req on interface ifName.
+func KeyFor(ifName string, req *dhcpv4.DHCPv4) Key {
+	clientID := req.ClientHWAddr.String()
+	if id := req.Options.Get(dhcpv4.OptionClientIdentifier); len(id) > 0 {
+		clientID = hex.EncodeToString(id)
+	}
+	return Key{Interface: ifName, ClientID: clientID}
+}
+
+// addrKey identifies an address on an interface.
+type addrKey struct {
+	Interface string
+	IP        string
+}
+
+func addrOf(l *Lease) addrKey {
+	return addrKey{Interface: l.Interface, IP: string(l.IP.To16())}
+}
+
+// Lease is an address offered to or acknowledged for a client.
+type Lease struct {
+	Key
+	HWAddr   net.HardwareAddr
+	IP       net.IP
+	State    State
+	Hostname string
+	XID      dhcpv4.TransactionID
+	// Server identifier the lease was handed out with
+	ServerID net.IP
+	// When the lease was last offered or acked
+	Updated time.Time
+	Expiry  time.Time
+}
+
+// MarshalJSON encodes the lease as it's journaled, plus its state.
+func (l Lease) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		leaseJSON
+		State string `json:"state"`
+	}{toJSON(l), l.State.String()})
+}
+
+// UnmarshalJSON decodes a lease encoded by MarshalJSON, i.e. as listed by the
+// control socket.
+func (l *Lease) UnmarshalJSON(b []byte) error {
+	var j struct {
+		leaseJSON
+		State string `json:"state"`
+	}
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	lease, err := fromJSON(j.leaseJSON)
+	if err != nil {
+		return err
+	}
+	if j.State == Offered.String() {
+		lease.State = Offered
+	}
+	*l = lease
+	return nil
+}
+
+// Table holds the current leases.
+type Table struct {
+	log  *ll.Entry
+	done chan struct{}
+
+	mu     sync.RWMutex
+	leases map[Key]*Lease
+	// Clients with a lease of each address, so finding the holder of an
+	// address doesn't take a scan of all leases
+	byAddr map[addrKey]map[Key]bool
+
+	// Leases are recorded here if set
+	journal *Journal
+
+	// Allows tests to control time
+	now func() time.Time
+}
+
+// New creates an empty lease table. Call Run to remove expired leases.
+func New() *Table {
+	return &Table{
+		log:    ll.NewEntry(ll.StandardLogger()).WithFields(ll.Fields{"component": "leases"}),
+		done:   make(chan struct{}),
+		leases: make(map[Key]*Lease),
+		byAddr: make(map[addrKey]map[Key]bool),
+		now:    time.Now,
+	}
+}
+
+// Close stops removing expired leases.
+func (t *Table) Close() {
+	close(t.done)
+}
+
+// Run removes expired leases periodically. Blocks until Close is called.
+func (t *Table) Run() {
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+			for _, l := range t.Expire() {
+				t.log.Infof("Lease of %s for %s on %s expired", l.IP, l.ClientID, l.Interface)
+			}
+			t.compact()
+		}
+	}
+}
+
+// SetJournal sets the journal to record acknowledged leases in, as they're
+// acked, released or expire. Offers aren't recorded.
+func (t *Table) SetJournal(j *Journal) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.journal = j
+}
+
+// Restore adds the acknowledged leases read from a journal, unless they
+// expired meanwhile.
+func (t *Table) Restore(leases []Lease) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	for _, l := range leases {
+		if !now.Before(l.Expiry) {
+			continue
+		}
+		l.State = Acked
+		t.put(&l)
+	}
+}
+
+// put adds or replaces the lease of client l.Key. Must be called with the
+// lock held.
+func (t *Table) put(l *Lease) {
+	t.remove(l.Key)
+	t.leases[l.Key] = l
+	a := addrOf(l)
+	if t.byAddr[a] == nil {
+		t.byAddr[a] = make(map[Key]bool)
+	}
+	t.byAddr[a][l.Key] = true
+}
+
+// remove removes the lease of client k, if any. Must be called with the lock
+// held.
+func (t *Table) remove(k Key) {
+	l, ok := t.leases[k]
+	if !ok {
+		return
+	}
+	delete(t.leases, k)
+	a := addrOf(l)
+	delete(t.byAddr[a], k)
+	if len(t.byAddr[a]) == 0 {
+		delete(t.byAddr, a)
+	}
+}
+
+// compact compacts the journal if it grew too large.
+func (t *Table) compact() {
+	t.mu.Lock()
+	j := t.journal
+	if j == nil || !j.needsCompaction(len(t.leases)) {
+		t.mu.Unlock()
+		return
+	}
+
+	// Offers aren't journaled, so don't let them in through compaction
+	var acked []Lease
+	for _, l := range t.leases {
+		if l.State == Acked {
+			acked = append(acked, *l)
+		}
+	}
+	// Changes from here on are queued for the compacted journal, so the
+	// table isn't held up while it's written
+	j.beginCompact()
+	t.mu.Unlock()
+
+	if err := j.endCompact(acked); err != nil {
+		t.log.Errorf("Failed to compact lease journal: %v", err)
+	}
+}
+
+// record records op on l in the journal, if any. Must be called with the lock
+// held, so records are in order. The record is only queued, the journal writes
+// it in the background.
+func (t *Table) record(op string, l Lease, now time.Time) {
+	if t.journal != nil {
+		t.journal.record(op, l, now)
+	}
+}
+
+// Get returns the lease of client k, unless it expired.
+func (t *Table) Get(k Key) (Lease, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	l, ok := t.leases[k]
+	if !ok || !t.now().Before(l.Expiry) {
+		return Lease{}, false
+	}
+	return *l, true
+}
+
+// Offer records l as offered, held for OfferHold. An acknowledged lease of
+// the same address is kept as is, as the client just asked again while it
+// holds it. One of another address is released.
+func (t *Table) Offer(l Lease) Lease {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	if cur, ok := t.leases[l.Key]; ok && cur.State == Acked && now.Before(cur.Expiry) {
+		if cur.IP.Equal(l.IP) {
+			cur.XID = l.XID
+			return *cur
+		}
+		t.record(opRelease, *cur, now)
+	}
+
+	l.State = Offered
+	l.Updated = now
+	l.Expiry = now.Add(OfferHold)
+	t.put(&l)
+	return l
+}
+
+// Ack records l as acknowledged for leaseTime. Other clients holding the same
+// address on the interface lose it, as only one of them can use it.
+func (t *Table) Ack(l Lease, leaseTime time.Duration) Lease {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for k := range t.byAddr[addrOf(&l)] {
+		if k != l.Key {
+			t.log.Infof("Lease of %s on %s passes from %s to %s", l.IP, l.Interface, k.ClientID, l.ClientID)
+			t.remove(k)
+		}
+	}
+
+	now := t.now()
+	l.State = Acked
+	l.Updated = now
+	l.Expiry = now.Add(leaseTime)
+	t.put(&l)
+	t.record(opAck, l, now)
+	return l
+}
+
+// Release removes the lease of client k, as the client released or declined
+// it, or isn't entitled to it anymore. Returns the removed lease, if any.
+func (t *Table) Release(k Key) (Lease, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	l, ok := t.leases[k]
+	if !ok {
+		return Lease{}, false
+	}
+	t.remove(k)
+	if l.State == Acked {
+		t.record(opRelease, *l, t.now())
+	}
+	return *l, true
+}
+
+// Expire removes the leases that expired and returns them.
+func (t *Table) Expire() []Lease {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	var expired []Lease
+	for k, l := range t.leases {
+		if !now.Before(l.Expiry) {
+			expired = append(expired, *l)
+			t.remove(k)
+			if l.State == Acked {
+				t.record(opExpire, *l, now)
+			}
+		}
+	}
+	return expired
+}
+
+// List returns all leases that didn't expire, sorted by interface and client.
+func (t *Table) List() []Lease {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	now := t.now()
+	list := make([]Lease, 0, len(t.leases))
+	for _, l := range t.leases {
+		if now.Before(l.Expiry) {
+			list = append(list, *l)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Interface != list[j].Interface {
+			return list[i].Interface < list[j].Interface
+		}
+		return list[i].ClientID < list[j].ClientID
+	})
+	return list
+}
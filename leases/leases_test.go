@@ -0,0 +1,195 @@
+package leases
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+)
+
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func newTestTable() (*Table, *clock) {
+	c := &clock{t: time.Unix(1000000, 0)}
+	t := New()
+	t.now = c.now
+	return t, c
+}
+
+func lease(ifName, ip string) Lease {
+	mac, _ := net.ParseMAC("52:54:00:12:34:56")
+	return Lease{
+		Key:    Key{Interface: ifName, ClientID: mac.String()},
+		HWAddr: mac,
+		IP:     net.ParseIP(ip),
+	}
+}
+
+func TestKeyFor(t *testing.T) {
+	mac, _ := net.ParseMAC("52:54:00:12:34:56")
+	req, err := dhcpv4.NewDiscovery(mac)
+	assert.Nil(t, err)
+	assert.Equal(t, Key{Interface: "tap1_0", ClientID: "52:54:00:12:34:56"}, KeyFor("tap1_0", req))
+
+	// The client identifier wins over the hardware address
+	req.UpdateOption(dhcpv4.OptClientIdentifier([]byte{1, 0x52, 0x54, 0, 0x12, 0x34, 0x56}))
+	assert.Equal(t, Key{Interface: "tap1_0", ClientID: "01525400123456"}, KeyFor("tap1_0", req))
+}
+
+func TestOfferAck(t *testing.T) {
+	tbl, c := newTestTable()
+	l := lease("tap1_0", "192.0.2.10")
+
+	_, ok := tbl.Get(l.Key)
+	assert.False(t, ok)
+
+	offered := tbl.Offer(l)
+	assert.Equal(t, Offered, offered.State)
+	got, ok := tbl.Get(l.Key)
+	assert.True(t, ok)
+	assert.True(t, got.IP.Equal(l.IP))
+
+	// Offers are only held briefly
+	c.advance(OfferHold)
+	_, ok = tbl.Get(l.Key)
+	assert.False(t, ok, "Offer not expired")
+
+	acked := tbl.Ack(l, time.Hour)
+	assert.Equal(t, Acked, acked.State)
+	assert.Equal(t, c.t.Add(time.Hour), acked.Expiry)
+
+	// Offering the acked address again doesn't downgrade the lease
+	c.advance(time.Minute)
+	l.XID = dhcpv4.TransactionID{1, 2, 3, 4}
+	offered = tbl.Offer(l)
+	assert.Equal(t, Acked, offered.State)
+	assert.Equal(t, acked.Expiry, offered.Expiry)
+	assert.Equal(t, l.XID, offered.XID)
+
+	// But offering another one does
+	other := lease("tap1_0", "192.0.2.11")
+	offered = tbl.Offer(other)
+	assert.Equal(t, Offered, offered.State)
+	got, _ = tbl.Get(l.Key)
+	assert.True(t, got.IP.Equal(other.IP))
+}
+
+func TestAckSupersedes(t *testing.T) {
+	tbl, _ := newTestTable()
+	a := lease("tap1_0", "192.0.2.10")
+	b := lease("tap1_0", "192.0.2.10")
+	b.ClientID = "01525400123456"
+	// Same address on another interface
+	c := lease("tap2_0", "192.0.2.10")
+
+	tbl.Ack(a, time.Hour)
+	tbl.Ack(c, time.Hour)
+	tbl.Ack(b, time.Hour)
+
+	_, ok := tbl.Get(a.Key)
+	assert.False(t, ok, "Superseded lease kept")
+	_, ok = tbl.Get(b.Key)
+	assert.True(t, ok)
+	_, ok = tbl.Get(c.Key)
+	assert.True(t, ok, "Lease on other interface superseded")
+}
+
+func TestAddrIndex(t *testing.T) {
+	tbl, c := newTestTable()
+	l := lease("tap1_0", "192.0.2.10")
+
+	tbl.Offer(l)
+	assert.Equal(t, map[addrKey]map[Key]bool{
+		{Interface: "tap1_0", IP: string(net.ParseIP("192.0.2.10").To16())}: {l.Key: true},
+	}, tbl.byAddr)
+
+	// Acked another address, the previous one is free again
+	moved := l
+	moved.IP = net.ParseIP("192.0.2.11").To4()
+	tbl.Ack(moved, time.Hour)
+	assert.Equal(t, map[addrKey]map[Key]bool{
+		{Interface: "tap1_0", IP: string(net.ParseIP("192.0.2.11").To16())}: {l.Key: true},
+	}, tbl.byAddr)
+
+	c.advance(2 * time.Hour)
+	tbl.Expire()
+	assert.Empty(t, tbl.byAddr)
+}
+
+func TestRelease(t *testing.T) {
+	tbl, _ := newTestTable()
+	l := lease("tap1_0", "192.0.2.10")
+
+	tbl.Ack(l, time.Hour)
+	released, ok := tbl.Release(l.Key)
+	assert.True(t, ok)
+	assert.True(t, released.IP.Equal(l.IP))
+
+	_, ok = tbl.Get(l.Key)
+	assert.False(t, ok)
+	_, ok = tbl.Release(l.Key)
+	assert.False(t, ok, "Released twice")
+}
+
+func TestExpire(t *testing.T) {
+	tbl, c := newTestTable()
+
+	a := lease("tap1_0", "192.0.2.10")
+	b := lease("tap2_0", "192.0.2.20")
+	tbl.Ack(a, time.Hour)
+	tbl.Ack(b, 2*time.Hour)
+	assert.Equal(t, 2, len(tbl.List()))
+	assert.Equal(t, "tap1_0", tbl.List()[0].Interface, "List not sorted")
+
+	assert.Empty(t, tbl.Expire())
+
+	c.advance(time.Hour)
+	// Expired leases aren't listed even before they're removed
+	assert.Equal(t, 1, len(tbl.List()))
+
+	expired := tbl.Expire()
+	assert.Equal(t, 1, len(expired))
+	assert.Equal(t, a.Key, expired[0].Key)
+	assert.Equal(t, 1, len(tbl.List()))
+}
+
+func TestMarshalJSON(t *testing.T) {
+	l := lease("tap1_0", "192.0.2.10")
+	l.State = Acked
+
+	b, err := json.Marshal(l)
+	assert.Nil(t, err)
+
+	var m map[string]any
+	assert.Nil(t, json.Unmarshal(b, &m))
+	assert.Equal(t, "tap1_0", m["interface"])
+	assert.Equal(t, "52:54:00:12:34:56", m["hwaddr"])
+	assert.Equal(t, "192.0.2.10", m["ip"])
+	assert.Equal(t, "acked", m["state"])
+
+	l.State = Offered
+	l.Expiry = time.Unix(1000000, 0).UTC()
+	b, err = json.Marshal(l)
+	assert.Nil(t, err)
+	var got Lease
+	assert.Nil(t, json.Unmarshal(b, &got))
+	assert.Equal(t, l.Key, got.Key)
+	assert.True(t, l.IP.Equal(got.IP))
+	assert.Equal(t, Offered, got.State)
+	assert.Equal(t, l.Expiry, got.Expiry)
+
+	assert.NotNil(t, json.Unmarshal([]byte(`{"interface": "tap1_0", "client-id": "x", "ip": "bad"}`), &got))
+}
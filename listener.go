@@ -1,14 +1,30 @@
 package main
 
 import (
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/google/gopacket"
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv4/server4"
-	"github.com/linode/dhcpd-unnumbered/options"
+	"github.com/linode/dhcpd-unnumbered/boot"
+	"github.com/linode/dhcpd-unnumbered/config"
+	"github.com/linode/dhcpd-unnumbered/decision"
+	"github.com/linode/dhcpd-unnumbered/filter"
+	"github.com/linode/dhcpd-unnumbered/leases"
+	"github.com/linode/dhcpd-unnumbered/metrics"
+	"github.com/linode/dhcpd-unnumbered/ratelimit"
+	"github.com/linode/dhcpd-unnumbered/relay"
+	"github.com/linode/dhcpd-unnumbered/routes"
+	"github.com/prometheus/client_golang/prometheus"
 
 	ll "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netns"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/sys/unix"
 )
@@ -17,62 +33,237 @@ import (
 // not a VRF.
 var ErrNotVRF = errors.New("not a VRF interface")
 
+// This is returned when replying to a relay agent through a listener that
+// can't reach it.
+var ErrNoRelaySender = errors.New("listener can't send to relay agents")
+
+// QueuePolicy defines what happens to requests arriving while all workers are
+// busy and the queue is full.
+type QueuePolicy int
+
+const (
+	// QueueDrop drops the request that didn't fit into the queue.
+	QueueDrop QueuePolicy = iota
+	// QueueBlock stops reading from the socket until there's room again,
+	// leaving it to the kernel to drop once the socket buffer is full.
+	QueueBlock
+)
+
+// Receive buffers, reused across requests
+var bufPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, MaxDatagram)
+		return &b
+	},
+}
+
+// packet is a datagram read from the socket, waiting for a worker.
+type packet struct {
+	buf     *[]byte
+	n       int
+	ifindex int
+	src     *net.UDPAddr
+}
+
 // Listener is the core struct
 type Listener struct {
-	c   *ipv4.PacketConn
-	sIP net.IP
-	log *ll.Entry
-
+	recv   Receiver
+	sender Sender
+	// Sends replies to relay agents, nil if recv can't
+	relay RelaySender
+	sIP   net.IP
+	log   *ll.Entry
+
+	// Returns where facts about interfaces are looked up, given the
+	// configuration of a request
+	lookup func(c *config.Config) decision.Lookup
+
+	// Namespace the sockets live in, not open for the daemon's own namespace
+	ns     netns.NsHandle
+	nsName string
+
+	// Interface bound to, empty for the wildcard listener
+	intf string
+	// VRF bound to or the tap is enslaved to, empty otherwise
+	vrf string
 	// Table of the VRF, otherwise the main table
 	routeTable int
+
+	// Rate limits requests per client and per interface
+	limiter *ratelimit.Limiter
+
+	// Host routes, if nil or not in sync, routes are dumped per request
+	routes *routes.Cache
+
+	// Leases handed out, if nil no leases are tracked
+	leases *leases.Table
+
+	// Maps relayed clients to interfaces, if nil they're named after their
+	// identity
+	relayMap *relay.Map
+
+	// Worker pool handling requests
+	workers     int
+	queueSize   int
+	queuePolicy QueuePolicy
+	dropped     atomic.Uint64
 }
 
 // NewListener creates a new instance of DHCP listener. If intf is a concrete
 // interface, it must be a VRF.
 func NewListener(intf string) (*Listener, error) {
-	s := net.UDPAddr{
-		IP:   net.IPv4zero,
-		Port: 67,
-		Zone: intf,
-	}
+	return NewListenerAt(netns.None(), "", intf)
+}
 
+// NewListenerAt creates a new instance of DHCP listener in namespace ns, named
+// nsName for logging. The handle must stay open until the listener is closed.
+func NewListenerAt(ns netns.NsHandle, nsName string, intf string) (*Listener, error) {
 	// The default is the main table
 	vrfTable := unix.RT_TABLE_MAIN
 
 	if intf != "" {
 		var err error
-		vrfTable, err = getVRFTableIdx(intf)
+		vrfTable, err = getVRFTableIdx(ns, intf)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	udpConn, err := server4.NewIPv4UDPConn(s.Zone, &s)
+	return newListener(ns, nsName, intf, intf, vrfTable)
+}
+
+// NewTapListener creates a new instance of DHCP listener bound to tap intf.
+// Host routes are looked up in the table of the VRF the tap is enslaved to, or
+// the main table.
+func NewTapListener(intf string) (*Listener, error) {
+	vrf, table, err := getMasterVRF(netns.None(), intf)
 	if err != nil {
 		return nil, err
 	}
+	return newListener(netns.None(), "", intf, vrf, table)
+}
+
+// newListener opens the sockets in ns, bound to intf if not empty.
+func newListener(ns netns.NsHandle, nsName string, intf string, vrf string, table int) (*Listener, error) {
+	s := net.UDPAddr{
+		IP:   net.IPv4zero,
+		Port: 67,
+		Zone: intf,
+	}
+
+	var c *ipv4.PacketConn
+	var sender *rawSender
+	// Sockets belong to the namespace they were created in, no matter where
+	// they're used later on.
+	err := inNetns(ns, func() error {
+		udpConn, err := server4.NewIPv4UDPConn(s.Zone, &s)
+		if err != nil {
+			return err
+		}
+
+		c = ipv4.NewPacketConn(udpConn)
+
+		// When not bound to an interface, we need the information in each
+		// packet to know which interface it came on
+		err = c.SetControlMessage(ipv4.FlagInterface, true)
+		if err != nil {
+			c.Close()
+			return err
+		}
 
-	c := ipv4.NewPacketConn(udpConn)
+		// Drop anything that isn't a DHCP request before it's copied to
+		// userspace
+		prog, err := filter.Program()
+		if err != nil {
+			c.Close()
+			return fmt.Errorf("cannot assemble BPF program: %v", err)
+		}
+		if err := c.SetBPF(prog); err != nil {
+			c.Close()
+			return fmt.Errorf("cannot attach BPF program: %v", err)
+		}
 
-	// When not bound to an interface, we need the information in each
-	// packet to know which interface it came on
-	err = c.SetControlMessage(ipv4.FlagInterface, true)
+		sender, err = newRawSender()
+		if err != nil {
+			c.Close()
+			return fmt.Errorf("cannot open raw socket: %v", err)
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	return newListenerOn(udpReceiver{c}, sender, ns, nsName, intf, vrf, table), nil
+}
+
+// newListenerOn creates a listener receiving requests from recv and sending
+// replies through sender.
+func newListenerOn(recv Receiver, sender Sender, ns netns.NsHandle, nsName string, intf string, vrf string, table int) *Listener {
 	// Create a sub logger that attaches the interface to each message
 	logIntf := intf
 	if logIntf == "" {
 		logIntf = "NONE"
 	}
-	log := ll.NewEntry(ll.StandardLogger()).WithFields(ll.Fields{"interface": logIntf})
+	fields := ll.Fields{"interface": logIntf}
+	if nsName != "" {
+		fields["netns"] = nsName
+	}
+	log := ll.NewEntry(ll.StandardLogger()).WithFields(fields)
+
+	l := &Listener{
+		recv:        recv,
+		sender:      sender,
+		log:         log,
+		ns:          ns,
+		nsName:      nsName,
+		intf:        intf,
+		vrf:         vrf,
+		routeTable:  table,
+		limiter:     ratelimit.New(),
+		workers:     DefaultWorkers,
+		queueSize:   DefaultQueueSize,
+		queuePolicy: QueueDrop,
+	}
+	l.relay, _ = recv.(RelaySender)
+	l.lookup = func(c *config.Config) decision.Lookup {
+		return listenerLookup{l, c.OverrideFilePrefix}
+	}
+	return l
+}
 
-	return &Listener{
-		c:          c,
-		log:        log,
-		routeTable: vrfTable,
-	}, nil
+// ListenerInfo describes a listener for introspection.
+type ListenerInfo struct {
+	Interface  string `json:"interface,omitempty"`
+	VRF        string `json:"vrf,omitempty"`
+	Netns      string `json:"netns,omitempty"`
+	Source     string `json:"source,omitempty"`
+	RouteTable int    `json:"route-table"`
+	Workers    int    `json:"workers"`
+	QueueSize  int    `json:"queue-size"`
+	QueueDrops uint64 `json:"queue-drops"`
+	RouteCache bool   `json:"route-cache"`
+	Buckets    int    `json:"rate-limit-buckets"`
+	DHCPv6     bool   `json:"dhcpv6,omitempty"`
+}
+
+// Info returns a description of the listener.
+func (l *Listener) Info() ListenerInfo {
+	info := ListenerInfo{
+		Interface:  l.intf,
+		VRF:        l.vrf,
+		Netns:      l.nsName,
+		RouteTable: l.routeTable,
+		Workers:    l.workers,
+		QueueSize:  l.queueSize,
+		QueueDrops: l.dropped.Load(),
+		RouteCache: l.routes != nil,
+		Buckets:    l.limiter.Len(),
+	}
+	if l.sIP != nil {
+		info.Source = l.sIP.String()
+	}
+	return info
 }
 
 // SetSource sets the DHCP server IP and Identified in the offer
@@ -81,32 +272,127 @@ func (l *Listener) SetSource(ip net.IP) {
 	l.log.Infof("Sending from %s", l.sIP)
 }
 
+// SetRouteCache sets the cache to look up host routes in.
+func (l *Listener) SetRouteCache(c *routes.Cache) {
+	l.routes = c
+}
+
+// SetInterfaceFilter restricts the requests accepted by the kernel to those
+// received on one of the given interfaces, replacing the previous set. nil
+// lifts the restriction.
+func (l *Listener) SetInterfaceFilter(ifindexes []int) error {
+	prog, err := filter.Program()
+	if ifindexes != nil {
+		prog, err = filter.ProgramForInterfaces(ifindexes)
+	}
+	if err != nil {
+		return err
+	}
+	return l.recv.SetBPF(prog)
+}
+
+// SetLeases sets the table to track leases in.
+func (l *Listener) SetLeases(t *leases.Table) {
+	l.leases = t
+}
+
+// SetRelayMap sets the mappings of relayed clients to interfaces.
+func (l *Listener) SetRelayMap(m *relay.Map) {
+	l.relayMap = m
+}
+
+// SetQueue sets the number of workers handling requests, the number of
+// requests that can be queued for them and what happens once the queue is
+// full. Must be called before Listen.
+func (l *Listener) SetQueue(workers, size int, policy QueuePolicy) {
+	l.workers = workers
+	l.queueSize = size
+	l.queuePolicy = policy
+}
+
 // Listen starts listening for incoming DHCP requests
 func (l *Listener) Listen() error {
-	l.log.Infof("Listen %s", l.c.LocalAddr())
+	l.log.Infof("Listen %s with %d workers", l.recv.LocalAddr(), l.workers)
+
+	queue := make(chan packet, l.queueSize)
+	wg := sync.WaitGroup{}
+	for i := 0; i < l.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range queue {
+				l.handleMsg((*p.buf)[:p.n], p.ifindex, p.src)
+				bufPool.Put(p.buf)
+			}
+		}()
+	}
+	defer func() {
+		close(queue)
+		wg.Wait()
+	}()
+
+	// Whether the previous request made it into the queue, to only warn once
+	// per burst of dropped requests
+	queued := true
+
 	for {
-		b := make([]byte, MaxDatagram)
-		n, oob, _, err := l.c.ReadFrom(b)
+		b := bufPool.Get().(*[]byte)
+		n, ifindex, src, err := l.recv.Receive(*b)
 		if err != nil {
+			bufPool.Put(b)
 			// NOTE: this error will also be logged if the socket is closed when
 			// the VRF disappears (which is expected).
 			l.log.Errorf("Error reading from connection: %v (this error is expected if a VRF was torn down)", err)
 			return err
 		}
-		go l.handleMsg(b[:n], oob)
+
+		p := packet{buf: b, n: n, ifindex: ifindex, src: src}
+		if l.queuePolicy == QueueBlock {
+			queue <- p
+			continue
+		}
+
+		select {
+		case queue <- p:
+			queued = true
+		default:
+			bufPool.Put(b)
+			dropped := l.dropped.Add(1)
+			metrics.Dropped.WithLabelValues(metrics.DropQueueFull).Inc()
+			if queued {
+				l.log.Warnf("Request queue full, dropping requests (%d dropped so far)", dropped)
+			} else {
+				l.log.Debugf("Request queue full, dropped request (%d dropped so far)", dropped)
+			}
+			queued = false
+		}
 	}
 }
 
 func (l *Listener) Close() error {
 	l.log.Info("Closing Listener")
-	return l.c.Close()
+	if err := l.sender.Close(); err != nil {
+		l.log.Warnf("Failed to close raw socket: %v", err)
+	}
+	return l.recv.Close()
 }
 
 // handleMsg is triggered every time there is a DHCP request coming in. this is the main deal handling the reply
-func (l *Listener) handleMsg(buf []byte, oob *ipv4.ControlMessage) {
-	ifi, err := net.InterfaceByIndex(oob.IfIndex)
+func (l *Listener) handleMsg(buf []byte, ifindex int, src *net.UDPAddr) {
+	// Stick to the same configuration for the whole request, even if it gets
+	// reloaded meanwhile
+	c := cfg.Load()
+
+	start := time.Now()
+	defer func() {
+		metrics.HandlingDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	lk := l.lookup(c)
+	ifi, err := lk.Interface(ifindex)
 	if err != nil {
 		l.log.Errorf("Error getting request interface: %v", err)
+		metrics.Dropped.WithLabelValues(metrics.DropInterfaceLookup).Inc()
 		return
 	}
 	l.log.Debugf("Received on interface %+v", ifi)
@@ -114,226 +400,381 @@ func (l *Listener) handleMsg(buf []byte, oob *ipv4.ControlMessage) {
 	req, err := dhcpv4.FromBytes(buf)
 	if err != nil {
 		l.log.Errorf("Error parsing DHCPv4 request: %v", err)
+		metrics.Dropped.WithLabelValues(metrics.DropParseError).Inc()
 		return
 	}
+	metrics.Received.WithLabelValues(req.MessageType().String()).Inc()
 
 	l.log.Debugf("received %s on %v", req.MessageType(), ifi.Name)
 	l.log.Trace(req.Summary())
 
-	if !(regex.Match([]byte(ifi.Name))) {
-		l.log.Debugf("DHCP request on Interface %v is not accepted, ignoring", ifi.Name)
-		return
+	// Requests forwarded by a relay agent don't come from a tap, the client
+	// is identified by what the agent tells about it instead
+	agent := relay.FromRequest(req)
+	if agent != nil {
+		var srcIP net.IP
+		if src != nil {
+			srcIP = src.IP
+		}
+		ifi, err = decision.AcceptRelay(c, lk, agent, srcIP, &decision.Trace{Log: l.log})
+	} else {
+		err = decision.Accept(c, ifi, &decision.Trace{Log: l.log})
 	}
-
-	if ifi.Flags&net.FlagUp != net.FlagUp {
-		l.log.Debugf("DHCP request on a Interface %v, which is down. that's not right, skipping...", ifi.Name)
+	if err != nil {
+		l.drop(err)
 		return
 	}
 
 	if req.OpCode != dhcpv4.OpcodeBootRequest {
 		l.log.Warnf("Unsupported opcode %d. Only BootRequest (%d) is supported", req.OpCode, dhcpv4.OpcodeBootRequest)
+		metrics.Dropped.WithLabelValues(metrics.DropUnsupportedOpcode).Inc()
 		return
 	}
 
-	// Load override options from file if it exists. Otherwise, fall back to
-	// existing behavior of generating options internally, updating this struct
-	// while doing so.
-	options := &options.DHCP{}
-	if *flagHostnameOverride {
-		opt, err := getOptionsOverride(l.log, ifi.Name)
-		if err != nil {
-			l.log.Warnf("Failed to read options file: %v", err)
-		} else {
-			l.log.Infof("Override options read from file")
-			options = opt
-		}
+	// Check the client first, so a single noisy guest doesn't use up the
+	// budget of its interface
+	limits := c.RateLimitsFor(l.vrf)
+	if !l.limiter.Allow(ifi.Name+"/"+req.ClientHWAddr.String(), limits.Client) {
+		l.log.Debugf("Rate limit exceeded by %s on %v, dropping", req.ClientHWAddr, ifi.Name)
+		metrics.Dropped.WithLabelValues(metrics.DropRateLimited).Inc()
+		return
 	}
-
-	if options.PvtIPs == nil {
-		options.PvtIPs = pvtIPs
+	if !l.limiter.Allow(ifi.Name, limits.Interface) {
+		l.log.Debugf("Rate limit exceeded on %v, dropping", ifi.Name)
+		metrics.Dropped.WithLabelValues(metrics.DropRateLimited).Inc()
+		return
 	}
 
-	if len(options.IPv4) == 0 {
-		l.log.Debugf("Now reading routes from table %d", l.routeTable)
-		rts, err := getTableRoutes(oob.IfIndex, l.routeTable)
+	key := l.leaseKey(ifi.Name, req)
 
+	mt := req.MessageType()
+	switch mt {
+	case dhcpv4.MessageTypeDiscover, dhcpv4.MessageTypeRequest, dhcpv4.MessageTypeInform:
+	case dhcpv4.MessageTypeRelease:
+		// Nothing to free as addresses are bound to the tap by routing, but
+		// keep a record of the guest letting go of it.
+		ll.Infof("%s of %s from %s on %s", mt, req.ClientIPAddr, req.ClientHWAddr, ifi.Name)
+		l.releaseLeaseBy(key, req)
+		return
+	case dhcpv4.MessageTypeDecline:
+		// The guest detected the address as already in use, usually by an IP
+		// conflict within the VM.
+		ll.Warnf("%s of %s from %s on %s, address might be in use", mt, req.RequestedIPAddress(), req.ClientHWAddr, ifi.Name)
+		l.releaseLeaseBy(key, req)
+		return
+	default:
+		l.log.Warnf("Unhandled message type: %v", mt)
+		metrics.Dropped.WithLabelValues(metrics.DropUnhandledType).Inc()
+		return
+	}
+
+	r, err := l.decide(c, lk, ifi, req, key, &decision.Trace{Log: l.log})
+	if err != nil {
+		l.drop(err)
+		return
+	}
+	options, pickedIP, sIP := r.Options, r.IP, r.ServerIP
+
+	if r.Verdict == decision.Nak {
+		resp, err := dhcpv4.NewReplyFromRequest(req,
+			dhcpv4.WithMessageType(dhcpv4.MessageTypeNak),
+			dhcpv4.WithOption(dhcpv4.OptServerIdentifier(sIP)),
+			dhcpv4.WithOption(dhcpv4.OptMessage(r.Reason)),
+		)
 		if err != nil {
-			l.log.Errorf("failed to get routes for Interface %v from table %d: %v", ifi.Name, l.routeTable, err)
+			l.log.Errorf("Failed to compile NAK: %v", err)
+			metrics.Dropped.WithLabelValues(metrics.DropReplyError).Inc()
 			return
 		}
-
-		for _, ip := range rts {
-			// Range is implicitly /24.
-			ipn := net.IPNet{
-				IP:   ip.IP,
-				Mask: net.CIDRMask(24, 32),
-			}
-			options.IPv4 = append(options.IPv4, &ipn)
+		peer, peerMAC := replyPeer(req, resp, nil)
+		if agent != nil {
+			// The relay agent broadcasts it to the client (RFC 2131 4.3.2)
+			resp.SetBroadcast()
+			peer, peerMAC = agent.Peer(src), nil
 		}
-	}
-	l.log.Debugf("Routes found for Interface %v: %v", ifi.Name, options.IPv4)
-
-	// seems like we have no host routes, not providing DHCP
-	if len(options.IPv4) == 0 {
-		l.log.Infof("seems like we have no host routes or override IPs, not providing DHCP")
+		ll.Infof("%s to %s on %s: %s", resp.MessageType(), peer.IP, ifi.Name, r.Reason)
+		l.send(*options.Gateway, peer, peerMAC, ifi, resp, maxReplySize(req))
+		// Whatever the client held, it's not ours to hand out anymore
+		l.releaseLease(key)
 		return
 	}
 
-	// by default set the first IP in our return slice of routes
-	pickedIP := options.IPv4[0]
-	for _, ipr := range options.IPv4 {
-		// however, check if the client requests a specific IP *and* still owns it, if so let 'em have it, even if private
-		if req.RequestedIPAddress().Equal(ipr.IP) {
-			l.log.Debugf("client requested IP: %v and still owns it. so sticking to that one", req.RequestedIPAddress())
-			pickedIP = ipr
-			break
-		}
-		if req.ClientIPAddr.Equal(ipr.IP) {
-			l.log.Debugf("client used IP: %v and still owns it. so sticking to that one", req.ClientIPAddr)
-			pickedIP = ipr
-			break
+	// lets go compile the response
+	// giaddr and option 82 are echoed by NewReplyFromRequest
+	var mods []dhcpv4.Modifier
+	mods = append(mods, dhcpv4.WithServerIP(r.NextServer))
+	// An INFORM comes from a guest configured statically, so it only gets the
+	// configuration parameters without an address or lease (RFC 2131 3.4)
+	if mt != dhcpv4.MessageTypeInform {
+		mods = append(mods, dhcpv4.WithYourIP(pickedIP.IP))
+		mods = append(mods, dhcpv4.WithNetmask(pickedIP.Mask))
+		mods = append(mods, dhcpv4.WithRouter(*options.Gateway))
+		mods = append(mods, dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(*options.LeaseTime)))
+
+		if r.Classless {
+			routes := classlessRoutes(*options.Gateway)
+			mods = append(mods, dhcpv4.WithOption(dhcpv4.OptClasslessStaticRoute(routes...)))
+			// Same as option 121 for Microsoft clients predating RFC 3442
+			mods = append(mods, dhcpv4.WithGeneric(dhcpv4.GenericOptionCode(249), routes.ToBytes()))
 		}
+	}
+	mods = append(mods, dhcpv4.WithDNS(r.DNS...))
+	mods = append(mods, dhcpv4.WithOption(dhcpv4.OptHostName(*options.Hostname)))
+	mods = append(mods, dhcpv4.WithOption(dhcpv4.OptDomainName(*options.Domainname)))
+	mods = append(mods, dhcpv4.WithOption(dhcpv4.OptServerIdentifier(sIP)))
 
-		// if first IP in rts slice is a privete IP, override it with this one.
-		// doing this way will allow the last private IP to stick anyway in case there is no public IP assigned to a VM
-		if options.PvtIPs.Contains(pickedIP.IP) {
-			l.log.Debugf("first IP was private, overriding with %v for now", ipr)
-			pickedIP = ipr
-		}
+	if len(options.NTP) > 0 {
+		mods = append(mods, dhcpv4.WithOption(dhcpv4.OptNTPServers(options.NTP...)))
 	}
 
-	l.log.Debugf("Picked IP: %v", pickedIP)
+	if options.InterfaceMTU != nil {
+		mtu := make([]byte, 2)
+		binary.BigEndian.PutUint16(mtu, *options.InterfaceMTU)
+		mods = append(mods, dhcpv4.WithGeneric(dhcpv4.OptionInterfaceMTU, mtu))
+	}
 
-	// the default gateway handed out by DHCP is the first IP of whatever subnet the client gets handed out.
-	// we actually don't care at all what the gw IP is, its really just to make the client's tcp/ip stack happy
-	if options.Gateway == nil {
-		gw := gatewayFromIP(pickedIP)
-		options.Gateway = gw
+	if len(options.DomainSearch) > 0 {
+		mods = append(mods, dhcpv4.WithDomainSearchList(options.DomainSearch...))
 	}
 
-	// source IP to be sending from
-	sIP := l.sIP
-	if sIP == nil {
-		sIP = *options.Gateway
+	mods = append(mods, bootModifiers(r.Delivery, *options.Bootfile, r.TFTPServer)...)
+
+	// Raw options go last so they win over anything set above
+	for _, opt := range options.RawOptions {
+		mods = append(mods, dhcpv4.WithOption(opt))
 	}
 
-	// mix DNS but mix em consistently so same IP gets the same order
-	dns := mixDNS(pickedIP.IP)
+	if mt == dhcpv4.MessageTypeDiscover {
+		mods = append(mods, dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer))
+	} else {
+		mods = append(mods, dhcpv4.WithMessageType(dhcpv4.MessageTypeAck))
+	}
 
-	// should I generate a dynamic hostname?
-	hostname := *flagHostname
-	domainname := *flagDomainname
+	resp, err := dhcpv4.NewReplyFromRequest(req, mods...)
+	if err != nil {
+		l.log.Errorf("Failed to compile reply: %v", err)
+		metrics.Dropped.WithLabelValues(metrics.DropReplyError).Inc()
+		return
+	}
 
-	// find dynamic hostname if feature is enabled
-	if *flagDynHost {
-		hostname = getDynamicHostname(pickedIP.IP)
+	yourIP := pickedIP.IP
+	if mt == dhcpv4.MessageTypeInform {
+		yourIP = nil
+	}
+	peer, peerMAC := replyPeer(req, resp, yourIP)
+	if agent != nil {
+		peer, peerMAC = agent.Peer(src), nil
 	}
 
-	// static hostname in a file (if exists) will supersede the dynamic hostname
-	if *flagHostnameOverride {
-		h, d, err := getHostnameOverride(ifi.Name)
-		if err == nil {
-			hostname = h
-			if d != "" {
-				domainname = d
-			}
+	ll.Infof(
+		"%s to %s on %s with %v, lease %s, hostname %s.%s, tftp %s:%s, next server %s",
+		resp.MessageType(),
+		peer.IP,
+		ifi.Name,
+		pickedIP,
+		*options.LeaseTime,
+		*options.Hostname,
+		*options.Domainname,
+		r.TFTPServer,
+		*options.Bootfile,
+		r.NextServer,
+	)
+	ll.Trace(resp.Summary())
+
+	l.send(*options.Gateway, peer, peerMAC, ifi, resp, maxReplySize(req))
+
+	if yourIP != nil && l.leases != nil {
+		lease := leases.Lease{
+			Key:      key,
+			HWAddr:   req.ClientHWAddr,
+			IP:       yourIP,
+			Hostname: *options.Hostname,
+			XID:      req.TransactionID,
+			ServerID: sIP,
+		}
+		if mt == dhcpv4.MessageTypeDiscover {
+			l.leases.Offer(lease)
 		} else {
-			l.log.Debugf("unable to get static hostname: %v", err)
+			l.leases.Ack(lease, *options.LeaseTime)
 		}
 	}
+}
+
+// drop logs why a request is dropped, as returned by decide, and counts it.
+func (l *Listener) drop(err error) {
+	logDrop(l.log, metrics.Dropped, err)
+}
 
-	// Options file takes priority over other hostname settings
-	if options.Hostname == nil {
-		options.Hostname = &hostname
+// logDrop logs why a request is dropped to log and counts it in dropped.
+func logDrop(log *ll.Entry, dropped *prometheus.CounterVec, err error) {
+	var drop *decision.DropError
+	if !errors.As(err, &drop) {
+		log.Errorf("Dropping request: %v", err)
+		dropped.WithLabelValues(metrics.DropReplyError).Inc()
+		return
 	}
 
-	if options.Domainname == nil {
-		options.Domainname = &domainname
+	switch drop.Reason {
+	case metrics.DropRouteLookup:
+		log.Error(drop.Err)
+	case metrics.DropNoHostRoutes, metrics.DropLeaseMismatch:
+		log.Info(drop.Err)
+	default:
+		log.Debug(drop.Err)
 	}
+	dropped.WithLabelValues(drop.Reason).Inc()
+}
 
-	// lets go compile the response
-	var mods []dhcpv4.Modifier
-	//mods = append(mods, dhcpv4.WithBroadCast(false))
-	//this should not be needed. only for dhcp relay which we don't use/do. needs to be tested
-	//resp.GatewayIPAddr = gw
-	mods = append(mods, dhcpv4.WithServerIP(*options.Gateway))
-	mods = append(mods, dhcpv4.WithYourIP(pickedIP.IP))
-	mods = append(mods, dhcpv4.WithNetmask(pickedIP.Mask))
-	mods = append(mods, dhcpv4.WithRouter(*options.Gateway))
-	mods = append(mods, dhcpv4.WithDNS(dns...))
-	mods = append(mods, dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(*flagLeaseTime)))
-	mods = append(mods, dhcpv4.WithOption(dhcpv4.OptHostName(*options.Hostname)))
-	mods = append(mods, dhcpv4.WithOption(dhcpv4.OptDomainName(*options.Domainname)))
-	mods = append(mods, dhcpv4.WithOption(dhcpv4.OptServerIdentifier(sIP)))
+// leaseKey returns the lease key of the client sending req on interface
+// ifName. Interfaces in other namespaces are prefixed with the namespace, as
+// their names are only unique within it.
+func (l *Listener) leaseKey(ifName string, req *dhcpv4.DHCPv4) leases.Key {
+	if l.nsName != "" {
+		ifName = l.nsName + "/" + ifName
+	}
+	return leases.KeyFor(ifName, req)
+}
 
-	if *flagBootfile != "" {
-		mods = append(mods, dhcpv4.WithOption(dhcpv4.OptBootFileName(*flagBootfile)))
+// lease returns the current lease of client k, if leases are tracked.
+func (l *Listener) lease(k leases.Key) (leases.Lease, bool) {
+	if l.leases == nil {
+		return leases.Lease{}, false
 	}
+	return l.leases.Get(k)
+}
 
-	if options.Tftp == nil && tftp != nil {
-		options.Tftp = &tftp
+// releaseLease forgets the lease of client k, if leases are tracked.
+func (l *Listener) releaseLease(k leases.Key) {
+	if l.leases == nil {
+		return
+	}
+	if lease, ok := l.leases.Release(k); ok {
+		l.log.Debugf("Released lease of %s for %s", lease.IP, k.ClientID)
 	}
+}
 
-	if options.Tftp != nil {
-		mods = append(mods, dhcpv4.WithOption(dhcpv4.OptTFTPServerName(options.Tftp.String()))) // this is Option 66
+// releaseLeaseBy forgets the lease of client k as released or declined by
+// req, if leases are tracked and req is about that lease.
+func (l *Listener) releaseLeaseBy(k leases.Key, req *dhcpv4.DHCPv4) {
+	lease, ok := l.lease(k)
+	if !ok {
+		return
 	}
+	if err := checkRelease(req, lease); err != nil {
+		l.drop(err)
+		return
+	}
+	l.releaseLease(k)
+}
 
-	switch mt := req.MessageType(); mt {
-	case dhcpv4.MessageTypeDiscover:
-		mods = append(mods, dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer))
-	case dhcpv4.MessageTypeRequest:
-		mods = append(mods, dhcpv4.WithMessageType(dhcpv4.MessageTypeAck))
-	default:
-		l.log.Warnf("Unhandled message type: %v", mt)
+// checkRelease returns an error if the DHCPRELEASE or DHCPDECLINE req isn't
+// about lease: it must name the server identifier the lease was handed out
+// with, and the leased address in ciaddr or the requested IP respectively
+// (RFC 2131 4.3.4, 4.3.5).
+func checkRelease(req *dhcpv4.DHCPv4, lease leases.Lease) error {
+	mt := req.MessageType()
+	if sid := req.ServerIdentifier(); lease.ServerID != nil && !sid.Equal(lease.ServerID) {
+		return &decision.DropError{Reason: metrics.DropOtherServer, Err: fmt.Errorf("%s for server %v rather than %v, ignoring", mt, sid, lease.ServerID)}
+	}
+	ip := req.ClientIPAddr
+	if mt == dhcpv4.MessageTypeDecline {
+		ip = req.RequestedIPAddress()
+	}
+	if !ip.Equal(lease.IP) {
+		return &decision.DropError{Reason: metrics.DropLeaseMismatch, Err: fmt.Errorf("%s of %v from %s, which holds %v, ignoring", mt, ip, req.ClientHWAddr, lease.IP)}
+	}
+	return nil
+}
+
+// cachedRoutes returns the host routes of ifindex in our table from the route
+// cache, if there is one and it's in sync.
+func (l *Listener) cachedRoutes(ifindex int) ([]*net.IPNet, bool) {
+	if l.routes == nil {
+		return nil, false
+	}
+	return l.routes.Routes(l.routeTable, ifindex)
+}
+
+// send transmits resp to peer on ifi, sourced from src. Without peerMAC, peer
+// is a relay agent, which is sent to through the kernel's routing instead. The
+// DHCP message is kept to size bytes if possible.
+func (l *Listener) send(src net.IP, peer *net.UDPAddr, peerMAC net.HardwareAddr, ifi *net.Interface, resp *dhcpv4.DHCPv4, size int) {
+	payload, ok := encodeReply(resp, size)
+	if !ok {
+		l.log.Warnf("%s to %v is %d bytes, more than the %d bytes the client accepts", resp.MessageType(), peer, len(payload), size)
+	}
+
+	if peerMAC == nil {
+		err := ErrNoRelaySender
+		if l.relay != nil {
+			err = l.relay.SendTo(payload, peer)
+		}
+		if err != nil {
+			ll.Errorf("Write to relay agent %v failed: %v", peer, err)
+			metrics.Dropped.WithLabelValues(metrics.DropSendFailure).Inc()
+			return
+		}
+		metrics.Sent.WithLabelValues(resp.MessageType().String()).Inc()
 		return
 	}
 
-	resp, err := dhcpv4.NewReplyFromRequest(req, mods...)
-	if err != nil {
-		l.log.Errorf("Failed to compile reply: %v", err)
+	buf := frameBufs.Get().(gopacket.SerializeBuffer)
+	defer frameBufs.Put(buf)
+	if err := serializeReply(buf, src, peer, peerMAC, ifi, payload); err != nil {
+		ll.Errorf("Failed to serialize reply to %v: %v", peer, err)
+		metrics.Dropped.WithLabelValues(metrics.DropReplyError).Inc()
+		return
+	}
+	if err := l.sender.Send(buf.Bytes(), ifi.Index); err != nil {
+		ll.Errorf("Write to connection %v failed: %v", peer, err)
+		metrics.Dropped.WithLabelValues(metrics.DropSendFailure).Inc()
 		return
 	}
+	metrics.Sent.WithLabelValues(resp.MessageType().String()).Inc()
+}
 
-	var peer *net.UDPAddr
-	var peerMAC *net.HardwareAddr
-	//only needed if we wanna support dhcp relay, we don't need that
-	//if !req.GatewayIPAddr.IsUnspecified() {
-	//	TODO: make RFC8357 compliant
-	//	peer = &net.UDPAddr{IP: req.GatewayIPAddr, Port: dhcpv4.ServerPort}
-	if resp.MessageType() == dhcpv4.MessageTypeNak {
-		peer = &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}
-		peerMAC = &net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
-	} else if !req.ClientIPAddr.IsUnspecified() {
-		peer = &net.UDPAddr{IP: req.ClientIPAddr, Port: dhcpv4.ClientPort}
-		peerMAC = &req.ClientHWAddr
-	} else if req.IsBroadcast() && req.Flags == 1 {
-		peer = &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}
-		peerMAC = &net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
-	} else if req.Flags == 0 {
-		peer = &net.UDPAddr{IP: pickedIP.IP, Port: dhcpv4.ClientPort}
-		peerMAC = &req.ClientHWAddr
-	} else {
-		ll.Traceln("Cannot handle non-broadcast-capable unspecified peers in an RFC-compliant way. Response will be broadcast")
-		peer = &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}
-		peerMAC = &net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+// bootModifiers puts the bootfile and tftp server name into the file and
+// sname header fields and/or options 67 and 66, as delivery says. Values too
+// long for their header field go into the option either way.
+func bootModifiers(delivery boot.Delivery, bootfile, tftp string) []dhcpv4.Modifier {
+	var mods []dhcpv4.Modifier
+	// The header fields need to end with a NUL
+	headerFile := delivery.Header() && len(bootfile) < fileLen
+	headerSname := delivery.Header() && len(tftp) < snameLen
+	if headerFile || headerSname {
+		mods = append(mods, func(d *dhcpv4.DHCPv4) {
+			if headerFile {
+				d.BootFileName = bootfile
+			}
+			if headerSname {
+				d.ServerHostName = tftp
+			}
+		})
 	}
 
-	ll.Infof(
-		"%s to %s on %s with %v, lease %s, hostname %s.%s, tftp %s:%s",
-		resp.MessageType(),
-		peer.IP,
-		ifi.Name,
-		pickedIP,
-		*flagLeaseTime,
-		*options.Hostname,
-		*options.Domainname,
-		// This can be nil, so let the logger deference
-		options.Tftp,
-		*flagBootfile,
-	)
-	ll.Trace(resp.Summary())
+	if bootfile != "" && (delivery.Options() || !headerFile) {
+		mods = append(mods, dhcpv4.WithOption(dhcpv4.OptBootFileName(bootfile)))
+	}
+	if tftp != "" && (delivery.Options() || !headerSname) {
+		mods = append(mods, dhcpv4.WithOption(dhcpv4.OptTFTPServerName(tftp))) // this is Option 66
+	}
+	return mods
+}
 
-	if err := sendPacket(peer, *peerMAC, *ifi, resp); err != nil {
-		ll.Errorf("Write to connection %v failed: %v", peer, err)
+// replyPeer selects the address and MAC a reply to req has to be sent to, as
+// per RFC 2131 section 4.1. yourIP is the address being handed out, if any.
+func replyPeer(req, resp *dhcpv4.DHCPv4, yourIP net.IP) (*net.UDPAddr, net.HardwareAddr) {
+	bcastMAC := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+	if resp.MessageType() == dhcpv4.MessageTypeNak {
+		return &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}, bcastMAC
+	} else if !req.ClientIPAddr.IsUnspecified() {
+		return &net.UDPAddr{IP: req.ClientIPAddr, Port: dhcpv4.ClientPort}, req.ClientHWAddr
+	} else if req.IsBroadcast() && req.Flags == 1 {
+		return &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}, bcastMAC
+	} else if req.Flags == 0 && yourIP != nil {
+		return &net.UDPAddr{IP: yourIP, Port: dhcpv4.ClientPort}, req.ClientHWAddr
 	}
+	ll.Traceln("Cannot handle non-broadcast-capable unspecified peers in an RFC-compliant way. Response will be broadcast")
+	return &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}, bcastMAC
 }
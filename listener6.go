@@ -0,0 +1,377 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/dhcpv6/server6"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/linode/dhcpd-unnumbered/config"
+	"github.com/linode/dhcpd-unnumbered/decision"
+	"github.com/linode/dhcpd-unnumbered/metrics"
+	"github.com/linode/dhcpd-unnumbered/ratelimit"
+	ll "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netns"
+	"golang.org/x/net/ipv6"
+)
+
+// RFC 4704 flags of the Client FQDN option
+const (
+	fqdnFlagS = 0x01 // the server performs AAAA updates
+	fqdnFlagO = 0x02 // the server overrode the client's S flag
+	fqdnFlagN = 0x04 // the server performs no DNS updates
+)
+
+// Listener6 serves DHCPv6 on a single tap. Clients multicast to
+// All_DHCP_Relay_Agents_and_Servers and are answered at their link-local
+// address, so unlike DHCPv4 the kernel takes care of framing.
+type Listener6 struct {
+	conn net.PacketConn
+	log  *ll.Entry
+
+	// Returns where facts about the tap are looked up, given the
+	// configuration of a request
+	lookup func(c *config.Config) decision.Lookup6
+
+	// Tap bound to
+	intf string
+	// VRF the tap is enslaved to, empty otherwise
+	vrf string
+	// Table of the VRF, otherwise the main table
+	routeTable int
+
+	// Server identifier, DUID-LL of the tap
+	duid dhcpv6.Duid
+
+	// Rate limits requests per client and per interface
+	limiter *ratelimit.Limiter
+}
+
+// NewListener6 creates a DHCPv6 listener bound to tap intf. IPv6 host routes
+// are looked up in the table of the VRF the tap is enslaved to, or the main
+// table.
+func NewListener6(intf string) (*Listener6, error) {
+	ifi, err := net.InterfaceByName(intf)
+	if err != nil {
+		return nil, err
+	}
+	if len(ifi.HardwareAddr) == 0 {
+		return nil, fmt.Errorf("%s has no link-layer address to derive a server identifier from", intf)
+	}
+
+	vrf, table, err := getMasterVRF(netns.None(), intf)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := server6.NewIPv6UDPConn(intf, &net.UDPAddr{IP: net.IPv6unspecified, Port: dhcpv6.DefaultServerPort})
+	if err != nil {
+		return nil, err
+	}
+	group := &net.UDPAddr{IP: dhcpv6.AllDHCPRelayAgentsAndServers}
+	if err := ipv6.NewPacketConn(conn).JoinGroup(ifi, group); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot join %s: %v", group.IP, err)
+	}
+
+	return newListener6On(conn, ifi.HardwareAddr, intf, vrf, table), nil
+}
+
+// newListener6On creates a DHCPv6 listener serving tap intf with MAC hwaddr
+// on conn.
+func newListener6On(conn net.PacketConn, hwaddr net.HardwareAddr, intf string, vrf string, table int) *Listener6 {
+	log := ll.NewEntry(ll.StandardLogger()).WithFields(ll.Fields{"interface": intf, "protocol": "dhcpv6"})
+
+	l := &Listener6{
+		conn:       conn,
+		log:        log,
+		intf:       intf,
+		vrf:        vrf,
+		routeTable: table,
+		duid: dhcpv6.Duid{
+			Type:          dhcpv6.DUID_LL,
+			HwType:        iana.HWTypeEthernet,
+			LinkLayerAddr: hwaddr,
+		},
+		limiter: ratelimit.New(),
+	}
+	l.lookup = func(c *config.Config) decision.Lookup6 {
+		return listenerLookup6{l, c.OverrideFilePrefix}
+	}
+	return l
+}
+
+// Info returns a description of the listener.
+func (l *Listener6) Info() ListenerInfo {
+	return ListenerInfo{
+		Interface:  l.intf,
+		VRF:        l.vrf,
+		Source:     l.duid.String(),
+		RouteTable: l.routeTable,
+		Workers:    1,
+		Buckets:    l.limiter.Len(),
+		DHCPv6:     true,
+	}
+}
+
+// Listen starts listening for incoming DHCPv6 messages. There's a single
+// guest behind a tap, so they are handled one at a time.
+func (l *Listener6) Listen() error {
+	l.log.Infof("Listen %s for DHCPv6 as %s", l.conn.LocalAddr(), l.duid.String())
+
+	buf := make([]byte, MaxDatagram)
+	for {
+		n, peer, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			l.log.Errorf("Error reading from connection: %v (this error is expected if a tap was torn down)", err)
+			return err
+		}
+		src, ok := peer.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		l.handleMsg(buf[:n], src)
+	}
+}
+
+func (l *Listener6) Close() error {
+	l.log.Info("Closing Listener")
+	return l.conn.Close()
+}
+
+// handleMsg answers the DHCPv6 message in buf, received from src.
+func (l *Listener6) handleMsg(buf []byte, src *net.UDPAddr) {
+	// Stick to the same configuration for the whole message, even if it gets
+	// reloaded meanwhile
+	c := cfg.Load()
+
+	start := time.Now()
+	defer func() {
+		metrics.HandlingDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	lk := l.lookup(c)
+	ifi, err := lk.InterfaceByName(l.intf)
+	if err != nil {
+		l.log.Errorf("Error getting request interface: %v", err)
+		metrics.Dropped6.WithLabelValues(metrics.DropInterfaceLookup).Inc()
+		return
+	}
+
+	// Relay messages fail to parse here, relayed DHCPv6 isn't served
+	msg, err := dhcpv6.MessageFromBytes(buf)
+	if err != nil {
+		l.log.Errorf("Error parsing DHCPv6 message: %v", err)
+		metrics.Dropped6.WithLabelValues(metrics.DropParseError).Inc()
+		return
+	}
+	mt := msg.MessageType
+	metrics.Received6.WithLabelValues(mt.String()).Inc()
+
+	l.log.Debugf("received %s on %v from %v", mt, ifi.Name, src.IP)
+	l.log.Trace(msg.Summary())
+
+	if err := decision.Accept(c, ifi, &decision.Trace{Log: l.log}); err != nil {
+		logDrop(l.log, metrics.Dropped6, err)
+		return
+	}
+	if err := decision.Accept6(msg, l.duid); err != nil {
+		logDrop(l.log, metrics.Dropped6, err)
+		return
+	}
+
+	// Check the client first, so a single noisy guest doesn't use up the
+	// budget of its interface
+	client := clientID6(msg, src)
+	limits := c.RateLimitsFor(l.vrf)
+	if !l.limiter.Allow(ifi.Name+"/"+client, limits.Client) {
+		l.log.Debugf("Rate limit exceeded by %s on %v, dropping", client, ifi.Name)
+		metrics.Dropped6.WithLabelValues(metrics.DropRateLimited).Inc()
+		return
+	}
+	if !l.limiter.Allow(ifi.Name, limits.Interface) {
+		l.log.Debugf("Rate limit exceeded on %v, dropping", ifi.Name)
+		metrics.Dropped6.WithLabelValues(metrics.DropRateLimited).Inc()
+		return
+	}
+
+	var r *decision.Reply6
+	switch mt {
+	case dhcpv6.MessageTypeRelease:
+		// Nothing to free as addresses are bound to the tap by routing, but
+		// keep a record of the guest letting go of them.
+		ll.Infof("%s of %v from %s on %s", mt, heldAddrs(msg), client, ifi.Name)
+	case dhcpv6.MessageTypeDecline:
+		// The guest detected the addresses as already in use, usually by
+		// duplicate address detection within the VM.
+		ll.Warnf("%s of %v from %s on %s, address might be in use", mt, heldAddrs(msg), client, ifi.Name)
+	default:
+		t := &decision.Trace{Log: l.log}
+		f, err := decision.Gather6(lk, c, ifi, t)
+		if err != nil {
+			logDrop(l.log, metrics.Dropped6, err)
+			return
+		}
+		r, err = decision.Decide6(c, msg, f, t)
+		if err != nil {
+			logDrop(l.log, metrics.Dropped6, err)
+			return
+		}
+	}
+
+	resp, err := l.reply(msg, r)
+	if err != nil {
+		l.log.Errorf("Failed to compile reply: %v", err)
+		metrics.Dropped6.WithLabelValues(metrics.DropReplyError).Inc()
+		return
+	}
+
+	switch {
+	case r == nil:
+		ll.Infof("%s to %s on %s", resp.MessageType, src.IP, ifi.Name)
+	case r.Verdict != decision.Ack:
+		ll.Infof("%s to %s on %s: %s", resp.MessageType, src.IP, ifi.Name, r.Reason)
+	default:
+		ll.Infof("%s to %s on %s with %v, lease %s, fqdn %s", resp.MessageType, src.IP, ifi.Name, r.Addrs, *r.Options.LeaseTime, r.FQDN)
+	}
+	ll.Trace(resp.Summary())
+
+	l.send(resp, src)
+}
+
+// reply compiles the answer to msg as decided in r, which is nil for RELEASE
+// and DECLINE.
+func (l *Listener6) reply(msg *dhcpv6.Message, r *decision.Reply6) (*dhcpv6.Message, error) {
+	mods := []dhcpv6.Modifier{dhcpv6.WithServerID(l.duid)}
+
+	switch msg.MessageType {
+	case dhcpv6.MessageTypeRelease, dhcpv6.MessageTypeDecline:
+		mods = append(mods, dhcpv6.WithOption(&dhcpv6.OptStatusCode{StatusCode: iana.StatusSuccess}))
+		return newReply6(msg, mods...), nil
+	case dhcpv6.MessageTypeConfirm:
+		status := &dhcpv6.OptStatusCode{StatusCode: iana.StatusSuccess}
+		if r.Verdict != decision.Ack {
+			status = &dhcpv6.OptStatusCode{StatusCode: iana.StatusNotOnLink, StatusMessage: r.Reason}
+		}
+		mods = append(mods, dhcpv6.WithOption(status))
+		return newReply6(msg, mods...), nil
+	case dhcpv6.MessageTypeSolicit, dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind:
+		for i, ia := range msg.Options.IANA() {
+			// All addresses go into the first IA_NA
+			var addrs []net.IP
+			if i == 0 {
+				addrs = r.Addrs
+			}
+			// Added rather than updated, as there can be more than one
+			resp := iaNA(ia, addrs, *r.Options.LeaseTime)
+			mods = append(mods, func(d dhcpv6.DHCPv6) { d.AddOption(resp) })
+		}
+	}
+
+	if len(r.DNS) > 0 {
+		mods = append(mods, dhcpv6.WithDNS(r.DNS...))
+	}
+	if len(r.DomainSearch) > 0 {
+		mods = append(mods, dhcpv6.WithDomainSearchList(r.DomainSearch...))
+	}
+	// RFC 4704 4: only clients sending the option get one back
+	if fqdn := msg.Options.FQDN(); fqdn != nil && r.FQDN != "" {
+		flags := uint8(fqdnFlagN)
+		if fqdn.Flags&fqdnFlagS != 0 {
+			flags |= fqdnFlagO
+		}
+		mods = append(mods, dhcpv6.WithFQDN(flags, r.FQDN))
+	}
+
+	if msg.MessageType == dhcpv6.MessageTypeSolicit && msg.GetOneOption(dhcpv6.OptionRapidCommit) == nil {
+		return dhcpv6.NewAdvertiseFromSolicit(msg, mods...)
+	}
+	return newReply6(msg, mods...), nil
+}
+
+// newReply6 creates a REPLY to msg. Unlike dhcpv6.NewReplyFromMessage it
+// answers DECLINE and INFORMATION-REQUEST without client identifier as well.
+func newReply6(msg *dhcpv6.Message, mods ...dhcpv6.Modifier) *dhcpv6.Message {
+	resp := &dhcpv6.Message{
+		MessageType:   dhcpv6.MessageTypeReply,
+		TransactionID: msg.TransactionID,
+	}
+	if cid := msg.GetOneOption(dhcpv6.OptionClientID); cid != nil {
+		resp.AddOption(cid)
+	}
+	if msg.MessageType == dhcpv6.MessageTypeSolicit {
+		dhcpv6.WithRapidCommit(resp)
+	}
+	for _, mod := range mods {
+		mod(resp)
+	}
+	return resp
+}
+
+// iaNA answers IA_NA ia of a client with addrs, valid for lease. Addresses the
+// client holds that aren't ours anymore are returned with lifetimes of zero,
+// so it stops using them (RFC 8415 18.3.4).
+func iaNA(ia *dhcpv6.OptIANA, addrs []net.IP, lease time.Duration) *dhcpv6.OptIANA {
+	resp := &dhcpv6.OptIANA{IaId: ia.IaId}
+
+	for _, ip := range addrs {
+		resp.Options.Add(&dhcpv6.OptIAAddress{IPv6Addr: ip, PreferredLifetime: lease, ValidLifetime: lease})
+	}
+	for _, held := range ia.Options.Addresses() {
+		stale := true
+		for _, ip := range addrs {
+			if ip.Equal(held.IPv6Addr) {
+				stale = false
+				break
+			}
+		}
+		if stale {
+			resp.Options.Add(&dhcpv6.OptIAAddress{IPv6Addr: held.IPv6Addr})
+		}
+	}
+
+	if len(addrs) == 0 {
+		resp.Options.Add(&dhcpv6.OptStatusCode{StatusCode: iana.StatusNoAddrsAvail, StatusMessage: "no addresses available on this link"})
+		return resp
+	}
+
+	// Renew at half and rebind at 80% of the lease, as RFC 8415 21.4
+	// recommends
+	resp.T1 = lease / 2
+	resp.T2 = lease * 4 / 5
+	return resp
+}
+
+// send transmits resp to the client at src.
+func (l *Listener6) send(resp *dhcpv6.Message, src *net.UDPAddr) {
+	peer := &net.UDPAddr{IP: src.IP, Port: dhcpv6.DefaultClientPort, Zone: src.Zone}
+	if _, err := l.conn.WriteTo(resp.ToBytes(), peer); err != nil {
+		ll.Errorf("Write to connection %v failed: %v", peer, err)
+		metrics.Dropped6.WithLabelValues(metrics.DropSendFailure).Inc()
+		return
+	}
+	metrics.Sent6.WithLabelValues(resp.MessageType.String()).Inc()
+}
+
+// clientID6 returns the client identifier of msg in hex, or the address of
+// src for INFORMATION-REQUESTs coming without one.
+func clientID6(msg *dhcpv6.Message, src *net.UDPAddr) string {
+	if cid := msg.Options.ClientID(); cid != nil {
+		return fmt.Sprintf("%x", cid.ToBytes())
+	}
+	return src.IP.String()
+}
+
+// heldAddrs lists the addresses in the IA_NAs of msg.
+func heldAddrs(msg *dhcpv6.Message) string {
+	var addrs []string
+	for _, ia := range msg.Options.IANA() {
+		for _, a := range ia.Options.Addresses() {
+			addrs = append(addrs, a.IPv6Addr.String())
+		}
+	}
+	return "[" + strings.Join(addrs, " ") + "]"
+}
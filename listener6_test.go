@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/linode/dhcpd-unnumbered/config"
+	"github.com/linode/dhcpd-unnumbered/decision"
+	"github.com/linode/dhcpd-unnumbered/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+var clientLL = &net.UDPAddr{IP: net.ParseIP("fe80::200:5eff:fe00:5301"), Port: 546, Zone: "tap.7_0"}
+
+// e2e6 runs a DHCPv6 listener on a fake socket for tap.7_0 (index 7), routed
+// 2001:db8::7.
+type e2e6 struct {
+	t    *testing.T
+	conn *fakePacketConn
+	l    *Listener6
+}
+
+func newE2E6(t *testing.T) *e2e6 {
+	_, pvt, _ := net.ParseCIDR("10.0.0.0/8")
+	cfg.Store(&config.Config{
+		LeaseTime:  time.Hour,
+		TapRegex:   regexp.MustCompile("tap.*_0"),
+		PvtIPs:     pvt,
+		DNS6:       []net.IP{net.ParseIP("2001:db8::53")},
+		Hostname:   "localhost",
+		Domainname: "localdomain",
+	})
+
+	lk := staticLookup{
+		interfaces: map[int]*net.Interface{
+			7: {Index: 7, Name: "tap.7_0", HardwareAddr: tapMAC, Flags: net.FlagUp},
+		},
+		routes6: map[int][]*net.IPNet{
+			7: {{IP: net.ParseIP("2001:db8::7"), Mask: net.CIDRMask(128, 128)}},
+		},
+	}
+
+	e := &e2e6{t: t, conn: newFakePacketConn()}
+	e.l = newListener6On(e.conn, tapMAC, "tap.7_0", "", unix.RT_TABLE_MAIN)
+	e.l.lookup = func(*config.Config) decision.Lookup6 { return lk }
+
+	done := make(chan error)
+	go func() { done <- e.l.Listen() }()
+	t.Cleanup(func() {
+		e.l.Close()
+		assert.ErrorIs(t, <-done, net.ErrClosed)
+	})
+	return e
+}
+
+// exchange sends msg from the client and returns the reply, nil if there is
+// none.
+func (e *e2e6) exchange(msg *dhcpv6.Message) *dhcpv6.Message {
+	e.conn.inject(msg.ToBytes(), clientLL)
+	select {
+	case d := <-e.conn.written:
+		assert.Equal(e.t, clientLL, d.peer, "Bad peer")
+		resp, err := dhcpv6.MessageFromBytes(d.payload)
+		if err != nil {
+			e.t.Fatalf("invalid DHCPv6 payload: %v", err)
+		}
+		assert.Equal(e.t, msg.TransactionID, resp.TransactionID, "Bad transaction ID")
+		return resp
+	case <-time.After(200 * time.Millisecond):
+		return nil
+	}
+}
+
+// followUp returns a message of type mt continuing the exchange of sol with
+// server sid, holding addrs.
+func followUp(mt dhcpv6.MessageType, sol *dhcpv6.Message, sid *dhcpv6.Duid, addrs ...string) *dhcpv6.Message {
+	msg := &dhcpv6.Message{MessageType: mt, TransactionID: dhcpv6.TransactionID{0, 0, byte(mt)}}
+	msg.AddOption(sol.GetOneOption(dhcpv6.OptionClientID))
+	if sid != nil {
+		msg.AddOption(dhcpv6.OptServerID(*sid))
+	}
+	ia := &dhcpv6.OptIANA{IaId: sol.Options.OneIANA().IaId}
+	for _, a := range addrs {
+		ia.Options.Add(&dhcpv6.OptIAAddress{IPv6Addr: net.ParseIP(a), PreferredLifetime: time.Hour, ValidLifetime: time.Hour})
+	}
+	msg.AddOption(ia)
+	return msg
+}
+
+// lifetimes returns the addresses in the IA_NA of resp with their valid
+// lifetimes.
+func lifetimes(resp *dhcpv6.Message) map[string]time.Duration {
+	m := make(map[string]time.Duration)
+	for _, a := range resp.Options.OneIANA().Options.Addresses() {
+		m[a.IPv6Addr.String()] = a.ValidLifetime
+	}
+	return m
+}
+
+func TestListener6(t *testing.T) {
+	e := newE2E6(t)
+	serverID := dhcpv6.Duid{Type: dhcpv6.DUID_LL, HwType: iana.HWTypeEthernet, LinkLayerAddr: tapMAC}
+
+	sol, err := dhcpv6.NewSolicit(clientMAC, dhcpv6.WithFQDN(0x01, "guest"))
+	assert.Nil(t, err)
+	adv := e.exchange(sol)
+	if !assert.NotNil(t, adv, "No ADVERTISE") {
+		return
+	}
+	assert.Equal(t, dhcpv6.MessageTypeAdvertise, adv.MessageType)
+	assert.True(t, serverID.Equal(*adv.Options.ServerID()), "Bad server ID")
+	ia := adv.Options.OneIANA()
+	assert.Equal(t, sol.Options.OneIANA().IaId, ia.IaId)
+	assert.Equal(t, 30*time.Minute, ia.T1)
+	assert.Equal(t, 48*time.Minute, ia.T2)
+	assert.Equal(t, map[string]time.Duration{"2001:db8::7": time.Hour}, lifetimes(adv))
+	assert.Equal(t, []net.IP{net.ParseIP("2001:db8::53")}, adv.Options.DNS())
+	assert.Equal(t, []string{"localdomain"}, adv.Options.DomainSearchList().Labels)
+	// We do no DNS updates and override the client asking us to
+	if fqdn := adv.Options.FQDN(); assert.NotNil(t, fqdn, "No FQDN") {
+		assert.Equal(t, uint8(fqdnFlagN|fqdnFlagO), fqdn.Flags)
+		assert.Equal(t, []string{"localhost.localdomain"}, fqdn.DomainName.Labels)
+	}
+
+	req, err := dhcpv6.NewRequestFromAdvertise(adv)
+	assert.Nil(t, err)
+	rep := e.exchange(req)
+	if assert.NotNil(t, rep, "No REPLY to REQUEST") {
+		assert.Equal(t, dhcpv6.MessageTypeReply, rep.MessageType)
+		assert.Equal(t, map[string]time.Duration{"2001:db8::7": time.Hour}, lifetimes(rep))
+		assert.Nil(t, rep.Options.FQDN(), "FQDN sent unasked")
+	}
+
+	// Addresses no longer routed to the tap are withdrawn
+	rep = e.exchange(followUp(dhcpv6.MessageTypeRenew, sol, &serverID, "2001:db8::7", "2001:db8::99"))
+	if assert.NotNil(t, rep, "No REPLY to RENEW") {
+		assert.Equal(t, map[string]time.Duration{"2001:db8::7": time.Hour, "2001:db8::99": 0}, lifetimes(rep))
+	}
+
+	rep = e.exchange(followUp(dhcpv6.MessageTypeConfirm, sol, nil, "2001:db8::7"))
+	if assert.NotNil(t, rep, "No REPLY to CONFIRM") {
+		assert.Equal(t, iana.StatusSuccess, rep.Options.Status().StatusCode)
+	}
+	rep = e.exchange(followUp(dhcpv6.MessageTypeConfirm, sol, nil, "2001:db8::99"))
+	if assert.NotNil(t, rep, "No REPLY to CONFIRM") {
+		assert.Equal(t, iana.StatusNotOnLink, rep.Options.Status().StatusCode)
+	}
+
+	for _, mt := range []dhcpv6.MessageType{dhcpv6.MessageTypeRelease, dhcpv6.MessageTypeDecline} {
+		rep = e.exchange(followUp(mt, sol, &serverID, "2001:db8::7"))
+		if assert.NotNil(t, rep, "No REPLY to %s", mt) {
+			assert.Equal(t, dhcpv6.MessageTypeReply, rep.MessageType)
+			assert.Equal(t, iana.StatusSuccess, rep.Options.Status().StatusCode)
+		}
+	}
+
+	// Meant for another server
+	other := dhcpv6.Duid{Type: dhcpv6.DUID_LL, HwType: iana.HWTypeEthernet, LinkLayerAddr: clientMAC}
+	assert.Nil(t, e.exchange(followUp(dhcpv6.MessageTypeRequest, sol, &other)), "Replied to REQUEST for another server")
+
+	// Only IAs beyond the first go without addresses
+	twoIAs, err := dhcpv6.NewSolicit(clientMAC, dhcpv6.WithRapidCommit)
+	assert.Nil(t, err)
+	twoIAs.AddOption(&dhcpv6.OptIANA{IaId: [4]byte{0, 0, 0, 2}})
+	rep = e.exchange(twoIAs)
+	if assert.NotNil(t, rep, "No REPLY to rapid commit SOLICIT") {
+		assert.Equal(t, dhcpv6.MessageTypeReply, rep.MessageType)
+		assert.NotNil(t, rep.GetOneOption(dhcpv6.OptionRapidCommit))
+		ias := rep.Options.IANA()
+		if assert.Equal(t, 2, len(ias)) {
+			assert.Equal(t, 1, len(ias[0].Options.Addresses()))
+			assert.Equal(t, iana.StatusNoAddrsAvail, ias[1].Options.Status().StatusCode)
+		}
+	}
+
+	// Statically configured guests only want the options
+	info := &dhcpv6.Message{MessageType: dhcpv6.MessageTypeInformationRequest}
+	rep = e.exchange(info)
+	if assert.NotNil(t, rep, "No REPLY to INFORMATION-REQUEST") {
+		assert.Nil(t, rep.Options.OneIANA())
+		assert.Equal(t, []net.IP{net.ParseIP("2001:db8::53")}, rep.Options.DNS())
+	}
+}
+
+// DHCPv6 traffic is counted apart from DHCPv4
+func TestListener6Metrics(t *testing.T) {
+	e := newE2E6(t)
+	solicit := dhcpv6.MessageTypeSolicit.String()
+	received, received6 := testutil.ToFloat64(metrics.Received.WithLabelValues(solicit)), testutil.ToFloat64(metrics.Received6.WithLabelValues(solicit))
+
+	sol, err := dhcpv6.NewSolicit(clientMAC)
+	assert.Nil(t, err)
+	assert.NotNil(t, e.exchange(sol), "No ADVERTISE")
+
+	assert.Equal(t, received, testutil.ToFloat64(metrics.Received.WithLabelValues(solicit)))
+	assert.Equal(t, received6+1, testutil.ToFloat64(metrics.Received6.WithLabelValues(solicit)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.Sent.WithLabelValues(dhcpv6.MessageTypeAdvertise.String())))
+	assert.Less(t, 0.0, testutil.ToFloat64(metrics.Sent6.WithLabelValues(dhcpv6.MessageTypeAdvertise.String())))
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/linode/dhcpd-unnumbered/boot"
+	"github.com/linode/dhcpd-unnumbered/config"
+	"github.com/linode/dhcpd-unnumbered/decision"
+	"github.com/linode/dhcpd-unnumbered/filter"
+	"github.com/linode/dhcpd-unnumbered/leases"
+	"github.com/linode/dhcpd-unnumbered/options"
+	"github.com/linode/dhcpd-unnumbered/relay"
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	tapMAC    = net.HardwareAddr{0xfe, 0x00, 0x00, 0x00, 0x00, 0x07}
+	clientMAC = net.HardwareAddr{0x00, 0x00, 0x5e, 0x00, 0x53, 0x01}
+	serverIP  = net.IPv4(192, 0, 2, 1).To4()
+)
+
+// staticLookup serves interfaces, host routes and options files from maps.
+type staticLookup struct {
+	interfaces map[int]*net.Interface
+	routes     map[int][]*net.IPNet
+	routes6    map[int][]*net.IPNet
+	options    map[string]*options.DHCP
+	relayMap   *relay.Map
+}
+
+func (lk staticLookup) Interface(index int) (*net.Interface, error) {
+	if ifi, ok := lk.interfaces[index]; ok {
+		return ifi, nil
+	}
+	return nil, errors.New("no such network interface")
+}
+
+func (lk staticLookup) InterfaceByName(name string) (*net.Interface, error) {
+	for _, ifi := range lk.interfaces {
+		if ifi.Name == name {
+			return ifi, nil
+		}
+	}
+	return nil, errors.New("no such network interface")
+}
+
+func (lk staticLookup) RelayInterface(agent *relay.Agent) (string, bool) {
+	if lk.relayMap == nil {
+		return "", false
+	}
+	return lk.relayMap.Lookup(agent)
+}
+
+func (lk staticLookup) Routes(ifindex int) ([]*net.IPNet, string, error) {
+	return lk.routes[ifindex], "table 254", nil
+}
+
+func (lk staticLookup) Routes6(ifindex int) ([]*net.IPNet, string, error) {
+	return lk.routes6[ifindex], "table 254", nil
+}
+
+func (lk staticLookup) Options(ifName string) (*options.DHCP, error) {
+	if opt, ok := lk.options[ifName]; ok {
+		return opt, nil
+	}
+	return &options.DHCP{}, nil
+}
+
+func (lk staticLookup) Hostname(ifName string) (string, string, error) {
+	return "", "", errors.New("no hostname file")
+}
+
+// e2e runs a listener on a fake transport, with tap.7_0 (index 7) routed
+// 203.0.113.7 and 10.0.0.7, eth0 (index 2) routed 198.51.100.2. The options
+// file of Ethernet1_1, a relayed client, has 192.0.2.150/25. Relayed clients
+// are mapped as written to relayMap.
+type e2e struct {
+	t      *testing.T
+	ft     *fakeTransport
+	l      *Listener
+	leases *leases.Table
+	// Where the last reply to a relay agent went
+	lastPeer *net.UDPAddr
+	relayMap string
+}
+
+func newE2E(t *testing.T) *e2e {
+	_, pvt, _ := net.ParseCIDR("10.0.0.0/8")
+	cfg.Store(&config.Config{
+		LeaseTime:  time.Hour,
+		TapRegex:   regexp.MustCompile("tap.*_0"),
+		PvtIPs:     pvt,
+		DNS:        []net.IP{net.IPv4(8, 8, 8, 8).To4(), net.IPv4(8, 8, 4, 4).To4()},
+		Hostname:   "localhost",
+		Domainname: "localdomain",
+	})
+
+	relayMap := filepath.Join(t.TempDir(), "relay.json")
+	lk := staticLookup{
+		relayMap: relay.NewMap(relayMap),
+		interfaces: map[int]*net.Interface{
+			7: {Index: 7, Name: "tap.7_0", HardwareAddr: tapMAC, Flags: net.FlagUp},
+			2: {Index: 2, Name: "eth0", Flags: net.FlagUp},
+		},
+		routes: map[int][]*net.IPNet{
+			7: {
+				{IP: net.IPv4(10, 0, 0, 7).To4(), Mask: net.CIDRMask(32, 32)},
+				{IP: net.IPv4(203, 0, 113, 7).To4(), Mask: net.CIDRMask(32, 32)},
+			},
+			2: {{IP: net.IPv4(198, 51, 100, 2).To4(), Mask: net.CIDRMask(32, 32)}},
+		},
+		options: map[string]*options.DHCP{
+			"Ethernet1_1": {IPv4: []*net.IPNet{{IP: net.IPv4(192, 0, 2, 150).To4(), Mask: net.CIDRMask(25, 32)}}},
+		},
+	}
+
+	e := &e2e{t: t, ft: newFakeTransport(), leases: leases.New(), relayMap: relayMap}
+	e.l = newListenerOn(e.ft, e.ft, netns.None(), "", "", "", unix.RT_TABLE_MAIN)
+	e.l.lookup = func(*config.Config) decision.Lookup { return lk }
+	e.l.SetSource(serverIP)
+	e.l.SetLeases(e.leases)
+	e.l.SetQueue(1, 4, QueueDrop)
+
+	done := make(chan error)
+	go func() { done <- e.l.Listen() }()
+	t.Cleanup(func() {
+		e.l.Close()
+		assert.ErrorIs(t, <-done, net.ErrClosed)
+		e.leases.Close()
+	})
+	return e
+}
+
+// exchange sends req on ifindex and returns the reply frame, nil if there is
+// none.
+func (e *e2e) exchange(req *dhcpv4.DHCPv4, ifindex int) *fakeFrame {
+	e.ft.inject(req.ToBytes(), ifindex)
+	select {
+	case f := <-e.ft.sent:
+		return &f
+	case <-time.After(200 * time.Millisecond):
+		return nil
+	}
+}
+
+// exchangeRelayed sends req as relayed by the agent at src and returns the
+// reply to the agent, nil if there is none.
+func (e *e2e) exchangeRelayed(req *dhcpv4.DHCPv4, src *net.UDPAddr) *dhcpv4.DHCPv4 {
+	e.ft.injectFrom(req.ToBytes(), 2, src)
+	select {
+	case d := <-e.ft.relayed:
+		e.lastPeer = d.peer
+		resp, err := dhcpv4.FromBytes(d.payload)
+		if err != nil {
+			e.t.Fatalf("invalid DHCP payload: %v", err)
+		}
+		return resp
+	case f := <-e.ft.sent:
+		e.t.Fatalf("reply to relayed request sent on interface %d", f.ifindex)
+	case <-time.After(200 * time.Millisecond):
+	}
+	return nil
+}
+
+// reply is a decoded reply frame.
+type reply struct {
+	eth  *layers.Ethernet
+	ip   *layers.IPv4
+	udp  *layers.UDP
+	dhcp *dhcpv4.DHCPv4
+}
+
+func decodeReply(t *testing.T, f *fakeFrame) reply {
+	p := gopacket.NewPacket(f.frame, layers.LayerTypeEthernet, gopacket.Default)
+	assert.Nil(t, p.ErrorLayer(), "undecodable frame")
+
+	r := reply{}
+	r.eth, _ = p.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	r.ip, _ = p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	r.udp, _ = p.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if r.eth == nil || r.ip == nil || r.udp == nil {
+		t.Fatalf("incomplete frame: %v", p)
+	}
+	assert.Equal(t, layers.UDPPort(67), r.udp.SrcPort)
+	assert.Equal(t, layers.UDPPort(68), r.udp.DstPort)
+	assert.Equal(t, int(r.ip.Length), len(r.ip.Contents)+len(r.ip.Payload))
+
+	var err error
+	r.dhcp, err = dhcpv4.FromBytes(r.udp.Payload)
+	if err != nil {
+		t.Fatalf("invalid DHCP payload: %v", err)
+	}
+	return r
+}
+
+func newRequest(t *testing.T, mt dhcpv4.MessageType, mods ...dhcpv4.Modifier) *dhcpv4.DHCPv4 {
+	req, err := dhcpv4.New(append([]dhcpv4.Modifier{dhcpv4.WithMessageType(mt), dhcpv4.WithHwAddr(clientMAC)}, mods...)...)
+	assert.Nil(t, err)
+	return req
+}
+
+func TestListenerDiscoverRequest(t *testing.T) {
+	e := newE2E(t)
+	yourIP := net.IPv4(203, 0, 113, 7).To4()
+
+	discover := newRequest(t, dhcpv4.MessageTypeDiscover)
+	f := e.exchange(discover, 7)
+	if f == nil {
+		t.Fatal("no OFFER")
+	}
+	assert.Equal(t, 7, f.ifindex)
+
+	r := decodeReply(t, f)
+	assert.Equal(t, tapMAC, r.eth.SrcMAC)
+	assert.Equal(t, clientMAC, r.eth.DstMAC)
+	assert.Equal(t, layers.EthernetTypeIPv4, r.eth.EthernetType)
+	// Sent from the gateway, unicast to the address handed out
+	assert.Equal(t, "203.0.113.1", r.ip.SrcIP.String())
+	assert.Equal(t, yourIP, r.ip.DstIP.To4())
+	assert.Equal(t, layers.IPProtocolUDP, r.ip.Protocol)
+
+	offer := r.dhcp
+	assert.Equal(t, dhcpv4.MessageTypeOffer, offer.MessageType())
+	assert.Equal(t, discover.TransactionID, offer.TransactionID)
+	// The private address is skipped
+	assert.Equal(t, yourIP, offer.YourIPAddr.To4())
+	assert.Equal(t, net.IPMask(net.CIDRMask(24, 32)), offer.SubnetMask())
+	assert.Equal(t, []net.IP{net.IPv4(203, 0, 113, 1).To4()}, offer.Router())
+	assert.Equal(t, serverIP, offer.ServerIdentifier().To4())
+	assert.Equal(t, "203.0.113.1", offer.ServerIPAddr.String())
+	assert.Equal(t, time.Hour, offer.IPAddressLeaseTime(0))
+	assert.Equal(t, "localhost", offer.HostName())
+	assert.Equal(t, "localdomain", offer.DomainName())
+	// Mixed by the last octet of the address
+	assert.Equal(t, []net.IP{net.IPv4(8, 8, 4, 4).To4(), net.IPv4(8, 8, 8, 8).To4()}, offer.DNS())
+
+	lease, ok := e.leases.Get(leases.KeyFor("tap.7_0", discover))
+	assert.True(t, ok)
+	assert.Equal(t, leases.Offered, lease.State)
+	assert.Equal(t, yourIP, lease.IP.To4())
+
+	request := newRequest(t, dhcpv4.MessageTypeRequest,
+		dhcpv4.WithTransactionID(offer.TransactionID),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(serverIP)),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(yourIP)),
+	)
+	f = e.exchange(request, 7)
+	if f == nil {
+		t.Fatal("no ACK")
+	}
+	r = decodeReply(t, f)
+	assert.Equal(t, dhcpv4.MessageTypeAck, r.dhcp.MessageType())
+	assert.Equal(t, yourIP, r.dhcp.YourIPAddr.To4())
+	assert.Equal(t, yourIP, r.ip.DstIP.To4())
+
+	lease, ok = e.leases.Get(leases.KeyFor("tap.7_0", request))
+	assert.True(t, ok)
+	assert.Equal(t, leases.Acked, lease.State)
+}
+
+func TestListenerRelease(t *testing.T) {
+	e := newE2E(t)
+	yourIP := net.IPv4(203, 0, 113, 7).To4()
+	otherIP := net.IPv4(10, 0, 0, 7).To4()
+
+	request := newRequest(t, dhcpv4.MessageTypeRequest,
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(serverIP)),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(yourIP)),
+	)
+	key := leases.KeyFor("tap.7_0", request)
+	ack := func() {
+		if e.exchange(request, 7) == nil {
+			t.Fatal("no ACK")
+		}
+		lease, ok := e.leases.Get(key)
+		assert.True(t, ok)
+		assert.Equal(t, serverIP, lease.ServerID.To4())
+	}
+	ack()
+
+	// Addressed to another server or about another address, the lease is
+	// kept
+	for _, req := range []*dhcpv4.DHCPv4{
+		newRequest(t, dhcpv4.MessageTypeRelease, dhcpv4.WithClientIP(yourIP),
+			dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.IPv4(192, 0, 2, 99)))),
+		newRequest(t, dhcpv4.MessageTypeRelease, dhcpv4.WithClientIP(yourIP)),
+		newRequest(t, dhcpv4.MessageTypeRelease, dhcpv4.WithClientIP(otherIP),
+			dhcpv4.WithOption(dhcpv4.OptServerIdentifier(serverIP))),
+		newRequest(t, dhcpv4.MessageTypeDecline,
+			dhcpv4.WithOption(dhcpv4.OptServerIdentifier(serverIP)),
+			dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(otherIP))),
+		// A DECLINE has the address in the requested IP, not ciaddr
+		newRequest(t, dhcpv4.MessageTypeDecline, dhcpv4.WithClientIP(yourIP),
+			dhcpv4.WithOption(dhcpv4.OptServerIdentifier(serverIP))),
+	} {
+		assert.Nil(t, e.exchange(req, 7))
+		_, ok := e.leases.Get(key)
+		assert.True(t, ok, "Lease released by %s", req.Summary())
+	}
+
+	assert.Nil(t, e.exchange(newRequest(t, dhcpv4.MessageTypeRelease, dhcpv4.WithClientIP(yourIP),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(serverIP))), 7))
+	_, ok := e.leases.Get(key)
+	assert.False(t, ok, "Lease not released")
+
+	ack()
+	assert.Nil(t, e.exchange(newRequest(t, dhcpv4.MessageTypeDecline,
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(serverIP)),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(yourIP))), 7))
+	_, ok = e.leases.Get(key)
+	assert.False(t, ok, "Lease not declined")
+}
+
+func TestListenerNak(t *testing.T) {
+	e := newE2E(t)
+
+	request := newRequest(t, dhcpv4.MessageTypeRequest,
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(198, 51, 100, 99))),
+	)
+	f := e.exchange(request, 7)
+	if f == nil {
+		t.Fatal("no NAK")
+	}
+	r := decodeReply(t, f)
+	assert.Equal(t, dhcpv4.MessageTypeNak, r.dhcp.MessageType())
+	assert.Equal(t, net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, r.eth.DstMAC)
+	assert.True(t, r.ip.DstIP.Equal(net.IPv4bcast))
+	assert.Equal(t, "requested address 198.51.100.99 is not available", r.dhcp.Message())
+	assert.True(t, r.dhcp.YourIPAddr.IsUnspecified())
+
+	_, ok := e.leases.Get(leases.KeyFor("tap.7_0", request))
+	assert.False(t, ok)
+}
+
+func TestListenerBroadcast(t *testing.T) {
+	e := newE2E(t)
+
+	f := e.exchange(newRequest(t, dhcpv4.MessageTypeDiscover, dhcpv4.WithBroadcast(true)), 7)
+	if f == nil {
+		t.Fatal("no OFFER")
+	}
+	r := decodeReply(t, f)
+	assert.Equal(t, net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, r.eth.DstMAC)
+	assert.True(t, r.ip.DstIP.Equal(net.IPv4bcast))
+	assert.Equal(t, "203.0.113.7", r.dhcp.YourIPAddr.String())
+}
+
+func TestListenerInform(t *testing.T) {
+	e := newE2E(t)
+	ciaddr := net.IPv4(203, 0, 113, 7).To4()
+
+	f := e.exchange(newRequest(t, dhcpv4.MessageTypeInform, dhcpv4.WithClientIP(ciaddr)), 7)
+	if f == nil {
+		t.Fatal("no ACK")
+	}
+	r := decodeReply(t, f)
+	assert.Equal(t, dhcpv4.MessageTypeAck, r.dhcp.MessageType())
+	// Only configuration, no address or lease
+	assert.True(t, r.dhcp.YourIPAddr.IsUnspecified())
+	assert.False(t, r.dhcp.Options.Has(dhcpv4.OptionIPAddressLeaseTime))
+	assert.Equal(t, ciaddr, r.ip.DstIP.To4())
+	assert.Equal(t, clientMAC, r.eth.DstMAC)
+	assert.Equal(t, "localhost", r.dhcp.HostName())
+	assert.Empty(t, e.leases.List())
+}
+
+func TestListenerDrops(t *testing.T) {
+	e := newE2E(t)
+	discover := newRequest(t, dhcpv4.MessageTypeDiscover)
+
+	// Not matching the regex
+	assert.Nil(t, e.exchange(discover, 2))
+	// Unknown interface
+	assert.Nil(t, e.exchange(discover, 99))
+	// Not DHCP at all
+	e.ft.inject([]byte("hello"), 7)
+	// A reply rather than a request
+	offer, err := dhcpv4.NewReplyFromRequest(discover, dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer))
+	assert.Nil(t, err)
+	assert.Nil(t, e.exchange(offer, 7))
+	// Released, nothing to answer
+	assert.Nil(t, e.exchange(newRequest(t, dhcpv4.MessageTypeRelease), 7))
+
+	// Still answering
+	assert.NotNil(t, e.exchange(discover, 7))
+}
+
+func TestListenerBootProfile(t *testing.T) {
+	e := newE2E(t)
+	c := *cfg.Load()
+	var err error
+	c.BootProfiles, err = boot.ParseProfiles([]boot.ProfileJSON{
+		{Name: "uefi", Arch: []uint16{7}, Bootfile: "ipxe.efi", NextServer: "192.0.2.69", Tftp: "192.0.2.69"},
+	})
+	assert.Nil(t, err)
+	cfg.Store(&c)
+
+	f := e.exchange(newRequest(t, dhcpv4.MessageTypeDiscover, dhcpv4.WithOption(dhcpv4.OptClientArch(iana.EFI_X86_64))), 7)
+	if f == nil {
+		t.Fatal("no OFFER")
+	}
+	r := decodeReply(t, f)
+	assert.Equal(t, "192.0.2.69", r.dhcp.ServerIPAddr.String())
+	assert.Equal(t, "ipxe.efi", r.dhcp.BootFileNameOption())
+	assert.Equal(t, "192.0.2.69", r.dhcp.TFTPServerName())
+	assert.Equal(t, "ipxe.efi", r.dhcp.BootFileName)
+	assert.Equal(t, "192.0.2.69", r.dhcp.ServerHostName)
+
+	// Legacy ROMs only look at the header
+	c.BootDelivery = boot.DeliverHeader
+	cfg.Store(&c)
+	f = e.exchange(newRequest(t, dhcpv4.MessageTypeDiscover, dhcpv4.WithOption(dhcpv4.OptClientArch(iana.EFI_X86_64))), 7)
+	if f == nil {
+		t.Fatal("no OFFER")
+	}
+	r = decodeReply(t, f)
+	assert.Equal(t, "ipxe.efi", r.dhcp.BootFileName)
+	assert.Equal(t, "192.0.2.69", r.dhcp.ServerHostName)
+	assert.False(t, r.dhcp.Options.Has(dhcpv4.OptionBootfileName))
+	assert.False(t, r.dhcp.Options.Has(dhcpv4.OptionTFTPServerName))
+
+	// Other clients are left alone
+	f = e.exchange(newRequest(t, dhcpv4.MessageTypeDiscover), 7)
+	if f == nil {
+		t.Fatal("no OFFER")
+	}
+	r = decodeReply(t, f)
+	assert.Equal(t, "203.0.113.1", r.dhcp.ServerIPAddr.String())
+	assert.False(t, r.dhcp.Options.Has(dhcpv4.OptionBootfileName))
+	assert.False(t, r.dhcp.Options.Has(dhcpv4.OptionTFTPServerName))
+}
+
+func TestListenerInterfaceFilter(t *testing.T) {
+	e := newE2E(t)
+
+	assert.Nil(t, e.l.SetInterfaceFilter([]int{7}))
+	want, err := filter.ProgramForInterfaces([]int{7})
+	assert.Nil(t, err)
+	assert.Equal(t, want, e.ft.filter)
+
+	assert.Nil(t, e.l.SetInterfaceFilter(nil))
+	want, err = filter.Program()
+	assert.Nil(t, err)
+	assert.Equal(t, want, e.ft.filter)
+}
+
+func TestListenerRelay(t *testing.T) {
+	e := newE2E(t)
+	c := *cfg.Load()
+	c.HostnameOverride = true
+	_, trusted, _ := net.ParseCIDR("198.51.100.0/24")
+	c.RelayAgents = []*net.IPNet{trusted}
+	cfg.Store(&c)
+
+	giaddr := net.IPv4(192, 0, 2, 129).To4()
+	agent := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 10), Port: 67}
+	relayed := func(mt dhcpv4.MessageType, subs ...dhcpv4.Option) *dhcpv4.DHCPv4 {
+		return newRequest(t, mt,
+			dhcpv4.WithGatewayIP(giaddr),
+			dhcpv4.WithOption(dhcpv4.OptRelayAgentInfo(subs...)),
+		)
+	}
+	circuitID := dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte("Ethernet1/1"))
+
+	// Addresses from the options file of the client identity
+	discover := relayed(dhcpv4.MessageTypeDiscover, circuitID)
+	offer := e.exchangeRelayed(discover, agent)
+	if offer == nil {
+		t.Fatal("no OFFER")
+	}
+	assert.Equal(t, "192.0.2.129:67", e.lastPeer.String())
+	assert.Equal(t, dhcpv4.MessageTypeOffer, offer.MessageType())
+	assert.Equal(t, "192.0.2.150", offer.YourIPAddr.String())
+	assert.Equal(t, net.IPMask(net.CIDRMask(25, 32)), offer.SubnetMask())
+	assert.Equal(t, giaddr, offer.GatewayIPAddr.To4())
+	assert.Equal(t, []net.IP{giaddr}, offer.Router())
+	assert.Equal(t, discover.Options.Get(dhcpv4.OptionRelayAgentInformation), offer.Options.Get(dhcpv4.OptionRelayAgentInformation))
+
+	_, ok := e.leases.Get(leases.KeyFor("Ethernet1_1", discover))
+	assert.True(t, ok)
+
+	// Host routes of a local interface named after it
+	offer = e.exchangeRelayed(relayed(dhcpv4.MessageTypeDiscover, dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte("tap.7_0"))), agent)
+	if offer == nil {
+		t.Fatal("no OFFER")
+	}
+	assert.Equal(t, "203.0.113.7", offer.YourIPAddr.String())
+
+	// RFC 8357, back to the port the agent sent from
+	offer = e.exchangeRelayed(relayed(dhcpv4.MessageTypeDiscover, circuitID, dhcpv4.OptGeneric(dhcpv4.RelaySourcePortSubOption, nil)), &net.UDPAddr{IP: agent.IP, Port: 10067})
+	if offer == nil {
+		t.Fatal("no OFFER")
+	}
+	assert.Equal(t, "192.0.2.129:10067", e.lastPeer.String())
+
+	// A NAK is broadcast by the agent
+	request := relayed(dhcpv4.MessageTypeRequest, circuitID)
+	request.UpdateOption(dhcpv4.OptRequestedIPAddress(net.IPv4(198, 51, 100, 99)))
+	nak := e.exchangeRelayed(request, agent)
+	if nak == nil {
+		t.Fatal("no NAK")
+	}
+	assert.Equal(t, dhcpv4.MessageTypeNak, nak.MessageType())
+	assert.True(t, nak.IsBroadcast())
+	assert.Equal(t, "192.0.2.129:67", e.lastPeer.String())
+
+	// Not from a trusted agent
+	assert.Nil(t, e.exchangeRelayed(discover, &net.UDPAddr{IP: net.IPv4(203, 0, 113, 10), Port: 67}))
+	// No identity
+	assert.Nil(t, e.exchangeRelayed(relayed(dhcpv4.MessageTypeDiscover), agent))
+	// Unknown identity without options file
+	assert.Nil(t, e.exchangeRelayed(relayed(dhcpv4.MessageTypeDiscover, dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte("swp9"))), agent))
+}
+
+func TestListenerRelayMap(t *testing.T) {
+	e := newE2E(t)
+	c := *cfg.Load()
+	c.HostnameOverride = true
+	_, trusted, _ := net.ParseCIDR("198.51.100.0/24")
+	c.RelayAgents = []*net.IPNet{trusted}
+	cfg.Store(&c)
+
+	err := os.WriteFile(e.relayMap, []byte(`[
+  {"circuit-id": "swp3", "remote-id": "tor2", "interface": "Ethernet1_1"},
+  {"remote-id": "tor3", "interface": "tap.7_0"}
+]`), 0644)
+	assert.Nil(t, err)
+
+	agent := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 10), Port: 67}
+	relayed := func(subs ...dhcpv4.Option) *dhcpv4.DHCPv4 {
+		return newRequest(t, dhcpv4.MessageTypeDiscover,
+			dhcpv4.WithGatewayIP(net.IPv4(192, 0, 2, 129)),
+			dhcpv4.WithOption(dhcpv4.OptRelayAgentInfo(subs...)),
+		)
+	}
+	circuitID := func(id string) dhcpv4.Option {
+		return dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte(id))
+	}
+	remoteID := func(id string) dhcpv4.Option {
+		return dhcpv4.OptGeneric(dhcpv4.AgentRemoteIDSubOption, []byte(id))
+	}
+
+	// Options file of the interface mapped to
+	discover := relayed(circuitID("swp3"), remoteID("tor2"))
+	offer := e.exchangeRelayed(discover, agent)
+	if offer == nil {
+		t.Fatal("no OFFER")
+	}
+	assert.Equal(t, "192.0.2.150", offer.YourIPAddr.String())
+	_, ok := e.leases.Get(leases.KeyFor("Ethernet1_1", discover))
+	assert.True(t, ok)
+
+	// Host routes of the interface mapped to
+	offer = e.exchangeRelayed(relayed(circuitID("swp3"), remoteID("tor3")), agent)
+	if offer == nil {
+		t.Fatal("no OFFER")
+	}
+	assert.Equal(t, "203.0.113.7", offer.YourIPAddr.String())
+
+	// Not mapped, named after the circuit-id
+	assert.Nil(t, e.exchangeRelayed(relayed(circuitID("swp3"), remoteID("tor1")), agent))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/linode/dhcpd-unnumbered/config"
+	"github.com/linode/dhcpd-unnumbered/decision"
+	"github.com/linode/dhcpd-unnumbered/leases"
+	"github.com/linode/dhcpd-unnumbered/options"
+	"github.com/linode/dhcpd-unnumbered/relay"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// listenerLookup implements decision.Lookup in the namespace and routing table
+// of a listener.
+type listenerLookup struct {
+	l *Listener
+	// Where hostname and options override files live
+	prefix string
+}
+
+func (lk listenerLookup) Interface(index int) (*net.Interface, error) {
+	var ifi *net.Interface
+	err := inNetns(lk.l.ns, func() (err error) {
+		ifi, err = net.InterfaceByIndex(index)
+		return err
+	})
+	return ifi, err
+}
+
+func (lk listenerLookup) InterfaceByName(name string) (*net.Interface, error) {
+	var ifi *net.Interface
+	err := inNetns(lk.l.ns, func() (err error) {
+		ifi, err = net.InterfaceByName(name)
+		return err
+	})
+	return ifi, err
+}
+
+func (lk listenerLookup) RelayInterface(agent *relay.Agent) (string, bool) {
+	if lk.l.relayMap == nil {
+		return "", false
+	}
+	return lk.l.relayMap.Lookup(agent)
+}
+
+func (lk listenerLookup) Routes(ifindex int) ([]*net.IPNet, string, error) {
+	if rts, ok := lk.l.cachedRoutes(ifindex); ok {
+		return rts, fmt.Sprintf("cache of table %d", lk.l.routeTable), nil
+	}
+	rts, err := getTableRoutes(lk.l.ns, ifindex, lk.l.routeTable)
+	if err != nil {
+		return nil, "", fmt.Errorf("table %d: %v", lk.l.routeTable, err)
+	}
+	return rts, fmt.Sprintf("table %d", lk.l.routeTable), nil
+}
+
+func (lk listenerLookup) Options(ifName string) (*options.DHCP, error) {
+	return getOptionsOverride(lk.l.log, lk.prefix, overrideName(lk.l.nsName, ifName))
+}
+
+func (lk listenerLookup) Hostname(ifName string) (string, string, error) {
+	return getHostnameOverride(lk.prefix, overrideName(lk.l.nsName, ifName))
+}
+
+// decide gathers the facts about ifi through lk and about the client with
+// lease key, and works out the reply to req. Returns a *decision.DropError if
+// there is no reply.
+func (l *Listener) decide(c *config.Config, lk decision.Lookup, ifi *net.Interface, req *dhcpv4.DHCPv4, key leases.Key, t *decision.Trace) (*decision.Reply, error) {
+	f, err := decision.Gather(lk, c, ifi, t)
+	if err != nil {
+		return nil, err
+	}
+	f.ServerIP = l.sIP
+	if lease, ok := l.lease(key); ok {
+		f.Lease = lease.IP
+	}
+	return decision.Decide(c, req, f, t)
+}
+
+// listenerLookup6 implements decision.Lookup6 in the routing table of a DHCPv6
+// listener. The route cache only holds IPv4 routes, so routes are always read
+// from the table.
+type listenerLookup6 struct {
+	l *Listener6
+	// Where hostname and options override files live
+	prefix string
+}
+
+func (lk listenerLookup6) InterfaceByName(name string) (*net.Interface, error) {
+	return net.InterfaceByName(name)
+}
+
+func (lk listenerLookup6) Routes6(ifindex int) ([]*net.IPNet, string, error) {
+	rts, err := getHostRoutes(netns.None(), unix.AF_INET6, ifindex, lk.l.routeTable)
+	if err != nil {
+		return nil, "", fmt.Errorf("table %d: %v", lk.l.routeTable, err)
+	}
+	return rts, fmt.Sprintf("table %d", lk.l.routeTable), nil
+}
+
+func (lk listenerLookup6) Options(ifName string) (*options.DHCP, error) {
+	return getOptionsOverride(lk.l.log, lk.prefix, ifName)
+}
+
+func (lk listenerLookup6) Hostname(ifName string) (string, string, error) {
+	return getHostnameOverride(lk.prefix, ifName)
+}
@@ -5,34 +5,121 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/linode/dhcpd-unnumbered/boot"
+	"github.com/linode/dhcpd-unnumbered/config"
+	"github.com/linode/dhcpd-unnumbered/leases"
+	"github.com/linode/dhcpd-unnumbered/metrics"
 	"github.com/linode/dhcpd-unnumbered/monitor"
+	"github.com/linode/dhcpd-unnumbered/relay"
+	"github.com/linode/dhcpd-unnumbered/routes"
+	"github.com/prometheus/client_golang/prometheus"
 	ll "github.com/sirupsen/logrus"
 )
 
 const (
 	// MaxDatagram is the maximum length of message that can be received.
-	MaxDatagram = 1 << 16
+	// Clients don't fragment DHCP messages, so they are bound by the MTU in
+	// practice. Larger messages are truncated and fail to parse.
+	MaxDatagram = 1 << 12
+
+	// DefaultWorkers is the default number of workers per listener.
+	DefaultWorkers = 16
+	// DefaultQueueSize is the default number of requests queued per listener.
+	DefaultQueueSize = 256
 )
 
 var (
-	regex  *regexp.Regexp
-	pvtIPs *net.IPNet
+	// The current configuration, replaced as a whole on reload
+	cfg atomic.Pointer[config.Config]
+
+	// Flags given on the command line, these win over the config file
+	pinnedFlags = make(map[string]bool)
+
 	myDNS  listIP
-	tftp   net.IP
+	myDNS6 listIP
+
+	flagClientRate     = flag.Float64("client-rate", 0, "requests per second allowed per interface and MAC. 0 disables the limit")
+	flagClientBurst    = flag.Int("client-burst", 5, "burst of requests allowed per interface and MAC")
+	flagInterfaceRate  = flag.Float64("interface-rate", 0, "requests per second allowed per interface. 0 disables the limit")
+	flagInterfaceBurst = flag.Int("interface-burst", 20, "burst of requests allowed per interface")
+
+	flagRouteCache = flag.Bool(
+		"route-cache",
+		true,
+		"cache host routes and keep them current through netlink notifications, instead of dumping the routing table per request",
+	)
+
+	flagWorkers     = flag.Int("workers", DefaultWorkers, "number of workers handling requests, per listener")
+	flagQueueSize   = flag.Int("queue", DefaultQueueSize, "number of requests queued for the workers, per listener")
+	flagQueuePolicy = flag.String(
+		"queue-policy",
+		"drop",
+		"what to do with requests when the queue is full. one of drop (drop the request) or block (stop reading from the socket, the kernel drops once its buffer is full)",
+	)
+
+	queuePolicies = map[string]QueuePolicy{
+		"drop":  QueueDrop,
+		"block": QueueBlock,
+	}
+
+	flagNetnsRegex = flag.String(
+		"netns",
+		"",
+		"additionally serve taps in the named network namespaces matching regex, i.e. ^tenant-. disabled if empty",
+	)
+	flagNetnsDir = flag.String("netns-dir", monitor.DefaultNetnsDir, "directory of named network namespaces")
 
-	flagLeaseTime = flag.Duration("leasetime", (30 * time.Minute), "DHCP lease time.")
-	flagTapRegex  = flag.String("regex", "tap.*_0", "regex to match interfaces.")
-	flagVrfRegex  = flag.String("bind", "", "additionally bind VRF interfaces matching regex.")
-	flagPvtIPs    = flag.String(
+	flagControl = flag.String(
+		"control",
+		"",
+		"unix socket to serve control commands on, see `dhcpd-unnumbered ctl help`. disabled if empty",
+	)
+
+	flagMetrics = flag.String("metrics", "", "address to serve prometheus metrics on, i.e. :9167. disabled if empty")
+	flagConfig  = flag.String(
+		"config",
+		"",
+		"JSON config file, keys are named after command line flags. flags given on the command line take precedence. reloaded on SIGHUP",
+	)
+	flagLeaseTime     = flag.Duration("leasetime", (30 * time.Minute), "DHCP lease time.")
+	flagTapRegex      = flag.String("regex", "tap.*_0", "regex to match interfaces.")
+	flagVrfRegex      = flag.String("bind", "", "additionally bind VRF interfaces matching regex.")
+	flagBPFInterfaces = flag.Bool(
+		"bpf-interfaces",
+		false,
+		"only let requests from interfaces matching -regex through the socket filter, kept current as interfaces come and go. has no effect with -bind-taps",
+	)
+	flagBindTaps = flag.Bool(
+		"bind-taps",
+		false,
+		"bind a socket to each interface matching -regex as it comes up, instead of a single socket across interfaces. taps enslaved to a VRF are looked up in its table. can't be combined with -bind",
+	)
+	flagDHCPv6 = flag.Bool(
+		"dhcpv6",
+		false,
+		"additionally serve DHCPv6 on each interface matching -regex as it comes up, handing out its IPv6 host routes. taps enslaved to a VRF are looked up in its table",
+	)
+	flagPvtIPs = flag.String(
 		"pvtcidr",
 		"192.168.0.0/16",
 		"private IP range. IPs in this range don't quallify for initial DHCP offeres, even if assigned to requesting tap",
 	)
+	flagLeaseFile = flag.String(
+		"lease-file",
+		"",
+		"journal leases are recorded in and restored from on restart. defaults to leases.journal in the directory of -override-file-prefix, none disables it",
+	)
 	flagDynHost          = flag.Bool("dynamic-hostname", false, "dynamic hostname generated from {IP/./-}.domainname")
 	flagHostnameOverride = flag.Bool(
 		"hostname-override",
@@ -49,8 +136,34 @@ var (
 		"localhost",
 		"static hostname to be handed out in dhcp offeres, is ignored if dynamic-hostname is enabled",
 	)
-	flagDomainname = flag.String("domainname", "localdomain", "domainname to be handed out in dhcp offeres")
-	flagBootfile   = flag.String("bootfile", "", "boot file to offer in DHCP replies")
+	flagDomainname   = flag.String("domainname", "localdomain", "domainname to be handed out in dhcp offeres")
+	flagBootfile     = flag.String("bootfile", "", "boot file to offer in DHCP replies")
+	flagTftpIP       = flag.String("tftp", "", "tftp srv to offer in DHCP replies")
+	flagBootDelivery = flag.String(
+		"boot-delivery",
+		"both",
+		"where to put tftp server and bootfile: header (siaddr, sname and file fields), options (66 and 67) or both",
+	)
+	flagClassless = flag.Bool(
+		"classless",
+		false,
+		"offer a /32 and reach the gateway through RFC 3442 classless static routes (option 121 and 249) instead of a fake /24",
+	)
+	flagClasslessGateway = flag.String(
+		"classless-gateway",
+		"",
+		"gateway to route through in classless mode. defaults to the source IP taken from lo, or 169.254.0.1 if there is none",
+	)
+	flagRelayAgents = flag.String(
+		"relay-agents",
+		"",
+		"comma separated addresses or CIDRs of DHCP relay agents to serve relayed requests from. relayed requests are dropped if empty",
+	)
+	flagRelayMap = flag.String(
+		"relay-map",
+		"",
+		"JSON file mapping circuit-id and remote-id of relayed clients to interface names, read again when changed. relayed clients are named after their circuit-id if not mapped",
+	)
 
 	logLevels = map[string]func(){
 		"none":    func() { ll.SetOutput(io.Discard) },
@@ -65,9 +178,30 @@ var (
 
 func main() {
 	flagLogLevel := flag.String("loglevel", "info", fmt.Sprintf("Log level. One of %v", getLogLevels()))
-	flagTftpIP := flag.String("tftp", "", "tftp srv to offer in DHCP replies")
 	flag.Var(&myDNS, "dns", "dns server to use in DHCP offer, option can be used multiple times for more than 1 server")
+	flag.Var(&myDNS6, "dns6", "IPv6 dns server to hand out over DHCPv6, option can be used multiple times for more than 1 server")
 	flag.Parse()
+	flag.Visit(func(f *flag.Flag) { pinnedFlags[f.Name] = true })
+
+	// Talk to the running daemon instead of becoming one
+	if flag.Arg(0) == "ctl" {
+		if err := runCtl(*flagControl, flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.Arg(0) == "explain" {
+		// Keep the output to the steps
+		if !pinnedFlags["loglevel"] {
+			ll.SetLevel(ll.WarnLevel)
+		}
+		if err := explain(os.Stdout, flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	ll.SetFormatter(&ll.TextFormatter{
 		FullTimestamp: true,
@@ -82,70 +216,183 @@ func main() {
 
 	ll.Infof("Setting log level to '%s'", ll.GetLevel())
 
-	if *flagDynHost {
-		ll.Infof("Dynamic hostnames based on IP enabled")
+	queuePolicy, ok := queuePolicies[*flagQueuePolicy]
+	if !ok {
+		ll.Fatalf("Invalid queue policy '%s'", *flagQueuePolicy)
 	}
-
-	if *flagHostnameOverride {
-		ll.Infof("Hostname override enabled from %s", *flagHostnamePath)
+	if *flagBindTaps && *flagVrfRegex != "" {
+		// VRF listeners would see the requests of enslaved taps as well
+		ll.Fatalf("-bind-taps can't be combined with -bind")
 	}
-
-	var err error
-	regex, err = regexp.Compile(*flagTapRegex)
-	if err != nil {
-		ll.Fatalf("unable to parse interface regex: %v", err)
+	if *flagWorkers < 1 || *flagQueueSize < 0 {
+		ll.Fatalf("Invalid worker pool of %d workers and a queue of %d", *flagWorkers, *flagQueueSize)
 	}
-	ll.Infof("Handling Interfaces matching '%s'", regex.String())
 
-	tftp = net.ParseIP(*flagTftpIP)
-	if tftp != nil {
-		ll.Infof("using %s as tftp", tftp)
+	c, err := loadConfig()
+	if err == nil {
+		err = checkRelayAgents(c)
 	}
-
-	_, pvtIPs, err = net.ParseCIDR(*flagPvtIPs)
 	if err != nil {
-		ll.Fatalf("unable to parse private IP range: %v", err)
+		ll.Fatalf("invalid configuration: %v", err)
 	}
-	ll.Infof("ignoring private IPs from %v", pvtIPs)
-
-	if len(myDNS) == 0 {
-		err := myDNS.Set("8.8.8.8")
-		if err != nil {
-			ll.Fatalln("failed to set default DNS server")
-		}
-		ll.Infof("no DNS provided, using defaults")
-	}
-	ll.Infof("using DNS %v", myDNS)
+	cfg.Store(c)
+	logConfig(c)
 
 	sIP, err := getSourceIP()
 	if err != nil {
 		ll.Fatalf("unable to get source IP to be used: %v", err)
 	}
 
+	// Reload the config file on SIGHUP. An invalid file is rejected and the
+	// current configuration stays in place.
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			ll.Infof("SIGHUP received, reloading configuration")
+			c, err := loadConfig()
+			if err == nil {
+				err = checkReload(cfg.Load(), c)
+			}
+			if err != nil {
+				ll.Errorf("Failed to reload configuration, keeping the current one: %v", err)
+				continue
+			}
+			cfg.Store(c)
+			logConfig(c)
+		}
+	}()
+
+	if *flagMetrics != "" {
+		ll.Infof("Serving metrics on %s", *flagMetrics)
+		go func() {
+			if err := metrics.Listen(*flagMetrics); err != nil {
+				ll.Fatalf("Metrics listener unexpected exit: %s", err)
+			}
+		}()
+	}
+
 	// start server
 
 	wg := sync.WaitGroup{}
 
-	// Listen across interfaces with a single socket
-	s, err := NewListener("")
-	if err != nil {
-		ll.Errorf("new instance of DHCP listener couldn't be created: %v", err)
+	var routeCache *routes.Cache
+	if *flagRouteCache {
+		routeCache = routes.NewCache()
+		go func() {
+			if err := routeCache.Run(); err != nil {
+				ll.Fatalf("Route cache unexpected exit: %s", err)
+			}
+		}()
 	}
-	s.SetSource(sIP)
-	wg.Add(1)
+
+	leaseTable := leases.New()
+	var journal *leases.Journal
+	if path := leaseFile(); path != "" {
+		j, restored, err := leases.OpenJournal(path)
+		if err != nil {
+			if pinnedFlags["lease-file"] {
+				ll.Fatalf("Unable to open lease journal: %v", err)
+			}
+			ll.Warnf("Unable to open lease journal, leases won't persist: %v", err)
+		} else {
+			journal = j
+			leaseTable.Restore(restored)
+			leaseTable.SetJournal(journal)
+			ll.Infof("Recording leases in %s, restored %d", path, len(leaseTable.List()))
+		}
+	}
+	go leaseTable.Run()
+
+	// The journal is written in the background, so write what's queued
+	// before exiting
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGTERM, syscall.SIGINT)
 	go func() {
-		if err := s.Listen(); err != nil {
-			ll.Fatalf("Unexpected server exit: %s", err)
+		sig := <-shutdown
+		ll.Infof("%v received, exiting", sig)
+		leaseTable.Close()
+		if journal != nil {
+			if err := journal.Close(); err != nil {
+				ll.Errorf("Failed to close lease journal: %v", err)
+			}
 		}
-		wg.Done()
+		os.Exit(0)
 	}()
 
+	if *flagControl != "" {
+		ctl := newControlServer(*flagControl, leaseTable)
+		go func() {
+			if err := ctl.Listen(); err != nil {
+				ll.Errorf("Control socket unexpected exit: %s", err)
+			}
+		}()
+	}
+
+	relayMap := newRelayMap()
+
+	// Wraps a listener constructor, so all listeners are set up the same way
+	newServer := func(newListener func(string) (*Listener, error)) func(string) (*Listener, error) {
+		return func(intf string) (*Listener, error) {
+			s, err := newListener(intf)
+			if err != nil {
+				return nil, err
+			}
+			s.SetSource(sIP)
+			s.SetQueue(*flagWorkers, *flagQueueSize, queuePolicy)
+			s.SetRouteCache(routeCache)
+			s.SetLeases(leaseTable)
+			s.SetRelayMap(relayMap)
+			return s, nil
+		}
+	}
+
+	if *flagBindTaps {
+		// Bind a socket to each tap instead of listening across interfaces,
+		// so requests from other interfaces never reach us
+		ll.Infof("Will bind taps matching %s", c.TapRegex)
+		linkch := make(chan monitor.Event, 5)
+		mon := monitor.NewNetlinkMonitor(linkch, c.TapRegex)
+		active.addMonitor("taps", mon)
+
+		go func() {
+			if err := mon.Listen(); err != nil {
+				ll.Fatalf("Netlink monitor unexpected exit: %s", err)
+			}
+		}()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveLinks("tap", linkch, newServer(NewTapListener), metrics.TapListeners)
+		}()
+	} else {
+		// Listen across interfaces with a single socket
+		s, err := newServer(NewListener)("")
+		if err != nil {
+			ll.Fatalf("new instance of DHCP listener couldn't be created: %v", err)
+		}
+		active.addListener("wildcard", s)
+		if *flagBPFInterfaces {
+			ll.Infof("Will only accept requests from interfaces matching %s", c.TapRegex)
+			go filterInterfaces(s, c.TapRegex)
+		}
+		wg.Add(1)
+		go func() {
+			if err := s.Listen(); err != nil {
+				ll.Fatalf("Unexpected server exit: %s", err)
+			}
+			wg.Done()
+		}()
+	}
+
 	// Dynamically bind interfaces matching flagBindRegex if set
 	if *flagVrfRegex != "" {
 		ll.Infof("Will also bind VRFs matching %s", *flagVrfRegex)
 		regex := regexp.MustCompile(*flagVrfRegex)
 		linkch := make(chan monitor.Event, 5)
 		mon := monitor.NewNetlinkMonitor(linkch, regex)
+		active.addMonitor("vrfs", mon)
 
 		// Start monitor
 		go func() {
@@ -160,49 +407,270 @@ func main() {
 		// Watch for events and generate listeners
 		go func() {
 			defer wg.Done()
-			listeners := make(map[string]*Listener)
+			serveLinks("vrf", linkch, newServer(NewListener), metrics.VRFListeners)
+		}()
+	}
 
-			for {
-				event, ok := <-linkch
-				if !ok {
-					ll.Info("Monitor channel closed")
-					break
-				}
-				switch event.Type {
-				case monitor.LinkUp:
-					s, err := NewListener(event.Interface)
-					if err != nil {
-						if errors.Is(err, ErrNotVRF) {
-							// Just in case the regex matches an interface
-							// that's not a VRF, handle it gracefully.
-							ll.Infof("Won't bind %s as it's not a VRF", event.Interface)
-						} else {
-							ll.Warningf("Failed to bind %s: %v", event.Interface, err)
-						}
-						// Add a sentinel to avoid warning when the interface disappears
-						listeners[event.Interface] = nil
-						continue
-					}
-					s.SetSource(sIP)
-					listeners[event.Interface] = s
-					go s.Listen()
-				case monitor.LinkDown:
-					s, ok := listeners[event.Interface]
-					if !ok {
-						// This should not be possible
-						ll.Warningf("Interface %s without listener doing down", event.Interface)
-						continue
-					}
-					delete(listeners, event.Interface)
-					if s != nil {
-						s.Close()
-					}
-				}
+	// Serve DHCPv6 on taps matching the regex if enabled
+	if *flagDHCPv6 {
+		ll.Infof("Will serve DHCPv6 on taps matching %s", c.TapRegex)
+		linkch := make(chan monitor.Event, 5)
+		mon := monitor.NewNetlinkMonitor(linkch, c.TapRegex)
+		active.addMonitor("dhcpv6", mon)
+
+		go func() {
+			if err := mon.Listen(); err != nil {
+				ll.Fatalf("Netlink monitor unexpected exit: %s", err)
 			}
-			mon.Close()
+		}()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveLinks("dhcpv6", linkch, NewListener6, metrics.DHCPv6Listeners)
+		}()
+	}
+
+	// Serve namespaces matching flagNetnsRegex if set
+	if *flagNetnsRegex != "" {
+		ll.Infof("Will also serve namespaces in %s matching %s", *flagNetnsDir, *flagNetnsRegex)
+		regex := regexp.MustCompile(*flagNetnsRegex)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveNetns(*flagNetnsDir, regex, queuePolicy, leaseTable, relayMap)
 		}()
 	}
 
 	wg.Wait()
 	ll.Info("closing...")
 }
+
+// linkListener is a listener bound to a single interface.
+type linkListener interface {
+	inspectable
+	Listen() error
+	Close() error
+}
+
+// serveLinks creates a listener with newListener for each interface coming up
+// on linkch and closes it once the interface goes down. The listeners are
+// registered as <kind>/<interface>. Blocks until the channel is closed.
+func serveLinks[L linkListener](kind string, linkch chan monitor.Event, newListener func(string) (L, error), gauge prometheus.Gauge) {
+	listeners := make(map[string]linkListener)
+
+	for event := range linkch {
+		switch event.Type {
+		case monitor.LinkUp:
+			s, err := newListener(event.Interface)
+			if err != nil {
+				if errors.Is(err, ErrNotVRF) {
+					// Just in case the regex matches an interface
+					// that's not a VRF, handle it gracefully.
+					ll.Infof("Won't bind %s as it's not a VRF", event.Interface)
+				} else {
+					ll.Warningf("Failed to bind %s: %v", event.Interface, err)
+				}
+				// Add a sentinel to avoid warning when the interface disappears
+				listeners[event.Interface] = nil
+				continue
+			}
+			listeners[event.Interface] = s
+			active.addListener(kind+"/"+event.Interface, s)
+			gauge.Inc()
+			go s.Listen()
+		case monitor.LinkDown:
+			s, ok := listeners[event.Interface]
+			if !ok {
+				// This should not be possible
+				ll.Warningf("Interface %s without listener doing down", event.Interface)
+				continue
+			}
+			delete(listeners, event.Interface)
+			if s != nil {
+				active.removeListener(kind + "/" + event.Interface)
+				s.Close()
+				gauge.Dec()
+			}
+		}
+	}
+	ll.Info("Monitor channel closed")
+}
+
+// filterInterfaces keeps the interface filter of l current with the interfaces
+// matching regex that are up. Blocks until the monitor channel is closed.
+func filterInterfaces(l *Listener, regex *regexp.Regexp) {
+	linkch := make(chan monitor.Event, 5)
+	mon := monitor.NewNetlinkMonitor(linkch, regex)
+	active.addMonitor("bpf-interfaces", mon)
+
+	go func() {
+		if err := mon.Listen(); err != nil {
+			ll.Fatalf("Netlink monitor unexpected exit: %s", err)
+		}
+	}()
+
+	ifindexes := make(map[int]bool)
+	for event := range linkch {
+		switch event.Type {
+		case monitor.LinkUp:
+			ifindexes[event.Index] = true
+		case monitor.LinkDown:
+			delete(ifindexes, event.Index)
+		}
+
+		// Not nil even if empty, so requests get dropped without interfaces
+		list := make([]int, 0, len(ifindexes))
+		for idx := range ifindexes {
+			list = append(list, idx)
+		}
+		sort.Ints(list)
+
+		if err := l.SetInterfaceFilter(list); err != nil {
+			ll.Warnf("Failed to filter %d interfaces, accepting requests from all of them: %v", len(list), err)
+			if err := l.SetInterfaceFilter(nil); err != nil {
+				ll.Errorf("Failed to reset interface filter: %v", err)
+			}
+			continue
+		}
+		ll.Debugf("Filtering requests for %d interfaces", len(list))
+	}
+	ll.Info("Monitor channel closed")
+}
+
+// leaseFile returns the path of the lease journal, empty if leases shouldn't
+// persist.
+func leaseFile() string {
+	switch *flagLeaseFile {
+	case "none":
+		return ""
+	case "":
+		return filepath.Join(filepath.Dir(*flagHostnamePath), "leases.journal")
+	}
+	return *flagLeaseFile
+}
+
+// newRelayMap returns the mappings of relayed clients given with -relay-map,
+// nil if there are none.
+func newRelayMap() *relay.Map {
+	if *flagRelayMap == "" {
+		return nil
+	}
+	return relay.NewMap(*flagRelayMap)
+}
+
+// checkReload returns an error if c can't replace the configuration old
+// without a restart, as the tap regex is only read at startup by the tap
+// monitors, the DHCPv6 monitor and the interface filter.
+func checkReload(old, c *config.Config) error {
+	if err := checkRelayAgents(c); err != nil {
+		return err
+	}
+	if c.TapRegex.String() == old.TapRegex.String() {
+		return nil
+	}
+	var pinned []string
+	if *flagBindTaps {
+		pinned = append(pinned, "-bind-taps")
+	}
+	if *flagBPFInterfaces && !*flagBindTaps {
+		pinned = append(pinned, "-bpf-interfaces")
+	}
+	if *flagDHCPv6 {
+		pinned = append(pinned, "-dhcpv6")
+	}
+	if len(pinned) > 0 {
+		return fmt.Errorf("regex changed from %s to %s, which requires a restart with %s", old.TapRegex, c.TapRegex, strings.Join(pinned, ", "))
+	}
+	return nil
+}
+
+// checkRelayAgents returns an error if c trusts relay agents while requests
+// are only received from taps, so relayed requests would never be answered.
+func checkRelayAgents(c *config.Config) error {
+	if len(c.RelayAgents) == 0 {
+		return nil
+	}
+	if *flagBindTaps {
+		return fmt.Errorf("relay agents can't be served with -bind-taps, relayed requests don't come in on a tap")
+	}
+	if *flagBPFInterfaces {
+		return fmt.Errorf("relay agents can't be served with -bpf-interfaces, relayed requests don't come in on a tap")
+	}
+	return nil
+}
+
+// loadConfig builds the configuration from the command line flags and the
+// config file, if any.
+func loadConfig() (*config.Config, error) {
+	s := config.Settings{
+		LeaseTime:          *flagLeaseTime,
+		Regex:              *flagTapRegex,
+		PvtCIDR:            *flagPvtIPs,
+		Tftp:               *flagTftpIP,
+		DynamicHostname:    *flagDynHost,
+		HostnameOverride:   *flagHostnameOverride,
+		OverrideFilePrefix: *flagHostnamePath,
+		Hostname:           *flagHostname,
+		Domainname:         *flagDomainname,
+		Bootfile:           *flagBootfile,
+		BootDelivery:       *flagBootDelivery,
+		Classless:          *flagClassless,
+		ClasslessGateway:   *flagClasslessGateway,
+		ClientRate:         *flagClientRate,
+		ClientBurst:        *flagClientBurst,
+		InterfaceRate:      *flagInterfaceRate,
+		InterfaceBurst:     *flagInterfaceBurst,
+	}
+	for _, ip := range myDNS {
+		s.DNS = append(s.DNS, ip.String())
+	}
+	for _, ip := range myDNS6 {
+		s.DNS6 = append(s.DNS6, ip.String())
+	}
+	if *flagRelayAgents != "" {
+		s.RelayAgents = strings.Split(*flagRelayAgents, ",")
+	}
+
+	if *flagConfig != "" {
+		if err := config.LoadFile(*flagConfig, &s, pinnedFlags); err != nil {
+			return nil, err
+		}
+	}
+
+	return s.Parse()
+}
+
+// logConfig logs the noteworthy bits of a configuration that was just loaded.
+func logConfig(c *config.Config) {
+	if c.DynamicHostname {
+		ll.Infof("Dynamic hostnames based on IP enabled")
+	}
+	if c.HostnameOverride {
+		ll.Infof("Hostname override enabled from %s", c.OverrideFilePrefix)
+	}
+	ll.Infof("Handling Interfaces matching '%s'", c.TapRegex.String())
+	if c.Tftp != nil {
+		ll.Infof("using %s as tftp", c.Tftp)
+	}
+	if c.BootDelivery != boot.DeliverBoth {
+		ll.Infof("Boot settings only sent in %s", c.BootDelivery)
+	}
+	ll.Infof("ignoring private IPs from %v", c.PvtIPs)
+	ll.Infof("using DNS %v", c.DNS)
+	if len(c.DNS6) > 0 {
+		ll.Infof("using DNS %v for DHCPv6", c.DNS6)
+	}
+	if c.Classless {
+		ll.Infof("Classless static routes enabled")
+	}
+	if c.RateLimits.Client.Enabled() || c.RateLimits.Interface.Enabled() {
+		ll.Infof("Rate limiting requests to %+v", c.RateLimits)
+	}
+	for vrf, limits := range c.VRFRateLimits {
+		ll.Infof("Rate limiting requests in VRF %s to %+v", vrf, limits)
+	}
+	if len(c.RelayAgents) > 0 {
+		ll.Infof("Serving requests relayed by %v", c.RelayAgents)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"regexp"
+	"testing"
+
+	"github.com/linode/dhcpd-unnumbered/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckReload(t *testing.T) {
+	old := &config.Config{TapRegex: regexp.MustCompile("tap.*_0")}
+	same := &config.Config{TapRegex: regexp.MustCompile("tap.*_0")}
+	changed := &config.Config{TapRegex: regexp.MustCompile("tap.*")}
+
+	defer func(v bool) { *flagBindTaps = v }(*flagBindTaps)
+	defer func(v bool) { *flagBPFInterfaces = v }(*flagBPFInterfaces)
+	defer func(v bool) { *flagDHCPv6 = v }(*flagDHCPv6)
+
+	*flagBindTaps, *flagBPFInterfaces, *flagDHCPv6 = false, false, false
+	assert.Nil(t, checkReload(old, changed))
+
+	*flagBindTaps = true
+	assert.Nil(t, checkReload(old, same))
+	assert.ErrorContains(t, checkReload(old, changed), "-bind-taps")
+
+	*flagBindTaps, *flagBPFInterfaces = false, true
+	assert.Nil(t, checkReload(old, same))
+	assert.ErrorContains(t, checkReload(old, changed), "-bpf-interfaces")
+
+	*flagBPFInterfaces, *flagDHCPv6 = false, true
+	assert.Nil(t, checkReload(old, same))
+	assert.ErrorContains(t, checkReload(old, changed), "-dhcpv6")
+}
+
+func TestCheckRelayAgents(t *testing.T) {
+	_, agents, _ := net.ParseCIDR("198.51.100.0/24")
+	old := &config.Config{TapRegex: regexp.MustCompile("tap.*_0")}
+	c := &config.Config{TapRegex: regexp.MustCompile("tap.*_0"), RelayAgents: []*net.IPNet{agents}}
+
+	defer func(v bool) { *flagBindTaps = v }(*flagBindTaps)
+	defer func(v bool) { *flagBPFInterfaces = v }(*flagBPFInterfaces)
+
+	*flagBindTaps, *flagBPFInterfaces = false, false
+	assert.Nil(t, checkRelayAgents(c))
+	assert.Nil(t, checkReload(old, c))
+
+	*flagBindTaps = true
+	assert.ErrorContains(t, checkRelayAgents(c), "-bind-taps")
+	assert.ErrorContains(t, checkReload(old, c), "-bind-taps")
+	assert.Nil(t, checkRelayAgents(old))
+
+	*flagBindTaps, *flagBPFInterfaces = false, true
+	assert.ErrorContains(t, checkRelayAgents(c), "-bpf-interfaces")
+	assert.ErrorContains(t, checkReload(old, c), "-bpf-interfaces")
+	assert.Nil(t, checkRelayAgents(old))
+}
@@ -0,0 +1,129 @@
+package metrics
+
+// Prometheus metrics about the DHCP traffic handled, served over HTTP.
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "dhcpd_unnumbered"
+
+// Reasons for dropping a request, used as label of Dropped.
+const (
+	DropInterfaceLookup   = "interface_lookup"
+	DropParseError        = "parse_error"
+	DropRegexMismatch     = "regex_mismatch"
+	DropInterfaceDown     = "interface_down"
+	DropUnsupportedOpcode = "unsupported_opcode"
+	DropUnhandledType     = "unhandled_message_type"
+	DropRouteLookup       = "route_lookup"
+	DropNoHostRoutes      = "no_host_routes"
+	DropOtherServer       = "other_server"
+	DropReplyError        = "reply_error"
+	DropSendFailure       = "send_failure"
+	DropQueueFull         = "queue_full"
+	DropRateLimited       = "rate_limited"
+	DropUntrustedRelay    = "untrusted_relay"
+	DropNoRelayIdentity   = "no_relay_identity"
+	DropInvalidMessage    = "invalid_message"
+	DropLeaseMismatch     = "lease_mismatch"
+)
+
+var (
+	// Received counts incoming DHCP messages by message type.
+	Received = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "received_total",
+		Help:      "DHCP messages received, by message type.",
+	}, []string{"type"})
+
+	// Sent counts outgoing DHCP messages by message type.
+	Sent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sent_total",
+		Help:      "DHCP messages sent, by message type.",
+	}, []string{"type"})
+
+	// Dropped counts requests that didn't get a reply, by reason.
+	Dropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dropped_total",
+		Help:      "DHCP requests dropped without a reply, by reason.",
+	}, []string{"reason"})
+
+	// Received6 counts incoming DHCPv6 messages by message type.
+	Received6 = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dhcpv6_received_total",
+		Help:      "DHCPv6 messages received, by message type.",
+	}, []string{"type"})
+
+	// Sent6 counts outgoing DHCPv6 messages by message type.
+	Sent6 = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dhcpv6_sent_total",
+		Help:      "DHCPv6 messages sent, by message type.",
+	}, []string{"type"})
+
+	// Dropped6 counts DHCPv6 requests that didn't get a reply, by reason.
+	Dropped6 = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dhcpv6_dropped_total",
+		Help:      "DHCPv6 requests dropped without a reply, by reason.",
+	}, []string{"reason"})
+
+	// HandlingDuration observes the time spent handling a single request.
+	HandlingDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "handling_duration_seconds",
+		Help:      "Time spent handling a DHCP request, including sending the reply.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 8),
+	})
+
+	// VRFListeners is the number of listeners bound to VRFs.
+	VRFListeners = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "vrf_listeners",
+		Help:      "Number of active listeners bound to a VRF.",
+	})
+
+	// TapListeners is the number of listeners bound to taps.
+	TapListeners = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "tap_listeners",
+		Help:      "Number of active listeners bound to a tap.",
+	})
+
+	// NetnsListeners is the number of listeners serving other namespaces.
+	NetnsListeners = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "netns_listeners",
+		Help:      "Number of active listeners serving a network namespace.",
+	})
+
+	// DHCPv6Listeners is the number of DHCPv6 listeners bound to taps.
+	DHCPv6Listeners = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "dhcpv6_listeners",
+		Help:      "Number of active DHCPv6 listeners bound to a tap.",
+	})
+
+	// OptionsLoadFailures counts options override files that failed to load.
+	OptionsLoadFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "options_load_failures_total",
+		Help:      "Options override files that could not be loaded.",
+	})
+)
+
+// Listen serves the metrics on addr under /metrics. Blocks until the server
+// fails.
+func Listen(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return http.ListenAndServe(addr, mux)
+}
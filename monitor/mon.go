@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"net"
 	"regexp"
+	"sort"
+	"sync"
 
 	ll "github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
@@ -16,11 +18,15 @@ type EventType int
 const (
 	LinkUp EventType = iota
 	LinkDown
+	NetnsAdd
+	NetnsDel
 )
 
 type Event struct {
 	Type      EventType
-	Interface string
+	Interface string // Set for link events
+	Index     int    // Set for link events
+	Netns     string // Set for namespace events
 }
 
 type NetlinkMonitor struct {
@@ -28,6 +34,11 @@ type NetlinkMonitor struct {
 	done     chan struct{}
 	matching *regexp.Regexp
 	ch       chan Event // Events are emitted here
+
+	// All currently known interfaces that are up. Locked for writing, as
+	// Interfaces can be called concurrently.
+	mu         sync.Mutex
+	interfaces map[string]bool
 }
 
 // NewNetlinkMonitor creates a listener for interface up/down events matching
@@ -35,10 +46,11 @@ type NetlinkMonitor struct {
 func NewNetlinkMonitor(ch chan Event, matching *regexp.Regexp) *NetlinkMonitor {
 	log := ll.NewEntry(ll.StandardLogger())
 	nl := &NetlinkMonitor{
-		log:      log,
-		done:     make(chan struct{}),
-		ch:       ch,
-		matching: matching,
+		log:        log,
+		done:       make(chan struct{}),
+		ch:         ch,
+		matching:   matching,
+		interfaces: make(map[string]bool),
 	}
 	return nl
 }
@@ -50,9 +62,6 @@ func (nm *NetlinkMonitor) Close() {
 
 // Listen starts lisetning for events. Blocks until Close() is called
 func (nm *NetlinkMonitor) Listen() error {
-	// All currently known interfaces that are up.
-	interfaces := make(map[string]bool)
-
 	updates := make(chan netlink.LinkUpdate, 10)
 
 	// Listen for changes
@@ -81,7 +90,9 @@ func (nm *NetlinkMonitor) Listen() error {
 		ifName := attrs.Name
 		state := attrs.OperState
 		flags := attrs.Flags
-		known := interfaces[ifName]
+
+		// Only written here, so no need to lock for reading
+		known := nm.interfaces[ifName]
 		log := nm.log.WithFields(ll.Fields{"intf": ifName, "ctr": ctr})
 
 		log.WithFields(ll.Fields{"state": state, "flags": flags, "known": known}).Debug("Processing interface")
@@ -91,7 +102,7 @@ func (nm *NetlinkMonitor) Listen() error {
 			return
 		}
 
-		if interfaces[ifName] {
+		if known {
 			// If known interface and up, ignore event
 			if linkReady(attrs) {
 				log.Debug("Already up")
@@ -101,8 +112,11 @@ func (nm *NetlinkMonitor) Listen() error {
 			ev := Event{
 				Type:      LinkDown,
 				Interface: ifName,
+				Index:     attrs.Index,
 			}
-			delete(interfaces, ifName)
+			nm.mu.Lock()
+			delete(nm.interfaces, ifName)
+			nm.mu.Unlock()
 			log.Info("Interface went down")
 			nm.ch <- ev
 		} else {
@@ -112,8 +126,11 @@ func (nm *NetlinkMonitor) Listen() error {
 				ev := Event{
 					Type:      LinkUp,
 					Interface: attrs.Name,
+					Index:     attrs.Index,
 				}
-				interfaces[attrs.Name] = true
+				nm.mu.Lock()
+				nm.interfaces[attrs.Name] = true
+				nm.mu.Unlock()
 				log.Info("New interface is up, emit up")
 				nm.ch <- ev
 			} else {
@@ -142,6 +159,20 @@ func (nm *NetlinkMonitor) Listen() error {
 	}
 }
 
+// Interfaces returns the interfaces matching the regex that are up, sorted by
+// name.
+func (nm *NetlinkMonitor) Interfaces() []string {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	names := make([]string, 0, len(nm.interfaces))
+	for name := range nm.interfaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // linkReady returns true if the link is up, using the same strategy as
 // rad-unnumbered (except for not waiting until traffic flows).
 func linkReady(l *netlink.LinkAttrs) bool {
@@ -125,6 +125,7 @@ func TestUpDown(t *testing.T) {
 			// We mustn't see down events before up
 			assert.True(t, ev.Type != LinkDown)
 			assert.True(t, regex.Match([]byte(ev.Interface)))
+			assert.NotZero(t, ev.Index)
 			if cnt <= 0 {
 				return
 			}
@@ -151,6 +152,7 @@ func TestUpDown(t *testing.T) {
 
 	// Wait for up
 	wg.Wait()
+	assert.Equal(t, []string{"myvrf0", "myvrf1", "myvrf2", "myvrf3", "myvrf4"}, mon.Interfaces())
 
 	wg.Add(1)
 	var downevent = func() {
@@ -0,0 +1,111 @@
+package monitor
+
+// Watch a directory of named network namespaces (as created by `ip netns add`)
+// for namespaces appearing and disappearing. Emit those as events.
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	ll "github.com/sirupsen/logrus"
+)
+
+// DefaultNetnsDir is where iproute2 keeps named network namespaces.
+const DefaultNetnsDir = "/run/netns"
+
+// How often the namespace directory is scanned for changes
+const netnsPollInterval = time.Second
+
+type NetnsMonitor struct {
+	log      *ll.Entry
+	done     chan struct{}
+	dir      string
+	matching *regexp.Regexp
+	ch       chan Event // Events are emitted here
+	interval time.Duration
+}
+
+// NewNetnsMonitor creates a listener for namespaces in dir with names matching
+// the given regex being added or deleted.
+func NewNetnsMonitor(ch chan Event, dir string, matching *regexp.Regexp) *NetnsMonitor {
+	log := ll.NewEntry(ll.StandardLogger()).WithFields(ll.Fields{"dir": dir})
+	return &NetnsMonitor{
+		log:      log,
+		done:     make(chan struct{}),
+		dir:      dir,
+		matching: matching,
+		ch:       ch,
+		interval: netnsPollInterval,
+	}
+}
+
+// Close stops listening for events and frees resources
+func (nm *NetnsMonitor) Close() {
+	close(nm.done)
+}
+
+// Listen starts watching for namespaces, emitting NetnsAdd events for existing
+// ones first. Blocks until Close() is called.
+func (nm *NetnsMonitor) Listen() error {
+	// All currently known namespaces
+	namespaces := make(map[string]bool)
+
+	if err := nm.scan(namespaces); err != nil {
+		return fmt.Errorf("unable to read namespaces: %v", err)
+	}
+
+	ticker := time.NewTicker(nm.interval)
+	defer ticker.Stop()
+
+	nm.log.Infoln("Watching for namespaces")
+	for {
+		select {
+		case <-nm.done:
+			nm.log.Info("Netns monitor closed")
+			close(nm.ch)
+			return nil
+		case <-ticker.C:
+			if err := nm.scan(namespaces); err != nil {
+				// The directory only exists once the first namespace got
+				// created, so keep trying.
+				nm.log.Debugf("Unable to read namespaces: %v", err)
+			}
+		}
+	}
+}
+
+// scan the directory and emit events for the differences to known.
+func (nm *NetnsMonitor) scan(known map[string]bool) error {
+	entries, err := os.ReadDir(nm.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		name := e.Name()
+		if !nm.matching.MatchString(name) {
+			continue
+		}
+		seen[name] = true
+		if known[name] {
+			continue
+		}
+		known[name] = true
+		nm.log.WithFields(ll.Fields{"netns": name}).Info("New namespace, emit add")
+		nm.ch <- Event{Type: NetnsAdd, Netns: name}
+	}
+
+	for name := range known {
+		if seen[name] {
+			continue
+		}
+		delete(known, name)
+		nm.log.WithFields(ll.Fields{"netns": name}).Info("Namespace gone, emit delete")
+		nm.ch <- Event{Type: NetnsDel, Netns: name}
+	}
+
+	return nil
+}
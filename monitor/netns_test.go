@@ -0,0 +1,73 @@
+package monitor
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func nextEvent(t *testing.T, events chan Event) Event {
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for event")
+	}
+	return Event{}
+}
+
+// Namespaces are plain files in a directory as far as the monitor is
+// concerned, so this test doesn't need root.
+func TestNetnsAddDel(t *testing.T) {
+	dir := t.TempDir()
+	touch := func(name string) {
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, name), nil, 0644))
+	}
+	touch("tenant1")
+	touch("other")
+
+	events := make(chan Event, 5)
+	mon := NewNetnsMonitor(events, dir, regexp.MustCompile("^tenant"))
+	mon.interval = 10 * time.Millisecond
+	go mon.Listen()
+
+	// Existing namespace
+	ev := nextEvent(t, events)
+	assert.Equal(t, Event{Type: NetnsAdd, Netns: "tenant1"}, ev)
+
+	touch("tenant2")
+	touch("other2")
+	ev = nextEvent(t, events)
+	assert.Equal(t, Event{Type: NetnsAdd, Netns: "tenant2"}, ev)
+
+	assert.Nil(t, os.Remove(filepath.Join(dir, "tenant1")))
+	assert.Nil(t, os.Remove(filepath.Join(dir, "other")))
+	ev = nextEvent(t, events)
+	assert.Equal(t, Event{Type: NetnsDel, Netns: "tenant1"}, ev)
+
+	mon.Close()
+	// The channel is closed once the monitor is done
+	for range events {
+	}
+}
+
+// The directory doesn't exist until the first namespace gets created
+func TestNetnsMissingDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "netns")
+
+	events := make(chan Event, 5)
+	mon := NewNetnsMonitor(events, dir, regexp.MustCompile(".*"))
+	mon.interval = 10 * time.Millisecond
+	go mon.Listen()
+
+	assert.Nil(t, os.Mkdir(dir, 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "tenant1"), nil, 0644))
+	ev := nextEvent(t, events)
+	assert.Equal(t, Event{Type: NetnsAdd, Netns: "tenant1"}, ev)
+
+	mon.Close()
+}
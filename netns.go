@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+
+	"github.com/linode/dhcpd-unnumbered/leases"
+	"github.com/linode/dhcpd-unnumbered/metrics"
+	"github.com/linode/dhcpd-unnumbered/monitor"
+	"github.com/linode/dhcpd-unnumbered/relay"
+	"github.com/linode/dhcpd-unnumbered/routes"
+	ll "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netns"
+)
+
+// netnsServer serves the taps of a named network namespace with a wildcard
+// listener of its own. VRFs within the namespace aren't bound.
+type netnsServer struct {
+	name     string
+	ns       netns.NsHandle
+	listener *Listener
+	routes   *routes.Cache
+}
+
+// newNetnsServer opens namespace name in dir and starts serving it.
+func newNetnsServer(dir, name string, queuePolicy QueuePolicy, leaseTable *leases.Table, relayMap *relay.Map) (*netnsServer, error) {
+	ns, err := netns.GetFromPath(filepath.Join(dir, name))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open namespace: %v", err)
+	}
+
+	// Each namespace has its own loopback to pick the source IP from
+	var sIP net.IP
+	err = inNetns(ns, func() (err error) {
+		sIP, err = getSourceIP()
+		return err
+	})
+	if err != nil {
+		ns.Close()
+		return nil, fmt.Errorf("unable to get source IP to be used: %v", err)
+	}
+
+	l, err := NewListenerAt(ns, name, "")
+	if err != nil {
+		ns.Close()
+		return nil, err
+	}
+	l.SetSource(sIP)
+	l.SetQueue(*flagWorkers, *flagQueueSize, queuePolicy)
+	l.SetLeases(leaseTable)
+	l.SetRelayMap(relayMap)
+
+	srv := &netnsServer{
+		name:     name,
+		ns:       ns,
+		listener: l,
+	}
+
+	if *flagRouteCache {
+		srv.routes = routes.NewCacheAt(ns)
+		l.SetRouteCache(srv.routes)
+		go func() {
+			if err := srv.routes.Run(); err != nil {
+				ll.Errorf("Route cache of namespace %s unexpected exit: %s", name, err)
+			}
+		}()
+	}
+
+	go l.Listen()
+
+	return srv, nil
+}
+
+// Close stops serving the namespace and releases its handle.
+func (srv *netnsServer) Close() {
+	srv.listener.Close()
+	if srv.routes != nil {
+		srv.routes.Close()
+	}
+	srv.ns.Close()
+}
+
+// serveNetns watches dir for namespaces matching regex and serves them while
+// they exist. Blocks until the monitor fails.
+func serveNetns(dir string, regex *regexp.Regexp, queuePolicy QueuePolicy, leaseTable *leases.Table, relayMap *relay.Map) {
+	nsch := make(chan monitor.Event, 5)
+	mon := monitor.NewNetnsMonitor(nsch, dir, regex)
+
+	go func() {
+		if err := mon.Listen(); err != nil {
+			ll.Fatalf("Netns monitor unexpected exit: %s", err)
+		}
+	}()
+
+	servers := make(map[string]*netnsServer)
+	for event := range nsch {
+		switch event.Type {
+		case monitor.NetnsAdd:
+			srv, err := newNetnsServer(dir, event.Netns, queuePolicy, leaseTable, relayMap)
+			if err != nil {
+				ll.Warningf("Failed to serve namespace %s: %v", event.Netns, err)
+				continue
+			}
+			servers[event.Netns] = srv
+			active.addListener("netns/"+event.Netns, srv.listener)
+			metrics.NetnsListeners.Inc()
+		case monitor.NetnsDel:
+			srv, ok := servers[event.Netns]
+			if !ok {
+				// Failed to serve it in the first place
+				continue
+			}
+			delete(servers, event.Netns)
+			active.removeListener("netns/" + event.Netns)
+			srv.Close()
+			metrics.NetnsListeners.Dec()
+		}
+	}
+	ll.Info("Netns monitor channel closed")
+}
@@ -0,0 +1,37 @@
+package options
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+// SafeName turns an id into something safe to use in the name of an override
+// file. Printable ids are kept, except for characters that don't belong into
+// a file name, which are replaced with _. Others are hex encoded.
+func SafeName(id []byte) string {
+	for _, b := range id {
+		if b <= ' ' || b > '~' {
+			return hex.EncodeToString(id)
+		}
+	}
+	s := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '-', r == '_', r == '.', r == ':', r == '@':
+			return r
+		}
+		return '_'
+	}, string(id))
+	// No hidden files or ..
+	if strings.HasPrefix(s, ".") {
+		s = "_" + s[1:]
+	}
+	return s
+}
+
+// ValidName returns true if s is safe to use in the name of an override file
+// as is, as interface and namespace names given by users must be.
+func ValidName(s string) bool {
+	return s != "" && SafeName([]byte(s)) == s
+}
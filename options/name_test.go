@@ -0,0 +1,22 @@
+package options
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSafeName(t *testing.T) {
+	assert.Equal(t, "Ethernet1_1", SafeName([]byte("Ethernet1/1")))
+	assert.Equal(t, "_.", SafeName([]byte("..")))
+	assert.Equal(t, "000102", SafeName([]byte{0, 1, 2}))
+}
+
+func TestValidName(t *testing.T) {
+	for _, s := range []string{"tap.7_0", "Ethernet1_1", "tenant-a", "vm@host:1"} {
+		assert.True(t, ValidName(s), s)
+	}
+	for _, s := range []string{"", "..", ".tap", "../tap", "tenant/tap", "vlan 10"} {
+		assert.False(t, ValidName(s), s)
+	}
+}
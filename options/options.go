@@ -6,7 +6,10 @@ import (
 	"io"
 	"net"
 	"os"
+	"time"
 
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/linode/dhcpd-unnumbered/boot"
 	ll "github.com/sirupsen/logrus"
 )
 
@@ -17,17 +20,33 @@ import (
 // logged).
 type dhcpJSON struct {
 	IPv4       []string // Address/Prefix. If not specified, Prefix is implicitly /24
+	IPv6       []string // Addresses handed out over DHCPv6, optionally with a /128 prefix
 	Hostname   string
 	Domainname string
 	Gateway    string // Address
 	PvtIPs     string // Address/Prefix
 	Tftp       string
+	Classless  *bool // Hand out a /32 with classless static routes
+
+	LeaseTime    string   // Duration, i.e. 30m or 12h
+	DNS          []string // Addresses, handed out in the given order
+	DNS6         []string // IPv6 addresses, handed out over DHCPv6 in the given order
+	NTP          []string // Addresses
+	InterfaceMTU uint16
+	Bootfile     string
+	BootDelivery string // both, header or options
+	DomainSearch []string
+
+	RawOptions map[string]rawOptionJSON // Keyed by option code, see raw.go
+
+	BootProfiles []boot.ProfileJSON // Replace the configured ones, see boot/profile.go
 }
 
 // This struct represents the parsed DHCP options as used internally.
 type DHCP struct {
 	// If empty, these aren't set
 	IPv4 []*net.IPNet
+	IPv6 []net.IP
 
 	// If nil, these aren't set.
 	Hostname   *string
@@ -35,6 +54,20 @@ type DHCP struct {
 	Gateway    *net.IP
 	PvtIPs     *net.IPNet
 	Tftp       *net.IP
+	Classless  *bool
+
+	LeaseTime    *time.Duration
+	InterfaceMTU *uint16
+	Bootfile     *string
+	BootDelivery *boot.Delivery
+
+	// If empty, these aren't set
+	DNS          []net.IP
+	DNS6         []net.IP
+	NTP          []net.IP
+	DomainSearch []string
+	RawOptions   []dhcpv4.Option
+	BootProfiles []boot.Profile
 }
 
 // Load and parse OptionsJSON to Options. Returns an error if the file cannot be
@@ -92,6 +125,23 @@ func parseIP(log *ll.Entry, ipstr string) (*net.IPNet, error) {
 	return &ret, nil
 }
 
+// Parse a string as an IPv6 address, optionally with a /128 prefix as host
+// routes have.
+func parseIP6(ipstr string) (net.IP, error) {
+	ip, ipnet, err := net.ParseCIDR(ipstr)
+	if err == nil {
+		if ones, bits := ipnet.Mask.Size(); ones != 128 || bits != 128 {
+			return nil, fmt.Errorf("%s is not a single address", ipstr)
+		}
+	} else {
+		ip = net.ParseIP(ipstr)
+	}
+	if ip == nil || ip.To4() != nil {
+		return nil, fmt.Errorf("failed to parse %s as IPv6 address", ipstr)
+	}
+	return ip, nil
+}
+
 func parse(log *ll.Entry, bytes []byte) (*DHCP, error) {
 	options := &DHCP{}
 	var onDisk dhcpJSON
@@ -109,6 +159,15 @@ func parse(log *ll.Entry, bytes []byte) (*DHCP, error) {
 		}
 	}
 
+	for _, ipstr := range onDisk.IPv6 {
+		ip, err := parseIP6(ipstr)
+		if err == nil {
+			options.IPv6 = append(options.IPv6, ip)
+		} else {
+			log.Warnf("Failed to parse IPv6=%s, it will be ignored: %v", ipstr, err)
+		}
+	}
+
 	if onDisk.Hostname != "" {
 		options.Hostname = &onDisk.Hostname
 	}
@@ -146,5 +205,80 @@ func parse(log *ll.Entry, bytes []byte) (*DHCP, error) {
 		}
 	}
 
+	options.Classless = onDisk.Classless
+
+	if onDisk.LeaseTime != "" {
+		leaseTime, err := time.ParseDuration(onDisk.LeaseTime)
+		if err != nil || leaseTime <= 0 {
+			ll.Warnf("Failed to parse LeaseTime=%s, it will be ignored", onDisk.LeaseTime)
+		} else {
+			options.LeaseTime = &leaseTime
+		}
+	}
+
+	options.DNS = parseIPList(log, "DNS", onDisk.DNS)
+	options.NTP = parseIPList(log, "NTP", onDisk.NTP)
+	for _, ipstr := range onDisk.DNS6 {
+		ip := net.ParseIP(ipstr)
+		if ip == nil || ip.To4() != nil {
+			log.Warnf("Failed to parse DNS6=%s, it will be ignored", ipstr)
+			continue
+		}
+		options.DNS6 = append(options.DNS6, ip)
+	}
+
+	if onDisk.InterfaceMTU != 0 {
+		// RFC 2132 9.13: the minimum legal value for the MTU is 68
+		if onDisk.InterfaceMTU < 68 {
+			ll.Warnf("InterfaceMTU=%d is too small, it will be ignored", onDisk.InterfaceMTU)
+		} else {
+			options.InterfaceMTU = &onDisk.InterfaceMTU
+		}
+	}
+
+	if onDisk.Bootfile != "" {
+		options.Bootfile = &onDisk.Bootfile
+	}
+
+	if onDisk.BootDelivery != "" {
+		d, err := boot.ParseDelivery(onDisk.BootDelivery)
+		if err != nil {
+			log.Warnf("%v, it will be ignored", err)
+		} else {
+			options.BootDelivery = &d
+		}
+	}
+
+	for _, domain := range onDisk.DomainSearch {
+		if domain != "" {
+			options.DomainSearch = append(options.DomainSearch, domain)
+		}
+	}
+
+	options.RawOptions = parseRawOptions(log, onDisk.RawOptions)
+
+	for _, p := range onDisk.BootProfiles {
+		profile, err := p.Parse()
+		if err != nil {
+			log.Warnf("Failed to parse boot profile, it will be ignored: %v", err)
+			continue
+		}
+		options.BootProfiles = append(options.BootProfiles, profile)
+	}
+
 	return options, nil
 }
+
+// Parse a list of IPv4 addresses, discarding those that fail to parse.
+func parseIPList(log *ll.Entry, name string, ipstrs []string) []net.IP {
+	var ips []net.IP
+	for _, ipstr := range ipstrs {
+		ip := net.ParseIP(ipstr).To4()
+		if ip == nil {
+			log.Warnf("Failed to parse %s=%s, it will be ignored", name, ipstr)
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
@@ -3,7 +3,9 @@ package options
 import (
 	"net"
 	"testing"
+	"time"
 
+	"github.com/linode/dhcpd-unnumbered/boot"
 	ll "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
@@ -20,17 +22,35 @@ func TestNoFile(t *testing.T) {
 	assert.Nil(t, options.Domainname, "Domainname not empty")
 	assert.Nil(t, options.PvtIPs, "PvtIPs not empty")
 	assert.Nil(t, options.Tftp, "Tftp not empty")
+	assert.Nil(t, options.Classless, "Classless not empty")
+	assert.Nil(t, options.LeaseTime, "LeaseTime not empty")
+	assert.Nil(t, options.Bootfile, "Bootfile not empty")
+	assert.True(t, len(options.DNS) == 0, "DNS list not empty")
 }
 
 func TestParse(t *testing.T) {
 	json := `
 {
   "IPv4":       ["1.1.1.1/23", "invalid-will-be-skipped", "2.2.2.2"],
+  "IPv6":       ["2001:db8::7", "2001:db8::8/128", "2001:db8::/64"],
   "hostname":   "myhostname",
   "domainname": "domain",
   "gateway":    "1.2.3.4",
   "pvtips" :    "192.168.1.0/24",
-  "tftp":       "3.4.5.6"
+  "tftp":       "3.4.5.6",
+  "classless":  true,
+  "leasetime":  "2h",
+  "dns":        ["9.9.9.9", "bogus", "1.1.1.1"],
+  "dns6":       ["2001:db8::53", "9.9.9.9"],
+  "ntp":        ["10.0.0.123"],
+  "interfacemtu": 9000,
+  "bootfile":   "pxelinux.0",
+  "domainsearch": ["example.com", "example.net"],
+  "bootprofiles": [
+    {"name": "uefi", "arch": [7], "bootfile": "ipxe.efi"},
+    {"name": "broken", "nextserver": "nope"}
+  ],
+  "bootdelivery": "header"
 }
 `
 	log := ll.NewEntry(ll.StandardLogger())
@@ -41,6 +61,7 @@ func TestParse(t *testing.T) {
 	assert.Equal(t, 2, len(options.IPv4))
 	assert.Equal(t, "1.1.1.1/23", options.IPv4[0].String(), "Bad first IP")
 	assert.Equal(t, "2.2.2.2/24", options.IPv4[1].String(), "Bad second IP")
+	assert.Equal(t, []net.IP{net.ParseIP("2001:db8::7"), net.ParseIP("2001:db8::8")}, options.IPv6, "Bad IPv6")
 	assert.Equal(t, "myhostname", *options.Hostname, "Bad Hostname")
 	assert.Equal(t, "domain", *options.Domainname, "Bad Domainname")
 	assert.Equal(t, "1.2.3.4", options.Gateway.To4().String(), "Bad Gateway")
@@ -48,6 +69,36 @@ func TestParse(t *testing.T) {
 	mask := net.IPv4Mask(255, 255, 255, 0)
 	assert.Equal(t, mask.String(), options.PvtIPs.Mask.String(), "Bad PvtIPs")
 	assert.Equal(t, "3.4.5.6", options.Tftp.String(), "Bad Tftp")
+	assert.True(t, *options.Classless, "Bad Classless")
+	assert.Equal(t, 2*time.Hour, *options.LeaseTime, "Bad LeaseTime")
+	assert.Equal(t, 2, len(options.DNS), "Bad DNS")
+	assert.Equal(t, "9.9.9.9", options.DNS[0].String(), "Bad first DNS")
+	assert.Equal(t, "1.1.1.1", options.DNS[1].String(), "Bad second DNS")
+	assert.Equal(t, []net.IP{net.ParseIP("2001:db8::53")}, options.DNS6, "Bad DNS6")
+	assert.Equal(t, 1, len(options.NTP), "Bad NTP")
+	assert.Equal(t, "10.0.0.123", options.NTP[0].String(), "Bad NTP")
+	assert.Equal(t, uint16(9000), *options.InterfaceMTU, "Bad InterfaceMTU")
+	assert.Equal(t, "pxelinux.0", *options.Bootfile, "Bad Bootfile")
+	assert.Equal(t, []string{"example.com", "example.net"}, options.DomainSearch, "Bad DomainSearch")
+	assert.Equal(t, 1, len(options.BootProfiles), "Bad BootProfiles")
+	assert.Equal(t, "ipxe.efi", options.BootProfiles[0].Bootfile, "Bad BootProfiles")
+	assert.Equal(t, boot.DeliverHeader, *options.BootDelivery, "Bad BootDelivery")
+}
+
+// Values that parse but make no sense are ignored
+func TestParseInvalid(t *testing.T) {
+	json := `
+{
+  "leasetime":    "-5m",
+  "interfacemtu": 42
+}
+`
+	log := ll.NewEntry(ll.StandardLogger())
+
+	options, err := parse(log, []byte(json))
+	assert.Nil(t, err, "Failed to load options")
+	assert.Nil(t, options.LeaseTime, "LeaseTime not empty")
+	assert.Nil(t, options.InterfaceMTU, "InterfaceMTU not empty")
 }
 
 // Test parsing of IP and prefix
@@ -91,3 +142,25 @@ func TestParseIP(t *testing.T) {
 		assert.Contains(t, err.Error(), "failed to parse")
 	}
 }
+
+// Test parsing of IPv6 addresses handed out over DHCPv6
+func TestParseIP6(t *testing.T) {
+	ip, err := parseIP6("2001:db8::7")
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8::7", ip.String())
+
+	ip, err = parseIP6("2001:db8::7/128")
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8::7", ip.String())
+
+	_, err = parseIP6("2001:db8::/64")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "not a single address")
+	}
+
+	_, err = parseIP6("192.0.2.7")
+	assert.NotNil(t, err)
+
+	_, err = parseIP6("blah")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,146 @@
+package options
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	ll "github.com/sirupsen/logrus"
+)
+
+// A raw option as it exists on disk, keyed by its option code in the options
+// file, i.e.
+//
+//	"RawOptions": {
+//	  "252": {"Type": "string", "Value": "http://wpad.example.com/wpad.dat"},
+//	  "43":  {"Type": "hex", "Value": "01:04:c0:a8:00:01"}
+//	}
+type rawOptionJSON struct {
+	Type  string
+	Value json.RawMessage
+}
+
+// Options the server sets itself and which cannot be overridden by a raw
+// option.
+var managedOptions = map[uint8]bool{
+	dhcpv4.OptionSubnetMask.Code():         true,
+	dhcpv4.OptionRouter.Code():             true,
+	dhcpv4.OptionIPAddressLeaseTime.Code(): true,
+	dhcpv4.OptionDHCPMessageType.Code():    true,
+	dhcpv4.OptionServerIdentifier.Code():   true,
+	// Set when boot fields are overloaded with options
+	dhcpv4.OptionOptionOverload.Code(): true,
+	// Echoed from relayed requests as is (RFC 3046)
+	dhcpv4.OptionRelayAgentInformation.Code(): true,
+}
+
+// Parse raw options. Options failing validation are discarded with a warning.
+// The result is sorted by option code.
+func parseRawOptions(log *ll.Entry, onDisk map[string]rawOptionJSON) []dhcpv4.Option {
+	var opts []dhcpv4.Option
+	for key, raw := range onDisk {
+		code, err := strconv.ParseUint(key, 10, 8)
+		if err != nil {
+			log.Warnf("Failed to parse raw option code %s, it will be ignored", key)
+			continue
+		}
+
+		if code == uint64(dhcpv4.OptionPad.Code()) || code == uint64(dhcpv4.OptionEnd.Code()) || managedOptions[uint8(code)] {
+			log.Warnf("Raw option %d is managed by the server, it will be ignored", code)
+			continue
+		}
+
+		value, err := encodeRawValue(raw.Type, raw.Value)
+		if err != nil {
+			log.Warnf("Failed to parse raw option %d, it will be ignored: %v", code, err)
+			continue
+		}
+
+		opts = append(opts, dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(code), value))
+	}
+
+	sort.Slice(opts, func(i, j int) bool {
+		return opts[i].Code.Code() < opts[j].Code.Code()
+	})
+	return opts
+}
+
+// Encode value of the given type into its wire format.
+func encodeRawValue(typ string, value json.RawMessage) ([]byte, error) {
+	var b []byte
+	switch typ {
+	case "ip":
+		var s string
+		if err := json.Unmarshal(value, &s); err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(s).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %s", s)
+		}
+		b = ip
+	case "ip-list":
+		var l []string
+		if err := json.Unmarshal(value, &l); err != nil {
+			return nil, err
+		}
+		for _, s := range l {
+			ip := net.ParseIP(s).To4()
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IPv4 address %s", s)
+			}
+			b = append(b, ip...)
+		}
+	case "string":
+		var s string
+		if err := json.Unmarshal(value, &s); err != nil {
+			return nil, err
+		}
+		b = []byte(s)
+	case "uint8":
+		var n uint8
+		if err := json.Unmarshal(value, &n); err != nil {
+			return nil, err
+		}
+		b = []byte{n}
+	case "uint16":
+		var n uint16
+		if err := json.Unmarshal(value, &n); err != nil {
+			return nil, err
+		}
+		b = binary.BigEndian.AppendUint16(nil, n)
+	case "uint32":
+		var n uint32
+		if err := json.Unmarshal(value, &n); err != nil {
+			return nil, err
+		}
+		b = binary.BigEndian.AppendUint32(nil, n)
+	case "hex":
+		var s string
+		if err := json.Unmarshal(value, &s); err != nil {
+			return nil, err
+		}
+		var err error
+		b, err = hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown type %q", typ)
+	}
+
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty value")
+	}
+	// The length of an option is a single octet
+	if len(b) > 255 {
+		return nil, fmt.Errorf("value of %d bytes is too long", len(b))
+	}
+	return b, nil
+}
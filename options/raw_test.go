@@ -0,0 +1,71 @@
+package options
+
+import (
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	ll "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRawOptions(t *testing.T) {
+	json := `
+{
+  "RawOptions": {
+    "252": {"Type": "string", "Value": "http://wpad/wpad.dat"},
+    "43":  {"Type": "hex", "Value": "01:04:c0:a8:00:01"},
+    "150": {"Type": "ip-list", "Value": ["10.0.0.1", "10.0.0.2"]},
+    "128": {"Type": "ip", "Value": "10.0.0.3"},
+    "129": {"Type": "uint8", "Value": 7},
+    "130": {"Type": "uint16", "Value": 1500},
+    "131": {"Type": "uint32", "Value": 86400},
+    "53":  {"Type": "uint8", "Value": 5},
+    "3":   {"Type": "ip", "Value": "10.0.0.1"},
+    "132": {"Type": "ip", "Value": "not-an-ip"},
+    "133": {"Type": "uint8", "Value": 300},
+    "134": {"Type": "bogus", "Value": "x"},
+    "256": {"Type": "uint8", "Value": 1},
+    "abc": {"Type": "uint8", "Value": 1}
+  }
+}
+`
+	log := ll.NewEntry(ll.StandardLogger())
+
+	options, err := parse(log, []byte(json))
+	assert.Nil(t, err, "Failed to load options")
+
+	want := []dhcpv4.Option{
+		dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(43), []byte{1, 4, 192, 168, 0, 1}),
+		dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(128), []byte{10, 0, 0, 3}),
+		dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(129), []byte{7}),
+		dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(130), []byte{0x05, 0xdc}),
+		dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(131), []byte{0, 1, 0x51, 0x80}),
+		dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(150), []byte{10, 0, 0, 1, 10, 0, 0, 2}),
+		dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(252), []byte("http://wpad/wpad.dat")),
+	}
+
+	if assert.Equal(t, len(want), len(options.RawOptions), "Unexpected number of raw options") {
+		for i, opt := range options.RawOptions {
+			assert.Equal(t, want[i].Code.Code(), opt.Code.Code(), "Bad option code")
+			assert.Equal(t, want[i].Value.ToBytes(), opt.Value.ToBytes(), "Bad value of option %d", opt.Code.Code())
+		}
+	}
+}
+
+// The overload option describes the layout of the reply, set when encoding it
+func TestParseRawOverload(t *testing.T) {
+	json := `{"RawOptions": {"52": {"Type": "uint8", "Value": 3}}}`
+
+	options, err := parse(ll.NewEntry(ll.StandardLogger()), []byte(json))
+	assert.Nil(t, err, "Failed to load options")
+	assert.Empty(t, options.RawOptions)
+}
+
+// Relay agent information is echoed from the request, never made up
+func TestParseRawRelayAgentInformation(t *testing.T) {
+	json := `{"RawOptions": {"82": {"Type": "hex", "Value": "01:04:74:61:70:30"}}}`
+
+	options, err := parse(ll.NewEntry(ll.StandardLogger()), []byte(json))
+	assert.Nil(t, err, "Failed to load options")
+	assert.Empty(t, options.RawOptions)
+}
@@ -0,0 +1,109 @@
+package ratelimit
+
+// Token bucket rate limiting of requests, keyed by an arbitrary string.
+
+import (
+	"sync"
+	"time"
+)
+
+// How often buckets that filled up again are forgotten
+const sweepInterval = time.Minute
+
+// Limit is the rate requests are allowed at, with bursts of up to Burst
+// requests. A Rate of 0 disables limiting.
+type Limit struct {
+	Rate  float64 // Requests per second
+	Burst int
+}
+
+// Enabled returns true if the limit actually limits anything.
+func (l Limit) Enabled() bool {
+	return l.Rate > 0
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// When the bucket will be full again, after which it can be forgotten
+	full time.Time
+}
+
+// Limiter tracks a token bucket per key.
+type Limiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+
+	// Allows tests to control time
+	now func() time.Time
+}
+
+// New creates an empty Limiter.
+func New() *Limiter {
+	return &Limiter{
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// Allow takes a token from the bucket of key and returns true if there was one
+// left. The limit is passed on each call so it can change at runtime; a bucket
+// never holds more than the burst of the current limit.
+func (l *Limiter) Allow(key string, limit Limit) bool {
+	if !limit.Enabled() {
+		return true
+	}
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	b.full = now.Add(time.Duration((burst - b.tokens) / limit.Rate * float64(time.Second)))
+	return allowed
+}
+
+// Len returns the number of buckets currently tracked.
+func (l *Limiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// sweep forgets buckets that are full again, as a new bucket starts out full
+// anyway. Must be called with the lock held.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if !now.Before(b.full) {
+			delete(l.buckets, key)
+		}
+	}
+}
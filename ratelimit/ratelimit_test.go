@@ -0,0 +1,78 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func newTestLimiter() (*Limiter, *clock) {
+	c := &clock{t: time.Unix(1000000, 0)}
+	l := New()
+	l.now = c.now
+	l.lastSweep = c.t
+	return l, c
+}
+
+func TestAllow(t *testing.T) {
+	l, c := newTestLimiter()
+	limit := Limit{Rate: 2, Burst: 3}
+
+	// The burst is allowed right away
+	for i := 0; i < 3; i++ {
+		assert.True(t, l.Allow("a", limit), "Request %d of burst denied", i)
+	}
+	assert.False(t, l.Allow("a", limit), "Request beyond burst allowed")
+
+	// Other keys have their own bucket
+	assert.True(t, l.Allow("b", limit), "Other key denied")
+
+	// Refills at 2 per second
+	c.advance(500 * time.Millisecond)
+	assert.True(t, l.Allow("a", limit), "Refilled token denied")
+	assert.False(t, l.Allow("a", limit), "Request beyond refill allowed")
+
+	// Never more than the burst
+	c.advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		assert.True(t, l.Allow("a", limit), "Request %d of burst denied", i)
+	}
+	assert.False(t, l.Allow("a", limit), "Request beyond burst allowed")
+}
+
+func TestDisabled(t *testing.T) {
+	l, _ := newTestLimiter()
+
+	for i := 0; i < 100; i++ {
+		assert.True(t, l.Allow("a", Limit{}), "Request denied without limit")
+	}
+	assert.Equal(t, 0, l.Len(), "Buckets tracked without limit")
+}
+
+func TestSweep(t *testing.T) {
+	l, c := newTestLimiter()
+	slow := Limit{Rate: 0.01, Burst: 1}
+	fast := Limit{Rate: 10, Burst: 1}
+
+	assert.True(t, l.Allow("slow", slow))
+	assert.True(t, l.Allow("fast", fast))
+	assert.Equal(t, 2, l.Len())
+
+	// After the sweep interval, only the fast bucket is full again
+	c.advance(sweepInterval)
+	assert.False(t, l.Allow("slow", slow), "Slow bucket refilled too early")
+	assert.Equal(t, 1, l.Len(), "Full bucket not forgotten")
+}
@@ -0,0 +1,151 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/linode/dhcpd-unnumbered/options"
+	ll "github.com/sirupsen/logrus"
+)
+
+// MapEntryJSON maps relayed clients to an interface name, as it exists in the
+// mapping file, i.e.
+//
+//	{"circuit-id": "Ethernet1/1", "remote-id": "tor1", "interface": "bm-r1-u1"}
+//	{"circuit-id": "0004000a010c", "interface": "bm-r1-u2"}
+//
+// Ids match as sent by the relay agent or hex encoded. Unset ids match
+// anything, but at least one must be set.
+type MapEntryJSON struct {
+	CircuitID string `json:"circuit-id"`
+	RemoteID  string `json:"remote-id"`
+	Interface string `json:"interface"`
+}
+
+// MapEntry is a parsed mapping.
+type MapEntry struct {
+	CircuitID string
+	RemoteID  string
+	Interface string
+}
+
+// ParseMap parses the content of a mapping file, a JSON list of entries.
+func ParseMap(b []byte) ([]MapEntry, error) {
+	var onDisk []MapEntryJSON
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&onDisk); err != nil {
+		return nil, err
+	}
+
+	entries := make([]MapEntry, 0, len(onDisk))
+	for i, e := range onDisk {
+		if e.CircuitID == "" && e.RemoteID == "" {
+			return nil, fmt.Errorf("entry %d: circuit-id or remote-id required", i)
+		}
+		if !options.ValidName(e.Interface) {
+			return nil, fmt.Errorf("entry %d: invalid interface name '%s'", i, e.Interface)
+		}
+		entries = append(entries, MapEntry(e))
+	}
+	return entries, nil
+}
+
+// Matches returns true if the client relayed by a is mapped by e.
+func (e *MapEntry) Matches(a *Agent) bool {
+	return matchID(e.CircuitID, a.CircuitID) && matchID(e.RemoteID, a.RemoteID)
+}
+
+func matchID(want string, id []byte) bool {
+	if want == "" {
+		return true
+	}
+	return len(id) > 0 && (want == string(id) || want == hex.EncodeToString(id))
+}
+
+// Map maps relayed clients to interface names as given in a mapping file. The
+// file is read again when it changed, which is checked on lookup. A file that
+// fails to parse is rejected and the previous mappings are kept, a missing
+// file maps nothing.
+type Map struct {
+	path string
+	log  *ll.Entry
+
+	mu      sync.Mutex
+	entries []MapEntry
+	modTime time.Time
+	size    int64
+}
+
+// NewMap returns the map of the mapping file at path. The file is only read
+// on lookup, so it doesn't need to exist yet.
+func NewMap(path string) *Map {
+	return &Map{
+		path: path,
+		log:  ll.NewEntry(ll.StandardLogger()).WithFields(ll.Fields{"component": "relay", "map": path}),
+	}
+}
+
+// Lookup returns the interface the client relayed by a is mapped to by the
+// first matching entry.
+func (m *Map) Lookup(a *Agent) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.reload()
+	for i := range m.entries {
+		if m.entries[i].Matches(a) {
+			return m.entries[i].Interface, true
+		}
+	}
+	return "", false
+}
+
+// Len returns the number of mappings.
+func (m *Map) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.reload()
+	return len(m.entries)
+}
+
+// reload reads the file again if it changed since it was last read.
+func (m *Map) reload() {
+	fi, err := os.Stat(m.path)
+	if errors.Is(err, os.ErrNotExist) {
+		if m.entries != nil {
+			m.log.Warnf("Mapping file is gone, not mapping relayed clients anymore")
+		}
+		m.entries, m.modTime, m.size = nil, time.Time{}, 0
+		return
+	}
+	if err != nil {
+		m.log.Errorf("Failed to stat mapping file, keeping the current mappings: %v", err)
+		return
+	}
+	if fi.ModTime().Equal(m.modTime) && fi.Size() == m.size {
+		return
+	}
+	// Only tried again once the file changes
+	m.modTime, m.size = fi.ModTime(), fi.Size()
+
+	b, err := os.ReadFile(m.path)
+	if err != nil {
+		m.log.Errorf("Failed to read mapping file, keeping the current mappings: %v", err)
+		return
+	}
+	entries, err := ParseMap(b)
+	if err != nil {
+		m.log.Errorf("Invalid mapping file, keeping the current mappings: %v", err)
+		return
+	}
+	m.entries = entries
+	m.log.Infof("Loaded %d relay agent mappings", len(entries))
+}
@@ -0,0 +1,80 @@
+package relay
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMap(t *testing.T) {
+	entries, err := ParseMap([]byte(`[
+  {"circuit-id": "Ethernet1/1", "remote-id": "tor1", "interface": "bm-r1-u1"},
+  {"circuit-id": "0004000a010c", "interface": "bm-r1-u2"},
+  {"remote-id": "tor2", "interface": "bm-r2"}
+]`))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(entries))
+
+	for _, content := range []string{
+		`{"circuit-id": "Ethernet1/1", "interface": "bm-r1-u1"}`,
+		`[{"interface": "bm-r1-u1"}]`,
+		`[{"circuit-id": "Ethernet1/1"}]`,
+		`[{"circuit-id": "Ethernet1/1", "interface": "../bm-r1-u1"}]`,
+		`[{"circuit-id": "Ethernet1/1", "interface": "bm-r1-u1", "vlan": 10}]`,
+	} {
+		_, err := ParseMap([]byte(content))
+		assert.NotNil(t, err, content)
+	}
+}
+
+func TestMapEntryMatches(t *testing.T) {
+	both := MapEntry{CircuitID: "Ethernet1/1", RemoteID: "tor1"}
+	assert.True(t, both.Matches(&Agent{CircuitID: []byte("Ethernet1/1"), RemoteID: []byte("tor1")}))
+	assert.False(t, both.Matches(&Agent{CircuitID: []byte("Ethernet1/1"), RemoteID: []byte("tor2")}))
+	assert.False(t, both.Matches(&Agent{CircuitID: []byte("Ethernet1/1")}))
+
+	binary := MapEntry{CircuitID: "0004000a010c"}
+	assert.True(t, binary.Matches(&Agent{CircuitID: []byte{0x00, 0x04, 0x00, 0x0a, 0x01, 0x0c}, RemoteID: []byte("tor1")}))
+	assert.False(t, binary.Matches(&Agent{RemoteID: []byte("tor1")}))
+}
+
+func TestMap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relay.json")
+	m := NewMap(path)
+	a := &Agent{CircuitID: []byte("Ethernet1/1"), RemoteID: []byte("tor1")}
+
+	// Nothing mapped without a file
+	_, ok := m.Lookup(a)
+	assert.False(t, ok)
+
+	write := func(content string, mtime time.Time) {
+		assert.Nil(t, os.WriteFile(path, []byte(content), 0644))
+		assert.Nil(t, os.Chtimes(path, mtime, mtime))
+	}
+	now := time.Now()
+	write(`[{"remote-id": "tor2", "interface": "bm-r2"}, {"circuit-id": "Ethernet1/1", "interface": "bm-r1-u1"}]`, now)
+	ifName, ok := m.Lookup(a)
+	assert.True(t, ok)
+	assert.Equal(t, "bm-r1-u1", ifName)
+	assert.Equal(t, 2, m.Len())
+
+	// Changes are picked up
+	write(`[{"remote-id": "tor1", "interface": "bm-r1"}, {"circuit-id": "Ethernet1/1", "interface": "bm-r1-u1"}]`, now.Add(time.Second))
+	ifName, ok = m.Lookup(a)
+	assert.True(t, ok)
+	assert.Equal(t, "bm-r1", ifName)
+
+	// An invalid file is rejected
+	write(`[{"remote-id": "tor1"}]`, now.Add(2*time.Second))
+	ifName, ok = m.Lookup(a)
+	assert.True(t, ok)
+	assert.Equal(t, "bm-r1", ifName)
+
+	assert.Nil(t, os.Remove(path))
+	_, ok = m.Lookup(a)
+	assert.False(t, ok)
+	assert.Equal(t, 0, m.Len())
+}
@@ -0,0 +1,60 @@
+// Package relay handles requests forwarded by DHCP relay agents, i.e. the
+// top of rack switches in front of bare-metal hosts. Such requests don't come
+// from a tap, the client is told apart by the relay agent information the
+// agent adds instead (option 82, RFC 3046).
+package relay
+
+import (
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/linode/dhcpd-unnumbered/options"
+)
+
+// Agent is the relay agent a request was forwarded by.
+type Agent struct {
+	// Addr is the address of the agent on the client's network (giaddr),
+	// replies go there
+	Addr net.IP
+	// Sub-options of option 82, nil if not sent
+	CircuitID []byte
+	RemoteID  []byte
+	// SourcePort is set if the agent sent the relay source port sub-option,
+	// replies then go to the port the request came from (RFC 8357)
+	SourcePort bool
+}
+
+// FromRequest returns the agent req was forwarded by, nil if req came from
+// the client itself.
+func FromRequest(req *dhcpv4.DHCPv4) *Agent {
+	if req.GatewayIPAddr == nil || req.GatewayIPAddr.IsUnspecified() {
+		return nil
+	}
+	a := &Agent{Addr: req.GatewayIPAddr}
+	if info := req.RelayAgentInfo(); info != nil {
+		a.CircuitID = info.Get(dhcpv4.AgentCircuitIDSubOption)
+		a.RemoteID = info.Get(dhcpv4.AgentRemoteIDSubOption)
+		a.SourcePort = info.Has(dhcpv4.RelaySourcePortSubOption)
+	}
+	return a
+}
+
+// Identity returns the name the client is known by in place of a tap name:
+// the circuit-id, or the remote-id if there is none. Printable ids are used
+// as they are, except for characters that don't belong into a file name,
+// others are hex encoded. Empty if the agent sent neither.
+func (a *Agent) Identity() string {
+	if len(a.CircuitID) > 0 {
+		return options.SafeName(a.CircuitID)
+	}
+	return options.SafeName(a.RemoteID)
+}
+
+// Peer returns the address replies to requests from src go to.
+func (a *Agent) Peer(src *net.UDPAddr) *net.UDPAddr {
+	port := dhcpv4.ServerPort
+	if a.SourcePort && src != nil && src.Port != 0 {
+		port = src.Port
+	}
+	return &net.UDPAddr{IP: a.Addr, Port: port}
+}
@@ -0,0 +1,86 @@
+package relay
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+)
+
+func relayed(t *testing.T, subs ...dhcpv4.Option) *dhcpv4.DHCPv4 {
+	req, err := dhcpv4.New(
+		dhcpv4.WithGatewayIP(net.IPv4(192, 0, 2, 1)),
+		dhcpv4.WithOption(dhcpv4.OptRelayAgentInfo(subs...)),
+	)
+	assert.Nil(t, err)
+	return req
+}
+
+func circuitID(id string) dhcpv4.Option {
+	return dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte(id))
+}
+
+func remoteID(id string) dhcpv4.Option {
+	return dhcpv4.OptGeneric(dhcpv4.AgentRemoteIDSubOption, []byte(id))
+}
+
+func TestFromRequest(t *testing.T) {
+	req, err := dhcpv4.New()
+	assert.Nil(t, err)
+	assert.Nil(t, FromRequest(req), "Not relayed")
+
+	a := FromRequest(relayed(t, circuitID("Ethernet1/1"), remoteID("tor1")))
+	if assert.NotNil(t, a) {
+		assert.Equal(t, "192.0.2.1", a.Addr.String())
+		assert.Equal(t, []byte("Ethernet1/1"), a.CircuitID)
+		assert.Equal(t, []byte("tor1"), a.RemoteID)
+		assert.False(t, a.SourcePort)
+	}
+
+	// Relay agents that don't add option 82
+	req.GatewayIPAddr = net.IPv4(192, 0, 2, 1)
+	a = FromRequest(req)
+	if assert.NotNil(t, a) {
+		assert.Nil(t, a.CircuitID)
+		assert.Equal(t, "", a.Identity())
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	tests := []struct {
+		circuit, remote string
+		identity        string
+	}{
+		{"Ethernet1/1", "tor1", "Ethernet1_1"},
+		{"", "tor1", "tor1"},
+		{"swp12", "", "swp12"},
+		{"../../etc/passwd", "", "_._.._etc_passwd"},
+		{"vlan 10", "", "766c616e203130"},
+		{"\x00\x04\x00\x0a\x01\x0c", "", "0004000a010c"},
+	}
+
+	for _, tc := range tests {
+		a := &Agent{}
+		if tc.circuit != "" {
+			a.CircuitID = []byte(tc.circuit)
+		}
+		if tc.remote != "" {
+			a.RemoteID = []byte(tc.remote)
+		}
+		assert.Equal(t, tc.identity, a.Identity(), "%q/%q", tc.circuit, tc.remote)
+	}
+}
+
+func TestPeer(t *testing.T) {
+	src := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 10067}
+
+	a := FromRequest(relayed(t, circuitID("swp1")))
+	assert.Equal(t, "192.0.2.1:67", a.Peer(src).String())
+
+	// RFC 8357
+	a = FromRequest(relayed(t, circuitID("swp1"), dhcpv4.OptGeneric(dhcpv4.RelaySourcePortSubOption, nil)))
+	assert.True(t, a.SourcePort)
+	assert.Equal(t, "192.0.2.1:10067", a.Peer(src).String())
+	assert.Equal(t, "192.0.2.1:67", a.Peer(nil).String())
+}
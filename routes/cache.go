@@ -0,0 +1,232 @@
+package routes
+
+// Cache IPv4 host routes (/32) per routing table and interface. The cache is
+// filled from a full dump of all tables and then kept current through netlink
+// route notifications, instead of dumping the table on every request.
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	ll "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// How long to wait before resyncing after the subscription failed
+const resyncDelay = time.Second
+
+// Size of the buffer for route notifications. If we fall behind further, the
+// kernel drops notifications and the subscription fails with ENOBUFS, which
+// triggers a resync.
+const updateBuffer = 1024
+
+type key struct {
+	table   int
+	ifindex int
+}
+
+// Cache holds the host routes of all tables, keyed by table and interface.
+type Cache struct {
+	log  *ll.Entry
+	done chan struct{}
+	// Namespace of the routes, not open for the daemon's own namespace
+	ns netns.NsHandle
+
+	mu sync.RWMutex
+	// Host routes by destination IP
+	routes map[key]map[string]*net.IPNet
+	// False until the first sync and while resyncing
+	synced bool
+}
+
+// NewCache creates an empty route cache. Call Run to fill it.
+func NewCache() *Cache {
+	return NewCacheAt(netns.None())
+}
+
+// NewCacheAt creates an empty cache for the routes in namespace ns. The handle
+// must stay open until the cache is closed.
+func NewCacheAt(ns netns.NsHandle) *Cache {
+	return &Cache{
+		log:    ll.NewEntry(ll.StandardLogger()).WithFields(ll.Fields{"component": "routes"}),
+		done:   make(chan struct{}),
+		ns:     ns,
+		routes: make(map[key]map[string]*net.IPNet),
+	}
+}
+
+// Close stops keeping the cache current.
+func (c *Cache) Close() {
+	close(c.done)
+}
+
+// Routes returns the host routes pointing to interface ifindex in table,
+// sorted by IP. ok is false if the cache is not in sync with the kernel, in
+// which case the caller has to look the routes up by itself.
+func (c *Cache) Routes(table, ifindex int) (routes []*net.IPNet, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if !c.synced {
+		return nil, false
+	}
+
+	for _, r := range c.routes[key{table: table, ifindex: ifindex}] {
+		routes = append(routes, r)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return bytes.Compare(routes[i].IP.To4(), routes[j].IP.To4()) < 0
+	})
+	return routes, true
+}
+
+// Run fills the cache and keeps it current. If the subscription fails, the
+// cache is resynced from scratch. Blocks until Close is called.
+func (c *Cache) Run() error {
+	for {
+		err := c.sync()
+		select {
+		case <-c.done:
+			c.log.Info("Route cache closed")
+			return nil
+		default:
+		}
+
+		c.log.Warnf("Route subscription failed, resyncing: %v", err)
+		c.setSynced(false)
+
+		select {
+		case <-c.done:
+			return nil
+		case <-time.After(resyncDelay):
+		}
+	}
+}
+
+func (c *Cache) setSynced(synced bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.synced = synced
+}
+
+// sync subscribes to route changes, dumps all tables and applies the changes
+// as they come in. Returns once the subscription fails or Close is called.
+func (c *Cache) sync() error {
+	updates := make(chan netlink.RouteUpdate, updateBuffer)
+	errs := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+
+	// Subscribe before dumping, so no change gets lost in between. Changes
+	// that made it into the dump as well are applied twice, which is fine.
+	err := netlink.RouteSubscribeWithOptions(updates, done, netlink.RouteSubscribeOptions{
+		Namespace: &c.ns,
+		ErrorCallback: func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to subscribe to routes: %v", err)
+	}
+
+	nlh, err := netlink.NewHandleAt(c.ns)
+	if err != nil {
+		return fmt.Errorf("unable to hook into netlink: %v", err)
+	}
+	defer nlh.Delete()
+
+	dump, err := nlh.RouteListFiltered(unix.AF_INET, &netlink.Route{Table: unix.RT_TABLE_UNSPEC}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return fmt.Errorf("unable to get routes: %v", err)
+	}
+
+	routes := make(map[key]map[string]*net.IPNet)
+	for _, r := range dump {
+		add(routes, r)
+	}
+
+	c.mu.Lock()
+	c.routes = routes
+	c.synced = true
+	c.mu.Unlock()
+	c.log.Infof("Route cache synced with %d routes", len(dump))
+
+	for {
+		select {
+		case <-c.done:
+			return nil
+		case u, ok := <-updates:
+			if !ok {
+				select {
+				case err := <-errs:
+					return err
+				default:
+					return fmt.Errorf("subscription closed")
+				}
+			}
+			c.apply(u)
+		}
+	}
+}
+
+// apply a single route notification.
+func (c *Cache) apply(u netlink.RouteUpdate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch u.Type {
+	case unix.RTM_NEWROUTE:
+		if add(c.routes, u.Route) {
+			c.log.Debugf("Route added %s", u.Route)
+		}
+	case unix.RTM_DELROUTE:
+		if del(c.routes, u.Route) {
+			c.log.Debugf("Route removed %s", u.Route)
+		}
+	}
+}
+
+// isHostRoute returns true if r is an IPv4 /32 via an interface.
+func isHostRoute(r netlink.Route) bool {
+	if r.LinkIndex == 0 || r.Dst == nil || r.Dst.IP.To4() == nil {
+		return false
+	}
+	m, l := r.Dst.Mask.Size()
+	return m == 32 && l == 32
+}
+
+func add(routes map[key]map[string]*net.IPNet, r netlink.Route) bool {
+	if !isHostRoute(r) {
+		return false
+	}
+	k := key{table: r.Table, ifindex: r.LinkIndex}
+	if routes[k] == nil {
+		routes[k] = make(map[string]*net.IPNet)
+	}
+	routes[k][r.Dst.IP.String()] = r.Dst
+	return true
+}
+
+func del(routes map[key]map[string]*net.IPNet, r netlink.Route) bool {
+	if !isHostRoute(r) {
+		return false
+	}
+	k := key{table: r.Table, ifindex: r.LinkIndex}
+	if _, ok := routes[k][r.Dst.IP.String()]; !ok {
+		return false
+	}
+	delete(routes[k], r.Dst.IP.String())
+	if len(routes[k]) == 0 {
+		delete(routes, k)
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package routes
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func route(dst string, table, ifindex int) netlink.Route {
+	_, ipnet, err := net.ParseCIDR(dst)
+	if err != nil {
+		panic(err)
+	}
+	return netlink.Route{Dst: ipnet, Table: table, LinkIndex: ifindex}
+}
+
+func TestApply(t *testing.T) {
+	c := NewCache()
+	c.synced = true
+
+	updates := []netlink.RouteUpdate{
+		{Type: unix.RTM_NEWROUTE, Route: route("10.0.0.9/32", 254, 3)},
+		{Type: unix.RTM_NEWROUTE, Route: route("10.0.0.2/32", 254, 3)},
+		{Type: unix.RTM_NEWROUTE, Route: route("10.0.0.5/32", 254, 3)},
+		// Applied twice, as after a dump
+		{Type: unix.RTM_NEWROUTE, Route: route("10.0.0.5/32", 254, 3)},
+		// Other table and interface
+		{Type: unix.RTM_NEWROUTE, Route: route("10.0.0.7/32", 100, 3)},
+		{Type: unix.RTM_NEWROUTE, Route: route("10.0.0.8/32", 254, 4)},
+		// Not host routes
+		{Type: unix.RTM_NEWROUTE, Route: route("10.0.1.0/24", 254, 3)},
+		{Type: unix.RTM_NEWROUTE, Route: route("2001:db8::1/128", 254, 3)},
+		{Type: unix.RTM_NEWROUTE, Route: netlink.Route{Table: 254, LinkIndex: 3}},
+		// Removed again
+		{Type: unix.RTM_DELROUTE, Route: route("10.0.0.9/32", 254, 3)},
+		// Unknown
+		{Type: unix.RTM_DELROUTE, Route: route("10.0.0.1/32", 254, 3)},
+	}
+	for _, u := range updates {
+		c.apply(u)
+	}
+
+	rts, ok := c.Routes(254, 3)
+	assert.True(t, ok)
+	if assert.Equal(t, 2, len(rts)) {
+		assert.Equal(t, "10.0.0.2/32", rts[0].String(), "Bad first route")
+		assert.Equal(t, "10.0.0.5/32", rts[1].String(), "Bad second route")
+	}
+
+	rts, _ = c.Routes(100, 3)
+	assert.Equal(t, 1, len(rts), "Bad routes in other table")
+	rts, _ = c.Routes(254, 4)
+	assert.Equal(t, 1, len(rts), "Bad routes on other interface")
+	rts, _ = c.Routes(254, 5)
+	assert.Equal(t, 0, len(rts), "Bad routes on unknown interface")
+
+	c.apply(netlink.RouteUpdate{Type: unix.RTM_DELROUTE, Route: route("10.0.0.7/32", 100, 3)})
+	assert.Equal(t, 2, len(c.routes), "Empty interface not removed")
+}
+
+func TestNotSynced(t *testing.T) {
+	c := NewCache()
+	c.apply(netlink.RouteUpdate{Type: unix.RTM_NEWROUTE, Route: route("10.0.0.2/32", 254, 3)})
+
+	_, ok := c.Routes(254, 3)
+	assert.False(t, ok, "Unsynced cache used")
+}
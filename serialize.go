@@ -1,23 +1,39 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"net"
+	"sort"
+	"sync"
 	"syscall"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/insomniacslk/dhcp/dhcpv4"
-	ll "github.com/sirupsen/logrus"
 )
 
-// function to wrap dhcp response with appropriate ip and udp headers
-// for clients that require a UDP checksum
-func sendPacket(peer *net.UDPAddr, peerMAC net.HardwareAddr, ifi net.Interface, resp *dhcpv4.DHCPv4) error {
+// ErrSenderClosed is returned when sending through a closed rawSender.
+var ErrSenderClosed = errors.New("raw sender closed")
 
+// Serialization buffers, reused across replies
+var frameBufs = sync.Pool{
+	New: func() any { return gopacket.NewSerializeBuffer() },
+}
+
+// serializeReply wraps the dhcp response payload with appropriate ethernet, ip
+// and udp headers (for clients that require a UDP checksum), from src and the
+// MAC of ifi to peer/peerMAC. buf is cleared before use.
+func serializeReply(buf gopacket.SerializeBuffer, src net.IP, peer *net.UDPAddr, peerMAC net.HardwareAddr, ifi *net.Interface, payload []byte) error {
+	eth := layers.Ethernet{
+		EthernetType: layers.EthernetTypeIPv4,
+		SrcMAC:       ifi.HardwareAddr,
+		DstMAC:       peerMAC,
+	}
 	ip := layers.IPv4{
 		Version:  4,
 		TTL:      64,
-		SrcIP:    resp.ServerIPAddr,
+		SrcIP:    src,
 		DstIP:    peer.IP,
 		Protocol: layers.IPProtocolUDP,
 		Flags:    layers.IPv4DontFragment,
@@ -29,68 +45,183 @@ func sendPacket(peer *net.UDPAddr, peerMAC net.HardwareAddr, ifi net.Interface,
 
 	err := udp.SetNetworkLayerForChecksum(&ip)
 	if err != nil {
-		ll.Errorf("err: %v", err)
 		return err
 	}
 
-	buf := gopacket.NewSerializeBuffer()
 	opts := gopacket.SerializeOptions{
 		ComputeChecksums: true,
 		FixLengths:       true,
 	}
 
-	pkt := gopacket.NewPacket(resp.ToBytes(), layers.LayerTypeDHCPv4, gopacket.NoCopy)
-	dhcpLayer := pkt.Layer(layers.LayerTypeDHCPv4)
-	dhcp, ok := dhcpLayer.(gopacket.SerializableLayer)
-	if !ok {
-		ll.Errorf("layer %s is not serializable", dhcpLayer.LayerType().String())
-		return err
-	}
-
-	eth := layers.Ethernet{
-		EthernetType: layers.EthernetTypeIPv4,
-		SrcMAC:       ifi.HardwareAddr,
-		DstMAC:       peerMAC,
-	}
+	// SerializeLayers clears buf before use
+	return gopacket.SerializeLayers(buf, opts, &eth, &ip, &udp, gopacket.Payload(payload))
+}
 
-	err = gopacket.SerializeLayers(buf, opts, &eth, &ip, &udp, dhcp)
-	if err != nil {
-		ll.Errorf("err serialize layer: %v", err)
-		return err
-	}
-	data := buf.Bytes()
+// rawSender sends frames through a raw AF_PACKET socket. The socket is opened
+// once and reused for every reply on any interface, until the sender is
+// closed.
+type rawSender struct {
+	// Protects fd from being closed while sending
+	mu sync.RWMutex
+	fd int
+}
 
+// newRawSender opens the raw socket used to send replies.
+func newRawSender() (*rawSender, error) {
+	// Protocol 0 means we never receive anything on this socket
 	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
 	if err != nil {
-		ll.Errorf("sendPacket: cannot open socket: %v", err)
-		return err
+		return nil, err
 	}
-	defer func() {
-		err = syscall.Close(fd)
-		if err != nil {
-			ll.Errorf("sendPacket: cannot close socket: %v", err)
-		}
-	}()
 
-	err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
-	if err != nil {
-		ll.Errorf("send packet: cannot set option for socket: %v", err)
-		return err
+	return &rawSender{fd: fd}, nil
+}
+
+// Close closes the raw socket. Sending afterwards fails with ErrSenderClosed.
+func (s *rawSender) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fd < 0 {
+		return nil
 	}
+	err := syscall.Close(s.fd)
+	s.fd = -1
+	return err
+}
 
+// Send sends frame out on the interface with index ifindex.
+func (s *rawSender) Send(frame []byte, ifindex int) error {
+	// The destination MAC is taken from the frame itself, this is not used
 	var hwAddr [8]byte
-	copy(hwAddr[0:6], resp.ClientHWAddr[0:6])
+	copy(hwAddr[0:6], frame)
 
 	ethAddr := syscall.SockaddrLinklayer{
 		Protocol: 0,
-		Ifindex:  ifi.Index,
+		Ifindex:  ifindex,
 		Halen:    6,
-		Addr:     hwAddr, //not used
+		Addr:     hwAddr,
 	}
-	err = syscall.Sendto(fd, data, 0, &ethAddr)
-	if err != nil {
-		ll.Errorf("cannot send frame via socket: %v", err)
-		return err
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.fd < 0 {
+		return ErrSenderClosed
+	}
+
+	if err := syscall.Sendto(s.fd, frame, 0, &ethAddr); err != nil {
+		return fmt.Errorf("cannot send frame via socket: %v", err)
 	}
 	return nil
 }
+
+// Offsets and lengths of the BOOTP header fields reused for options
+const (
+	snameOffset = 44
+	snameLen    = 64
+	fileOffset  = 108
+	fileLen     = 128
+	// The fixed header up to the file field plus the magic cookie
+	optionsOffset = 240
+)
+
+// maxReplySize returns the length of the longest DHCP message, without IP and
+// UDP headers, the client sending req accepts (RFC 2132 9.10).
+func maxReplySize(req *dhcpv4.DHCPv4) int {
+	size, err := req.MaxMessageSize()
+	if err != nil || size < dhcpv4.MaxMessageSize {
+		size = dhcpv4.MaxMessageSize
+	}
+	// IP and UDP headers
+	return int(size) - 28
+}
+
+// overloadField is a header field options are continued in.
+type overloadField struct {
+	offset int
+	len    int
+	// Value of option overload announcing the field
+	flag byte
+	buf  []byte
+}
+
+// encodeReply serializes resp into at most size bytes. If the options don't
+// fit, they are continued in the file and sname fields as long as those are
+// unused, announced by option overload (RFC 2132 9.3). Returns false if resp
+// doesn't fit even so, it's serialized in full anyway.
+func encodeReply(resp *dhcpv4.DHCPv4, size int) ([]byte, bool) {
+	b := resp.ToBytes()
+	if len(b) <= size {
+		return b, true
+	}
+
+	var fields []overloadField
+	if resp.BootFileName == "" {
+		fields = append(fields, overloadField{offset: fileOffset, len: fileLen, flag: 1})
+	}
+	if resp.ServerHostName == "" {
+		fields = append(fields, overloadField{offset: snameOffset, len: snameLen, flag: 2})
+	}
+	if len(fields) == 0 {
+		return b, false
+	}
+
+	var codes []int
+	for code := range resp.Options {
+		if code != dhcpv4.OptionPad.Code() && code != dhcpv4.OptionEnd.Code() {
+			codes = append(codes, int(code))
+		}
+	}
+	// Relay agents look for option 82 in the options field only, so it gets
+	// placed first
+	sort.Slice(codes, func(i, j int) bool {
+		if relay := int(dhcpv4.OptionRelayAgentInformation.Code()); codes[i] == relay || codes[j] == relay {
+			return codes[i] == relay
+		}
+		return codes[i] < codes[j]
+	})
+
+	// Each option goes into the first place it fits, leaving room for the
+	// option overload and end options in the options field, and for the end
+	// option in the header fields
+	main := dhcpv4.Options{}
+	room := size - optionsOffset - 3 - 1
+	var overload byte
+	for _, c := range codes {
+		code := uint8(c)
+		chunk := dhcpv4.Options{code: resp.Options[code]}.ToBytes()
+		if len(chunk) <= room {
+			main[code] = resp.Options[code]
+			room -= len(chunk)
+			continue
+		}
+
+		placed := false
+		for i := range fields {
+			f := &fields[i]
+			if len(f.buf)+len(chunk) <= f.len-1 {
+				f.buf = append(f.buf, chunk...)
+				overload |= f.flag
+				placed = true
+				break
+			}
+		}
+		if !placed {
+			return b, false
+		}
+	}
+	main[dhcpv4.OptionOptionOverload.Code()] = []byte{overload}
+
+	out := *resp
+	out.Options = main
+	b = out.ToBytes()
+	for _, f := range fields {
+		if len(f.buf) == 0 {
+			continue
+		}
+		field := b[f.offset : f.offset+f.len]
+		n := copy(field, f.buf)
+		field[n] = dhcpv4.OptionEnd.Code()
+	}
+	return b, true
+}
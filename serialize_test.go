@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/linode/dhcpd-unnumbered/boot"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxReplySize(t *testing.T) {
+	req, err := dhcpv4.New()
+	assert.Nil(t, err)
+	assert.Equal(t, 548, maxReplySize(req))
+
+	req.UpdateOption(dhcpv4.OptMaxMessageSize(1500))
+	assert.Equal(t, 1472, maxReplySize(req))
+
+	// Below the minimum every client has to accept
+	req.UpdateOption(dhcpv4.OptMaxMessageSize(300))
+	assert.Equal(t, 548, maxReplySize(req))
+}
+
+// decodeOverloaded returns the options of b, including those continued in the
+// header fields announced by option overload.
+func decodeOverloaded(t *testing.T, b []byte) dhcpv4.Options {
+	opts := dhcpv4.Options{}
+	assert.Nil(t, opts.FromBytes(b[optionsOffset:]))
+	overload := opts.Get(dhcpv4.OptionOptionOverload)
+	if len(overload) == 1 {
+		if overload[0]&1 != 0 {
+			assert.Nil(t, opts.FromBytes(b[fileOffset:fileOffset+fileLen]))
+		}
+		if overload[0]&2 != 0 {
+			assert.Nil(t, opts.FromBytes(b[snameOffset:snameOffset+snameLen]))
+		}
+	}
+	return opts
+}
+
+func TestEncodeReply(t *testing.T) {
+	newReply := func(mods ...dhcpv4.Modifier) *dhcpv4.DHCPv4 {
+		resp, err := dhcpv4.New(append([]dhcpv4.Modifier{
+			dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer),
+			dhcpv4.WithYourIP(net.IPv4(203, 0, 113, 7)),
+			dhcpv4.WithOption(dhcpv4.OptHostName("guest")),
+		}, mods...)...)
+		assert.Nil(t, err)
+		return resp
+	}
+	filler := func(code uint8, n int) dhcpv4.Modifier {
+		return dhcpv4.WithGeneric(dhcpv4.GenericOptionCode(code), bytes.Repeat([]byte{'x'}, n))
+	}
+
+	// Fits as it is
+	resp := newReply()
+	b, ok := encodeReply(resp, 548)
+	assert.True(t, ok)
+	assert.Equal(t, resp.ToBytes(), b)
+
+	// Continued in file, then sname
+	resp = newReply(filler(224, 250), filler(225, 120), filler(226, 50))
+	assert.Greater(t, len(resp.ToBytes()), 548)
+	b, ok = encodeReply(resp, 548)
+	assert.True(t, ok)
+	assert.LessOrEqual(t, len(b), 548)
+	opts := decodeOverloaded(t, b)
+	assert.Equal(t, []byte{3}, opts.Get(dhcpv4.OptionOptionOverload))
+	delete(opts, dhcpv4.OptionOptionOverload.Code())
+	assert.Equal(t, resp.Options, opts)
+
+	// The header fields are still decoded by the library
+	decoded, err := dhcpv4.FromBytes(b)
+	assert.Nil(t, err)
+	assert.Equal(t, dhcpv4.MessageTypeOffer, decoded.MessageType())
+	assert.Equal(t, "guest", decoded.HostName())
+
+	// Only what's free is used
+	resp = newReply(filler(224, 250), filler(225, 50), dhcpv4.WithGeneric(dhcpv4.OptionBootfileName, []byte("ipxe.efi")))
+	resp.BootFileName = "ipxe.efi"
+	b, ok = encodeReply(resp, 548)
+	assert.True(t, ok)
+	assert.LessOrEqual(t, len(b), 548)
+	assert.Equal(t, "ipxe.efi", string(bytes.TrimRight(b[fileOffset:fileOffset+fileLen], "\x00")))
+	opts = decodeOverloaded(t, b)
+	assert.Equal(t, []byte{2}, opts.Get(dhcpv4.OptionOptionOverload))
+
+	// Doesn't fit at all
+	resp = newReply(filler(224, 250), filler(225, 250), filler(226, 250))
+	b, ok = encodeReply(resp, 548)
+	assert.False(t, ok)
+	assert.Equal(t, resp.ToBytes(), b)
+
+	// Doesn't fit and the fields are taken
+	resp = newReply(filler(224, 250), filler(225, 100))
+	resp.BootFileName = "ipxe.efi"
+	resp.ServerHostName = "192.0.2.69"
+	_, ok = encodeReply(resp, 548)
+	assert.False(t, ok)
+}
+
+func TestBootModifiers(t *testing.T) {
+	long := "http://boot.example.com/" + string(bytes.Repeat([]byte{'x'}, 120))
+
+	tests := []struct {
+		name     string
+		delivery boot.Delivery
+		bootfile string
+		tftp     string
+
+		file, sname     string
+		option67, opt66 bool
+	}{
+		{"nothing", boot.DeliverBoth, "", "", "", "", false, false},
+		{"both", boot.DeliverBoth, "ipxe.efi", "192.0.2.69", "ipxe.efi", "192.0.2.69", true, true},
+		{"header", boot.DeliverHeader, "ipxe.efi", "192.0.2.69", "ipxe.efi", "192.0.2.69", false, false},
+		{"options", boot.DeliverOptions, "ipxe.efi", "192.0.2.69", "", "", true, true},
+		{"too long for header", boot.DeliverHeader, long, "192.0.2.69", "", "192.0.2.69", true, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := dhcpv4.New(bootModifiers(tc.delivery, tc.bootfile, tc.tftp)...)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.file, resp.BootFileName)
+			assert.Equal(t, tc.sname, resp.ServerHostName)
+			assert.Equal(t, tc.option67, resp.Options.Has(dhcpv4.OptionBootfileName))
+			assert.Equal(t, tc.opt66, resp.Options.Has(dhcpv4.OptionTFTPServerName))
+			if tc.option67 {
+				assert.Equal(t, tc.bootfile, resp.BootFileNameOption())
+			}
+		})
+	}
+}
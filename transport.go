@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/net/ipv4"
+)
+
+// Receiver is where a listener reads requests from.
+type Receiver interface {
+	// Receive reads a request into buf. Returns its length, the index of the
+	// interface it came in on and where it came from.
+	Receive(buf []byte) (n int, ifindex int, src *net.UDPAddr, err error)
+	// SetBPF replaces the filter deciding which packets are received.
+	SetBPF(filter []bpf.RawInstruction) error
+	LocalAddr() net.Addr
+	Close() error
+}
+
+// Sender is where a listener sends replies to.
+type Sender interface {
+	// Send sends an Ethernet frame out on the interface with index ifindex.
+	Send(frame []byte, ifindex int) error
+	Close() error
+}
+
+// RelaySender sends replies to relay agents, which are routed by the kernel
+// rather than framed for a link. Receivers able to do so implement it.
+type RelaySender interface {
+	// SendTo sends a DHCP message to peer.
+	SendTo(payload []byte, peer *net.UDPAddr) error
+}
+
+// udpReceiver receives requests on a UDP socket.
+type udpReceiver struct {
+	*ipv4.PacketConn
+}
+
+// Receive reads a request. Unless the socket is bound to an interface, the
+// interface comes from the control message.
+func (r udpReceiver) Receive(buf []byte) (int, int, *net.UDPAddr, error) {
+	n, cm, addr, err := r.ReadFrom(buf)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	// An index of 0 fails the interface lookup, so the request gets dropped
+	ifindex := 0
+	if cm != nil {
+		ifindex = cm.IfIndex
+	}
+	src, _ := addr.(*net.UDPAddr)
+	return n, ifindex, src, nil
+}
+
+// SendTo sends a reply to a relay agent from the listening socket, so it
+// comes from the server port.
+func (r udpReceiver) SendTo(payload []byte, peer *net.UDPAddr) error {
+	_, err := r.WriteTo(payload, nil, peer)
+	return err
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/bpf"
+)
+
+// fakeFrame is a frame sent through a fakeTransport.
+type fakeFrame struct {
+	frame   []byte
+	ifindex int
+}
+
+// fakeDatagram is a message sent to a relay agent through a fakeTransport.
+type fakeDatagram struct {
+	payload []byte
+	peer    *net.UDPAddr
+}
+
+type fakePacket struct {
+	payload []byte
+	ifindex int
+	src     *net.UDPAddr
+}
+
+// fakeTransport is an in-memory Receiver, Sender and RelaySender. Packets
+// given to inject are received, frames sent show up on sent and messages to
+// relay agents on relayed.
+type fakeTransport struct {
+	in      chan fakePacket
+	sent    chan fakeFrame
+	relayed chan fakeDatagram
+
+	mu     sync.Mutex
+	filter []bpf.RawInstruction
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newFakeTransport() *fakeTransport {
+	return &fakeTransport{
+		in:      make(chan fakePacket),
+		sent:    make(chan fakeFrame, 16),
+		relayed: make(chan fakeDatagram, 16),
+		closed:  make(chan struct{}),
+	}
+}
+
+// inject hands payload to the listener as received on ifindex from a client.
+func (f *fakeTransport) inject(payload []byte, ifindex int) {
+	f.injectFrom(payload, ifindex, &net.UDPAddr{IP: net.IPv4zero, Port: 68})
+}
+
+// injectFrom hands payload to the listener as received on ifindex from src.
+func (f *fakeTransport) injectFrom(payload []byte, ifindex int, src *net.UDPAddr) {
+	f.in <- fakePacket{payload, ifindex, src}
+}
+
+func (f *fakeTransport) Receive(buf []byte) (int, int, *net.UDPAddr, error) {
+	select {
+	case p := <-f.in:
+		return copy(buf, p.payload), p.ifindex, p.src, nil
+	case <-f.closed:
+		return 0, 0, nil, net.ErrClosed
+	}
+}
+
+func (f *fakeTransport) SetBPF(filter []bpf.RawInstruction) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.filter = filter
+	return nil
+}
+
+func (f *fakeTransport) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4zero, Port: 67}
+}
+
+func (f *fakeTransport) Send(frame []byte, ifindex int) error {
+	select {
+	case <-f.closed:
+		return ErrSenderClosed
+	default:
+	}
+	// The frame buffer is reused once Send returns
+	f.sent <- fakeFrame{append([]byte(nil), frame...), ifindex}
+	return nil
+}
+
+func (f *fakeTransport) SendTo(payload []byte, peer *net.UDPAddr) error {
+	select {
+	case <-f.closed:
+		return net.ErrClosed
+	default:
+	}
+	f.relayed <- fakeDatagram{append([]byte(nil), payload...), peer}
+	return nil
+}
+
+func (f *fakeTransport) Close() error {
+	f.closeOnce.Do(func() { close(f.closed) })
+	return nil
+}
+
+// fakePacketConn is an in-memory net.PacketConn. Datagrams given to inject are
+// read, those written show up on written.
+type fakePacketConn struct {
+	in      chan fakeDatagram
+	written chan fakeDatagram
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newFakePacketConn() *fakePacketConn {
+	return &fakePacketConn{
+		in:      make(chan fakeDatagram),
+		written: make(chan fakeDatagram, 16),
+		closed:  make(chan struct{}),
+	}
+}
+
+// inject hands payload to the listener as received from peer.
+func (f *fakePacketConn) inject(payload []byte, peer *net.UDPAddr) {
+	f.in <- fakeDatagram{payload, peer}
+}
+
+func (f *fakePacketConn) ReadFrom(buf []byte) (int, net.Addr, error) {
+	select {
+	case d := <-f.in:
+		return copy(buf, d.payload), d.peer, nil
+	case <-f.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (f *fakePacketConn) WriteTo(payload []byte, addr net.Addr) (int, error) {
+	select {
+	case <-f.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	f.written <- fakeDatagram{append([]byte(nil), payload...), addr.(*net.UDPAddr)}
+	return len(payload), nil
+}
+
+func (f *fakePacketConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv6unspecified, Port: 547}
+}
+
+func (f *fakePacketConn) SetDeadline(t time.Time) error      { return nil }
+func (f *fakePacketConn) SetReadDeadline(t time.Time) error  { return nil }
+func (f *fakePacketConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (f *fakePacketConn) Close() error {
+	f.closeOnce.Do(func() { close(f.closed) })
+	return nil
+}